@@ -11,11 +11,12 @@ import (
 func (app *App) addCommand(cmd *cli.Cmd) {
   const SimilarChars = "5SB8|1IiLl0Oo"
 
-  cmd.Spec = "[--login] [--realm] [--note] [--no-copy] [--gen [--length] [--min-length] [--max-length] [--no-upper] [--no-lower] [--no-digit] [--no-symbol] [--no-similar] [--min-upper] [--max-upper] [--min-lower] [--max-lower] [--min-digit] [--max-digit] [--min-symbol] [--max-symbol] [--exclude]]"
+  cmd.Spec = "[--login] [--realm] [--note] [--tag...] [--no-copy] [--gen [--length] [--min-length] [--max-length] [--no-upper] [--no-lower] [--no-digit] [--no-symbol] [--no-similar] [--min-upper] [--max-upper] [--min-lower] [--max-lower] [--min-digit] [--max-digit] [--min-symbol] [--max-symbol] [--exclude]]"
 
   login := cmd.StringOpt("login", "", "Login for credential, e.g. username or email.")
   realm := cmd.StringOpt("realm", "", "Realm for credential, e.g. website or WiFi AP name.")
   note := cmd.StringOpt("note", "", "Note for credential.")
+  tags := cmd.StringsOpt("tag", nil, "Tag for credential, e.g. work or email.")
   noCopy := cmd.BoolOpt("no-copy", false, "Do not copy password to the clipboard.")
 
   gen := cmd.BoolOpt("gen", false, "Generate a password.")
@@ -42,7 +43,7 @@ func (app *App) addCommand(cmd *cli.Cmd) {
 
   cmd.Action = func() {
     if !*gen {
-      app.runAdd(*login, *realm, *note, !*noCopy)
+      app.runAdd(*login, *realm, *note, *tags, !*noCopy)
     } else {
       generator := passgen.New()
       if *length == 0 {
@@ -74,12 +75,12 @@ func (app *App) addCommand(cmd *cli.Cmd) {
       if (*noSimilar) {
         generator.Exclude += SimilarChars
       }
-      app.runGen(*login, *realm, *note, !*noCopy, generator)
+      app.runGen(*login, *realm, *note, *tags, !*noCopy, generator)
     }
   }
 }
 
-func (app *App) runAdd(login, realm, note string, copyPassword bool) {
+func (app *App) runAdd(login, realm, note string, tags []string, copyPassword bool) {
   db := app.openStore()
   defer db.Close()
 
@@ -97,17 +98,28 @@ func (app *App) runAdd(login, realm, note string, copyPassword bool) {
     note = readInput("Note: ")
   }
 
-  db.AddCredential(&store.Credential {
+  err := db.AddCredential(&store.Credential {
     Login: login,
     Password: password,
     Realm: realm,
     Note: note,
+    Tags: tags,
   })
 
+  if err != nil {
+    printError("Failed to add credential: %s\n", err)
+    return
+  }
+
   printSuccess("Credential added. ")
 
   if copyPassword {
-    clipboard.WriteAll(password)
+    if err = clipboard.WriteAll(password); err != nil {
+      fmt.Println()
+      printError("Failed to copy password to the clipboard: %s\n", err)
+      return
+    }
+
     fmt.Println("Password copied to the clipboard.")
   } else {
     fmt.Println()
@@ -119,7 +131,7 @@ type passwordResult struct {
   err error
 }
 
-func (app *App) runGen(login, realm, note string, copyPassword bool, generator *passgen.Generator) {
+func (app *App) runGen(login, realm, note string, tags []string, copyPassword bool, generator *passgen.Generator) {
   passwordChan := make(chan *passwordResult)
   go func() {
     password, err := generator.Generate()
@@ -155,17 +167,28 @@ func (app *App) runGen(login, realm, note string, copyPassword bool, generator *
     return
   }
 
-  db.AddCredential(&store.Credential {
+  err := db.AddCredential(&store.Credential {
     Login: login,
     Password: result.password,
     Realm: realm,
     Note: note,
+    Tags: tags,
   })
 
+  if err != nil {
+    printError("Failed to add credential: %s\n", err)
+    return
+  }
+
   printSuccess("Credential added. ")
 
   if copyPassword {
-    clipboard.WriteAll(result.password)
+    if err = clipboard.WriteAll(result.password); err != nil {
+      fmt.Println()
+      printError("Failed to copy password to the clipboard: %s\n", err)
+      return
+    }
+
     fmt.Println("Generated password copied to the clipboard.")
   } else {
     fmt.Println()
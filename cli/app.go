@@ -10,6 +10,11 @@ import (
 
 type App struct {
   storeFileName string
+  vaultName string
+  keyFileName string
+
+  // The vault opened by 'shares unlock', used by the command it runs.
+  unlocked *store.Store
 }
 
 func NewApp(fileName string) *App {
@@ -17,39 +22,117 @@ func NewApp(fileName string) *App {
 
   return &App {
     storeFileName: fullPath,
+    vaultName: store.DefaultVault,
   }
 }
 
 func (app *App) openStore() *store.Store {
+  return app.openStoreFile(app.storeFileName, "Master password: ")
+}
+
+func (app *App) openStoreFile(fileName string, prompt string) *store.Store {
+  if app.unlocked != nil && fileName == app.storeFileName {
+    return app.unlocked
+  }
+
+  var keyFile []byte
+  if app.keyFileName != "" {
+    var err error
+    if keyFile, err = readKeyFile(app.keyFileName, false); err != nil {
+      printError("%s\n", err)
+      os.Exit(1)
+    }
+
+    // Key slots unlocked by the key file alone do not need a password.
+    db, err := store.OpenVaultKeyFile(fileName, app.vaultName, "", keyFile)
+    if err == nil {
+      return db
+    }
+
+    if !isPasswordError(err) {
+      printError("%s\n", err)
+      os.Exit(1)
+    }
+  }
+
   for {
-    master := readPassword("Master password: ")
-    db, err := store.Open(app.storeFileName, master)
+    master := readPassword(prompt)
+    db, err := store.OpenVaultKeyFile(fileName, app.vaultName, master, keyFile)
     if err == nil {
       return db
     }
 
+    if _, ok := err.(store.KeyFileRequiredError); ok {
+      printError("%s Use --key-file or WARDKEYFILE.\n", err)
+      os.Exit(1)
+    }
+
     printError("%s\n", err)
 
-    if _, ok := err.(crypto.IncorrectPasswordError); !ok {
-      if _, ok = err.(crypto.InvalidPasswordError); !ok {
-        os.Exit(1)
-      }
+    if !isPasswordError(err) {
+      os.Exit(1)
     }
   }
 }
 
+// Whether opening the store failed only because the password was wrong or
+// missing, so asking for it again may help.
+func isPasswordError(err error) bool {
+  switch err.(type) {
+  case crypto.IncorrectPasswordError, crypto.InvalidPasswordError:
+    return true
+  }
+
+  return false
+}
+
 func (app *App) Run(args []string) {
   ward := cli.App("ward", "Secure password manager - https://github.com/schmich/ward")
   ward.Version("v version", "ward " + Version)
+
+  vaultName := ward.String(cli.StringOpt {
+    Name: "vault",
+    Value: store.DefaultVault,
+    Desc: "Name of the vault to use.",
+    EnvVar: "WARDVAULT",
+  })
+
+  keyFileName := ward.String(cli.StringOpt {
+    Name: "key-file",
+    Value: "",
+    Desc: "Key file required by the vault in addition to its master password.",
+    EnvVar: "WARDKEYFILE",
+  })
+
+  ward.Before = func() {
+    app.vaultName = *vaultName
+    app.keyFileName = *keyFileName
+  }
+
   ward.Command("init", "Create a new credential database.", app.initCommand)
   ward.Command("add", "Add a new credential.", app.addCommand)
   ward.Command("copy", "Copy a password to the clipboard.", app.copyCommand)
   ward.Command("edit", "Edit an existing credential.", app.editCommand)
-  ward.Command("del", "Delete a stored credential.", app.delCommand)
+  ward.Command("del", "Move a stored credential to the trash.", app.delCommand)
+  ward.Command("trash", "List or empty deleted credentials.", app.trashCommand)
+  ward.Command("restore", "Restore a deleted credential.", app.restoreCommand)
+  ward.Command("history", "List, copy, or restore previous passwords.", app.historyCommand)
+  ward.Command("attach", "Attach a file to a credential.", app.attachCommand)
+  ward.Command("detach", "Remove an attached file.", app.detachCommand)
+  ward.Command("extract", "Save an attached file.", app.extractCommand)
   ward.Command("qr", "Print password formatted as a QR code.", app.qrCommand)
   ward.Command("list", "Print a table-formatted list of credentials.", app.listCommand)
   ward.Command("import", "Import JSON-formatted credentials.", app.importCommand)
   ward.Command("export", "Export JSON-formatted credentials.", app.exportCommand)
   ward.Command("master", "Update master password.", app.masterCommand)
+  ward.Command("rekey", "Re-encrypt all credentials with a new key.", app.rekeyCommand)
+  ward.Command("log", "Print and verify the audit log.", app.logCommand)
+  ward.Command("index", "Enable or disable the blind index for exact lookups.", app.indexCommand)
+  ward.Command("vault", "Create, list, or remove vaults.", app.vaultCommand)
+  ward.Command("merge", "Merge changes from another copy of the database.", app.mergeCommand)
+  ward.Command("kdf", "Check password key derivation settings.", app.kdfCommand)
+  ward.Command("recover", "Reset a forgotten master password with the recovery key.", app.recoverCommand)
+  ward.Command("shares", "Split the vault key into shares for emergency access.", app.sharesCommand)
+  ward.Command("slot", "List, add, or remove key slots that unlock the vault.", app.slotCommand)
   ward.Run(args)
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+  "github.com/schmich/ward/store"
+  "github.com/jawher/mow.cli"
+  "path/filepath"
+  "io/ioutil"
+)
+
+func (app *App) attachCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--name] FILE QUERY..."
+
+  name := cmd.StringOpt("name", "", "Attachment name. Defaults to the file name.")
+  file := cmd.StringArg("FILE", "", "File to attach.")
+
+  query := cmd.Strings(cli.StringsArg {
+    Name: "QUERY",
+    Desc: "Criteria to match.",
+    Value: []string{},
+    EnvVar: "",
+  })
+
+  cmd.Action = func() {
+    app.runAttach(*file, *name, *query)
+  }
+}
+
+func (app *App) runAttach(fileName, name string, query []string) {
+  data, err := ioutil.ReadFile(fileName)
+  if err != nil {
+    printError("Failed to read %s: %s\n", fileName, err)
+    return
+  }
+
+  if len(data) > store.MaxAttachmentSize {
+    printError("%s is too large to attach (maximum %d bytes).\n", fileName, store.MaxAttachmentSize)
+    return
+  }
+
+  if name == "" {
+    name = filepath.Base(fileName)
+  }
+
+  db := app.openStore()
+  defer db.Close()
+
+  credential := findCredential(db, query, nil)
+  if credential == nil {
+    return
+  }
+
+  err = db.AddAttachment(credential, &store.Attachment {
+    Name: name,
+    Data: data,
+  })
+
+  if err != nil {
+    printError("Failed to attach %s: %s\n", fileName, err)
+    return
+  }
+
+  printSuccess("Attached %s to %s.\n", name, formatCredential(credential))
+}
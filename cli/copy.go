@@ -1,12 +1,18 @@
 package main
 
 import (
+  "github.com/schmich/ward/store"
   "github.com/jawher/mow.cli"
   "github.com/atotto/clipboard"
 )
 
 func (app *App) copyCommand(cmd *cli.Cmd) {
-  cmd.Spec = "QUERY..."
+  cmd.Spec = "[--field] (--id | [--tag...] [--exact] QUERY...)"
+
+  tags := cmd.StringsOpt("tag", nil, "Only match credentials with this tag.")
+  fieldName := cmd.StringOpt("field", "", "Copy the value of this custom field instead of the password.")
+  exact := cmd.BoolOpt("exact", false, "Only match credentials whose login or realm equals each query string.")
+  uuid := cmd.StringOpt("id", "", "Copy from the credential with this ID, as shown by list --ids.")
 
   query := cmd.Strings(cli.StringsArg {
     Name: "QUERY",
@@ -16,21 +22,48 @@ func (app *App) copyCommand(cmd *cli.Cmd) {
   })
 
   cmd.Action = func() {
-    app.runCopy(*query)
+    app.runCopy(*query, *tags, *fieldName, *exact, *uuid)
   }
 }
 
-func (app *App) runCopy(query []string) {
+func (app *App) runCopy(query []string, tags []string, fieldName string, exact bool, uuid string) {
   db := app.openStore()
   defer db.Close()
 
-  credential := findCredential(db, query)
+  var credential *store.Credential
+  if uuid != "" {
+    credential = findCredentialByUUID(db, uuid)
+  } else if exact {
+    credential = lookupCredential(db, query, tags)
+  } else {
+    credential = findCredential(db, query, tags)
+  }
+
   if credential == nil {
     return
   }
 
-  clipboard.WriteAll(credential.Password)
   identifier := formatCredential(credential)
 
-  printSuccess("Password for %s copied to the clipboard.\n", identifier)
+  name, value := "Password", credential.Password
+  if fieldName != "" {
+    field := credential.Field(fieldName)
+    if field == nil {
+      printError("No field \"%s\" for %s.\n", fieldName, identifier)
+      return
+    }
+
+    name, value = field.Name, field.Value
+  }
+
+  if err := clipboard.WriteAll(value); err != nil {
+    printError("Failed to copy %s to the clipboard: %s\n", name, err)
+    return
+  }
+
+  printSuccess("%s for %s copied to the clipboard.\n", name, identifier)
+
+  if err := db.TouchCredential(credential); err != nil {
+    printError("Failed to update last used time: %s\n", err)
+  }
 }
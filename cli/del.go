@@ -23,15 +23,19 @@ func (app *App) runDel(query []string) {
   db := app.openStore()
   defer db.Close()
 
-  credential := findCredential(db, query)
+  credential := findCredential(db, query, nil)
   if credential == nil {
     return
   }
 
   identifier := formatCredential(credential)
   if confirm := readYesNo("Delete " + identifier); confirm {
-    db.DeleteCredential(credential)
-    printSuccess("Credential deleted.\n")
+    if err := db.DeleteCredential(credential); err != nil {
+      printError("Failed to delete credential: %s\n", err)
+      return
+    }
+
+    printSuccess("Credential moved to the trash.\n")
   } else {
     printError("Canceled.\n")
   }
@@ -0,0 +1,50 @@
+package main
+
+import (
+  "github.com/jawher/mow.cli"
+)
+
+func (app *App) detachCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--name] QUERY..."
+
+  name := cmd.StringOpt("name", "", "Name of the attachment to remove.")
+
+  query := cmd.Strings(cli.StringsArg {
+    Name: "QUERY",
+    Desc: "Criteria to match.",
+    Value: []string{},
+    EnvVar: "",
+  })
+
+  cmd.Action = func() {
+    app.runDetach(*name, *query)
+  }
+}
+
+func (app *App) runDetach(name string, query []string) {
+  db := app.openStore()
+  defer db.Close()
+
+  credential := findCredential(db, query, nil)
+  if credential == nil {
+    return
+  }
+
+  attachment := findAttachment(db, credential, name)
+  if attachment == nil {
+    return
+  }
+
+  identifier := formatCredential(credential)
+  if confirm := readYesNo("Remove " + attachment.Name + " from " + identifier); !confirm {
+    printError("Canceled.\n")
+    return
+  }
+
+  if err := db.DeleteAttachment(attachment); err != nil {
+    printError("Failed to remove attachment: %s\n", err)
+    return
+  }
+
+  printSuccess("Removed %s from %s.\n", attachment.Name, identifier)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+  "github.com/schmich/ward/store"
   "github.com/jawher/mow.cli"
+  "strings"
   "fmt"
 )
 
@@ -24,7 +26,7 @@ func (app *App) runEdit(query []string) {
   db := app.openStore()
   defer db.Close()
 
-  credential := findCredential(db, query)
+  credential := findCredential(db, query, nil)
   if credential == nil {
     return
   }
@@ -34,11 +36,19 @@ func (app *App) runEdit(query []string) {
   fmt.Println("Password: (not shown)")
   fmt.Printf("Realm: %s\n", credential.Realm)
   fmt.Printf("Note: %s\n", credential.Note)
+  fmt.Printf("Tags: %s\n", strings.Join(credential.Tags, ", "))
+  for _, field := range credential.Fields {
+    if field.Concealed {
+      fmt.Printf("%s: (not shown)\n", field.Name)
+    } else {
+      fmt.Printf("%s: %s\n", field.Name, field.Value)
+    }
+  }
 
   update := false
 
   for {
-    response := readChar("Edit login, password, realm, note, or quit (l/p/r/n/q)? ", "lprnq")
+    response := readChar("Edit login, password, realm, note, tags, field, or quit (l/p/r/n/t/f/q)? ", "lprntfq")
     if response == 'q' {
       break
     }
@@ -51,15 +61,51 @@ func (app *App) runEdit(query []string) {
       credential.Realm = readInput("New realm: ")
     } else if response == 'n' {
       credential.Note = readInput("New note: ")
+    } else if response == 't' {
+      credential.Tags = splitTags(readInput("New tags (comma-separated): "))
+    } else if response == 'f' {
+      editField(credential)
     }
 
     update = true
   }
 
   if update {
-    db.UpdateCredential(credential)
+    if err := db.UpdateCredential(credential); err != nil {
+      printError("Failed to update credential: %s\n", err)
+      return
+    }
+
     printSuccess("Credential updated.\n")
   } else {
     printError("No changes made.\n")
   }
 }
+
+func editField(credential *store.Credential) {
+  name := strings.TrimSpace(readInput("Field name: "))
+  if name == "" {
+    printError("Invalid field name.\n")
+    return
+  }
+
+  concealed := false
+  if field := credential.Field(name); field != nil {
+    concealed = field.Concealed
+  } else {
+    concealed = readYesNo("Conceal value")
+  }
+
+  var value string
+  if concealed {
+    value = readPasswordConfirm("New value (empty to remove)")
+  } else {
+    value = readInput("New value (empty to remove): ")
+  }
+
+  if value == "" {
+    credential.RemoveField(name)
+  } else {
+    credential.SetField(name, value, concealed)
+  }
+}
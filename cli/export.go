@@ -1,23 +1,32 @@
 package main
 
 import (
+  "github.com/schmich/ward/store"
   "github.com/jawher/mow.cli"
   "encoding/json"
   "os"
 )
 
+// Exported credentials include their attachments. Attachment data is
+// base64-encoded in JSON.
+type exportCredential struct {
+  *store.Credential
+  Attachments []*store.Attachment `json:"attachments,omitempty"`
+}
+
 func (app *App) exportCommand(cmd *cli.Cmd) {
-  cmd.Spec = "[--compact] [FILE]"
+  cmd.Spec = "[--compact] [--tag...] [FILE]"
 
   file := cmd.StringArg("FILE", "", "Destination file. Otherwise, output written to stdout.")
   compact := cmd.BoolOpt("compact", false, "Generate compact JSON output.")
+  tags := cmd.StringsOpt("tag", nil, "Only export credentials with this tag.")
 
   cmd.Action = func() {
-    app.runExport(*file, *compact)
+    app.runExport(*file, *compact, *tags)
   }
 }
 
-func (app *App) runExport(fileName string, compact bool) {
+func (app *App) runExport(fileName string, compact bool, tags []string) {
   db := app.openStore()
   defer db.Close()
 
@@ -29,19 +38,40 @@ func (app *App) runExport(fileName string, compact bool) {
   } else {
     output, err = os.Create(fileName)
     if err != nil {
-      panic(err)
+      printError("Failed to create %s: %s\n", fileName, err)
+      return
     }
 
     defer output.Close()
   }
 
-  credentials := db.AllCredentials()
+  credentials, err := db.AllCredentials()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  credentials = filterTagged(credentials, tags)
+
+  exports := make([]exportCredential, len(credentials))
+  for i, credential := range credentials {
+    attachments, err := db.Attachments(credential)
+    if err != nil {
+      printError("%s\n", err)
+      return
+    }
+
+    exports[i] = exportCredential {
+      Credential: credential,
+      Attachments: attachments,
+    }
+  }
 
   var jsonData []byte
   if compact {
-    jsonData, err = json.Marshal(credentials)
+    jsonData, err = json.Marshal(exports)
   } else {
-    jsonData, err = json.MarshalIndent(credentials, "", "  ")
+    jsonData, err = json.MarshalIndent(exports, "", "  ")
   }
 
   if err != nil {
@@ -49,7 +79,15 @@ func (app *App) runExport(fileName string, compact bool) {
     return
   }
 
-  output.Write(jsonData)
+  if _, err = output.Write(jsonData); err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  if err = db.Audit(store.ActionExport, nil); err != nil {
+    printError("Failed to record export in audit log: %s\n", err)
+    return
+  }
 
   if fileName != "" {
     printSuccess("Exported credentials to %s.\n", fileName)
@@ -0,0 +1,59 @@
+package main
+
+import (
+  "github.com/jawher/mow.cli"
+  "path/filepath"
+  "io/ioutil"
+  "os"
+)
+
+func (app *App) extractCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--name] [--out] QUERY..."
+
+  name := cmd.StringOpt("name", "", "Name of the attachment to extract.")
+  out := cmd.StringOpt("out", "", "Destination file. Defaults to the attachment name.")
+
+  query := cmd.Strings(cli.StringsArg {
+    Name: "QUERY",
+    Desc: "Criteria to match.",
+    Value: []string{},
+    EnvVar: "",
+  })
+
+  cmd.Action = func() {
+    app.runExtract(*name, *out, *query)
+  }
+}
+
+func (app *App) runExtract(name, fileName string, query []string) {
+  db := app.openStore()
+  defer db.Close()
+
+  credential := findCredential(db, query, nil)
+  if credential == nil {
+    return
+  }
+
+  attachment := findAttachment(db, credential, name)
+  if attachment == nil {
+    return
+  }
+
+  if fileName == "" {
+    fileName = filepath.Base(attachment.Name)
+  }
+
+  if _, err := os.Stat(fileName); err == nil {
+    if confirm := readYesNo("Overwrite " + fileName); !confirm {
+      printError("Canceled.\n")
+      return
+    }
+  }
+
+  if err := ioutil.WriteFile(fileName, attachment.Data, 0600); err != nil {
+    printError("Failed to write %s: %s\n", fileName, err)
+    return
+  }
+
+  printSuccess("Extracted %s to %s.\n", attachment.Name, fileName)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+  "github.com/jawher/mow.cli"
+  "github.com/atotto/clipboard"
+  "github.com/rodaine/table"
+  "github.com/fatih/color"
+  "strconv"
+  "fmt"
+)
+
+func (app *App) historyCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--copy | --restore] QUERY..."
+
+  copyIndex := cmd.IntOpt("copy", 0, "Copy the password with the given history number to the clipboard.")
+  restoreIndex := cmd.IntOpt("restore", 0, "Restore the password with the given history number.")
+
+  query := cmd.Strings(cli.StringsArg {
+    Name: "QUERY",
+    Desc: "Criteria to match.",
+    Value: []string{},
+    EnvVar: "",
+  })
+
+  cmd.Action = func() {
+    app.runHistory(*query, *copyIndex, *restoreIndex)
+  }
+}
+
+func (app *App) runHistory(query []string, copyIndex, restoreIndex int) {
+  db := app.openStore()
+  defer db.Close()
+
+  credential := findCredential(db, query, nil)
+  if credential == nil {
+    return
+  }
+
+  identifier := formatCredential(credential)
+
+  history, err := db.PasswordHistory(credential)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  if len(history) == 0 {
+    printError("No password history for %s.\n", identifier)
+    return
+  }
+
+  index := copyIndex
+  if restoreIndex != 0 {
+    index = restoreIndex
+  }
+
+  if index == 0 {
+    fmt.Printf("Password history for %s:\n", identifier)
+
+    headerFmt := color.New(color.FgCyan, color.Underline).SprintfFunc()
+
+    table := table.New("#", "Replaced")
+    table.WithHeaderFormatter(headerFmt)
+
+    for i, entry := range history {
+      table.AddRow(strconv.Itoa(i + 1), formatTime(entry.Replaced))
+    }
+
+    table.Print()
+    return
+  }
+
+  if index < 1 || index > len(history) {
+    printError("Invalid history number: %d.\n", index)
+    return
+  }
+
+  entry := history[index - 1]
+
+  if copyIndex != 0 {
+    if err = clipboard.WriteAll(entry.Password); err != nil {
+      printError("Failed to copy password to the clipboard: %s\n", err)
+      return
+    }
+
+    printSuccess("Password #%d for %s copied to the clipboard.\n", index, identifier)
+    return
+  }
+
+  if confirm := readYesNo(fmt.Sprintf("Restore password #%d for %s", index, identifier)); !confirm {
+    printError("Canceled.\n")
+    return
+  }
+
+  if err = db.RestorePassword(credential, entry); err != nil {
+    printError("Failed to restore password: %s\n", err)
+    return
+  }
+
+  printSuccess("Password for %s restored.\n", identifier)
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-  "github.com/jawher/mow.cli"
   "github.com/schmich/ward/store"
+  "github.com/jawher/mow.cli"
   "encoding/json"
   "io/ioutil"
   "fmt"
@@ -35,7 +35,7 @@ func (app *App) runImport(fileName string) {
     return
   }
 
-  var credentials []store.Credential
+  var credentials []exportCredential
   err = json.Unmarshal(contents, &credentials)
 
   if err != nil {
@@ -44,9 +44,39 @@ func (app *App) runImport(fileName string) {
   }
 
   fmt.Printf("Importing %d credentials.\n", len(credentials))
-  for _, credential := range credentials {
-    db.AddCredential(&credential)
+  imported := 0
+  skipped := 0
+  for i, credential := range credentials {
+    if credential.Credential == nil {
+      printError("Invalid credential %d.\n", i + 1)
+      printImported(imported, skipped)
+      return
+    }
+
+    // Credentials imported before keep their ID and are left as they are.
+    if err = db.ImportCredential(credential.Credential, credential.Attachments); err != nil {
+      if _, ok := err.(store.DuplicateCredentialError); ok {
+        skipped++
+        continue
+      }
+
+      printError("Failed to import credential %d: %s\n", i + 1, err)
+      printImported(imported, skipped)
+      return
+    }
+
+    imported++
   }
 
+  printImported(imported, skipped)
   printSuccess("Imported credentials from %s.\n", fileName)
 }
+
+// Each credential is imported on its own, so those imported before a failure
+// are kept.
+func printImported(imported int, skipped int) {
+  fmt.Printf("Imported %d credentials.\n", imported)
+  if skipped > 0 {
+    fmt.Printf("Skipped %d credentials that already exist.\n", skipped)
+  }
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+  "github.com/jawher/mow.cli"
+  "fmt"
+)
+
+func (app *App) indexCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--enable | --disable]"
+
+  enable := cmd.BoolOpt("enable", false, "Build the blind index so that exact lookups decrypt fewer credentials.")
+  disable := cmd.BoolOpt("disable", false, "Remove the blind index.")
+
+  cmd.Action = func() {
+    app.runIndex(*enable, *disable)
+  }
+}
+
+func (app *App) runIndex(enable, disable bool) {
+  db := app.openStore()
+  defer db.Close()
+
+  if !enable && !disable {
+    enabled, err := db.BlindIndexEnabled()
+    if err != nil {
+      printError("%s\n", err)
+      return
+    }
+
+    if enabled {
+      fmt.Println("Blind index is enabled.")
+    } else {
+      fmt.Println("Blind index is disabled.")
+    }
+
+    return
+  }
+
+  if err := db.SetBlindIndex(enable); err != nil {
+    printError("Failed to update blind index: %s\n", err)
+    return
+  }
+
+  if enable {
+    printSuccess("Blind index enabled.\n")
+  } else {
+    printSuccess("Blind index disabled.\n")
+  }
+}
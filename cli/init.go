@@ -9,25 +9,64 @@ import (
 )
 
 func (app *App) initCommand(cmd *cli.Cmd) {
-  cmd.Spec = "[--stretch|--link=<file>]"
+  cmd.Spec = "[" + kdfOptionsSpec + " | --format | --key-file | --recovery-key]... | --link=<file>"
 
-  stretch := cmd.IntOpt("stretch", 200000, "Password key stretch iterations.")
+  kdf := addKDFOptions(cmd)
+  format := cmd.StringOpt("format", "sqlite", "Database format: sqlite or file.")
+  keyFile := cmd.StringOpt("key-file", "", "Require a key file to unlock the database. Created if it does not exist.")
+  recoveryKey := cmd.BoolOpt("recovery-key", false, "Print a recovery key that resets a forgotten master password.")
   file := cmd.StringOpt("link", "", "Link to an existing credential database.")
 
   cmd.Action = func() {
     if *file == "" {
-      app.runInit(*stretch)
+      app.runInit(kdf, *format, *keyFile, *recoveryKey)
     } else {
       app.runLink(*file)
     }
   }
 }
 
-func (app *App) runInit(keyStretch int) {
+func (app *App) runInit(options *kdfOptions, formatName string, keyFileName string, recoveryKey bool) {
+  var format store.Format
+  switch formatName {
+  case "sqlite":
+    format = store.FormatSQLite
+  case "file":
+    format = store.FormatFile
+  default:
+    printError("Invalid format: %s.\n", formatName)
+    return
+  }
+
+  kdf, err := options.kdf()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  if _, err := os.Stat(app.storeFileName); err == nil {
+    printError("Credential database already exists.\n")
+    return
+  }
+
+  var keyFile []byte
+  if keyFileName != "" {
+    if keyFile, err = readKeyFile(keyFileName, true); err != nil {
+      printError("%s\n", err)
+      return
+    }
+  }
+
   fmt.Println("Creating new credential database.")
   password := readPasswordConfirm("Master password")
 
-  db, err := store.Create(app.storeFileName, password, keyStretch)
+  var db *store.Store
+  if keyFile == nil {
+    db, err = store.CreateFormat(app.storeFileName, password, kdf, format)
+  } else {
+    db, err = store.CreateKeyFile(app.storeFileName, password, keyFile, kdf, format)
+  }
+
   if err != nil {
     printError("Failed to create database: %s\n", err.Error())
     return
@@ -36,6 +75,10 @@ func (app *App) runInit(keyStretch int) {
   defer db.Close()
 
   printSuccess("Credential database created at %s.\n", app.storeFileName)
+
+  if recoveryKey {
+    app.addRecoveryKey(db)
+  }
 }
 
 func (app *App) runLink(existingFileName string) {
@@ -7,6 +7,7 @@ import (
   "strings"
   "strconv"
   "bufio"
+  "time"
   "fmt"
   "os"
 )
@@ -89,8 +90,85 @@ func selectCredential(credentials []*store.Credential) *store.Credential {
   return credentials[index - 1]
 }
 
-func findCredential(db *store.Store, query []string) *store.Credential {
-  credentials := db.FindCredentials(query)
+func filterTagged(credentials []*store.Credential, tags []string) []*store.Credential {
+  if len(tags) == 0 {
+    return credentials
+  }
+
+  tagged := make([]*store.Credential, 0, len(credentials))
+  for _, credential := range credentials {
+    if credential.HasTags(tags) {
+      tagged = append(tagged, credential)
+    }
+  }
+
+  return tagged
+}
+
+func splitTags(tags string) []string {
+  return strings.Split(tags, ",")
+}
+
+func findCredential(db *store.Store, query []string, tags []string) *store.Credential {
+  credentials, err := db.FindCredentials(query)
+  if err != nil {
+    printError("%s\n", err)
+    return nil
+  }
+
+  return loadCredential(db, chooseCredential(filterTagged(credentials, tags), query))
+}
+
+func lookupCredential(db *store.Store, terms []string, tags []string) *store.Credential {
+  credentials, err := db.LookupCredentials(terms)
+  if err != nil {
+    printError("%s\n", err)
+    return nil
+  }
+
+  return loadCredential(db, chooseCredential(filterTagged(credentials, tags), terms))
+}
+
+func findCredentialByUUID(db *store.Store, uuid string) *store.Credential {
+  credential, err := db.CredentialByUUID(uuid)
+  if err != nil {
+    printError("%s\n", err)
+    return nil
+  }
+
+  if credential == nil {
+    printError("No credential with ID %s.\n", uuid)
+    return nil
+  }
+
+  return loadCredential(db, credential)
+}
+
+// Decrypts the password and fields of the selected credential only.
+func loadCredential(db *store.Store, credential *store.Credential) *store.Credential {
+  if credential == nil {
+    return nil
+  }
+
+  if err := db.LoadCredential(credential); err != nil {
+    printError("%s\n", err)
+    return nil
+  }
+
+  return credential
+}
+
+func findTrashedCredential(db *store.Store, query []string) *store.Credential {
+  credentials, err := db.FindTrashedCredentials(query)
+  if err != nil {
+    printError("%s\n", err)
+    return nil
+  }
+
+  return chooseCredential(credentials, query)
+}
+
+func chooseCredential(credentials []*store.Credential, query []string) *store.Credential {
   if len(credentials) == 0 {
     queryString := strings.Join(query, " ")
     printError("No credentials match \"%s\".\n", queryString)
@@ -104,6 +182,62 @@ func findCredential(db *store.Store, query []string) *store.Credential {
   }
 }
 
+func findAttachment(db *store.Store, credential *store.Credential, name string) *store.Attachment {
+  identifier := formatCredential(credential)
+
+  attachments, err := db.Attachments(credential)
+  if err != nil {
+    printError("%s\n", err)
+    return nil
+  }
+
+  if name != "" {
+    for _, attachment := range attachments {
+      if strings.EqualFold(attachment.Name, name) {
+        return attachment
+      }
+    }
+
+    printError("No attachment \"%s\" for %s.\n", name, identifier)
+    return nil
+  }
+
+  if len(attachments) == 0 {
+    printError("No attachments for %s.\n", identifier)
+    return nil
+  } else if len(attachments) == 1 {
+    return attachments[0]
+  }
+
+  fmt.Fprintf(os.Stderr, "Found multiple attachments for %s:\n", identifier)
+  for i, attachment := range attachments {
+    fmt.Fprintf(os.Stderr, "%d. %s (%d bytes)\n", i + 1, attachment.Name, len(attachment.Data))
+  }
+
+  index := readIndex(1, len(attachments), "> ")
+  return attachments[index - 1]
+}
+
+func pluralize(count int, noun string) string {
+  if count == 1 {
+    return fmt.Sprintf("%d %s", count, noun)
+  }
+
+  if strings.HasSuffix(noun, "y") {
+    return fmt.Sprintf("%d %sies", count, strings.TrimSuffix(noun, "y"))
+  }
+
+  return fmt.Sprintf("%d %ss", count, noun)
+}
+
+func formatTime(t time.Time) string {
+  if t.IsZero() {
+    return "-"
+  }
+
+  return t.Local().Format("2006-01-02")
+}
+
 func formatCredential(credential *store.Credential) string {
   loginRealm := ""
   if len(credential.Login) > 0 && len(credential.Realm) > 0 {
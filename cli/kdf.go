@@ -0,0 +1,190 @@
+package main
+
+import (
+  "github.com/schmich/ward/crypto"
+  "github.com/jawher/mow.cli"
+  "strings"
+  "errors"
+  "time"
+  "fmt"
+)
+
+func (app *App) kdfCommand(cmd *cli.Cmd) {
+  cmd.Command("status", "Check the key derivation settings against current recommendations.", app.kdfStatusCommand)
+}
+
+// Options for commands that set a master password, which choose how it is
+// turned into a key.
+type kdfOptions struct {
+  name *string
+  stretch *int
+  passes *int
+  memory *int
+  threads *int
+  target *string
+
+  nameSet bool
+  stretchSet bool
+  passesSet bool
+  memorySet bool
+  threadsSet bool
+}
+
+const kdfOptionsSpec = "--kdf | --stretch | --passes | --memory | --threads | --kdf-time"
+
+func addKDFOptions(cmd *cli.Cmd) *kdfOptions {
+  options := &kdfOptions {}
+
+  options.name = cmd.String(cli.StringOpt {
+    Name: "kdf",
+    Value: "argon2id",
+    Desc: "Password key derivation function: argon2id or pbkdf2.",
+    SetByUser: &options.nameSet,
+  })
+
+  options.stretch = cmd.Int(cli.IntOpt {
+    Name: "stretch",
+    Value: crypto.MinPBKDF2Iterations,
+    Desc: "PBKDF2 iterations.",
+    SetByUser: &options.stretchSet,
+  })
+
+  options.passes = cmd.Int(cli.IntOpt {
+    Name: "passes",
+    Value: 3,
+    Desc: "Argon2id passes.",
+    SetByUser: &options.passesSet,
+  })
+
+  options.memory = cmd.Int(cli.IntOpt {
+    Name: "memory",
+    Value: 64,
+    Desc: "Argon2id memory in MiB.",
+    SetByUser: &options.memorySet,
+  })
+
+  options.threads = cmd.Int(cli.IntOpt {
+    Name: "threads",
+    Value: 4,
+    Desc: "Argon2id threads.",
+    SetByUser: &options.threadsSet,
+  })
+
+  options.target = cmd.StringOpt("kdf-time", "", "Target unlock time, e.g. 1s. Chooses the passes or iterations for this machine.")
+
+  return options
+}
+
+// Returns the key derivation function for a new password.
+func (options *kdfOptions) kdf() (crypto.KDF, error) {
+  return options.update(crypto.KDF{})
+}
+
+// Returns the key derivation function for a password that replaces one using
+// current. Parameters that are not given on the command line are kept from
+// current, so a vault only moves to another function when asked to.
+func (options *kdfOptions) update(current crypto.KDF) (crypto.KDF, error) {
+  argon2idSet := options.passesSet || options.memorySet || options.threadsSet
+  if current.Name != "" && !options.nameSet && !options.stretchSet && !argon2idSet && *options.target == "" {
+    return current, nil
+  }
+
+  name := *options.name
+  if !options.nameSet {
+    if argon2idSet {
+      name = "argon2id"
+    } else if options.stretchSet {
+      name = "pbkdf2"
+    } else if current.Name != "" {
+      name = current.Name
+    }
+  }
+
+  var kdf crypto.KDF
+
+  switch name {
+  case "argon2id":
+    kdf = crypto.Argon2idParams(*options.passes, *options.memory * 1024, *options.threads)
+    if current.Name == crypto.KDFArgon2id {
+      if !options.passesSet {
+        kdf.Time = current.Time
+      }
+
+      if !options.memorySet {
+        kdf.Memory = current.Memory
+      }
+
+      if !options.threadsSet {
+        kdf.Threads = current.Threads
+      }
+    }
+  case "pbkdf2", crypto.KDFPBKDF2:
+    kdf = crypto.PBKDF2Params(*options.stretch)
+    if current.Name == crypto.KDFPBKDF2 && !options.stretchSet {
+      kdf.Time = current.Time
+    }
+  default:
+    return kdf, errors.New(fmt.Sprintf("Invalid key derivation function: %s.", name))
+  }
+
+  if err := kdf.Validate(); err != nil {
+    return kdf, err
+  }
+
+  if *options.target == "" {
+    return kdf, nil
+  }
+
+  target, err := time.ParseDuration(*options.target)
+  if err != nil {
+    return kdf, errors.New(fmt.Sprintf("Invalid unlock time: %s.", *options.target))
+  }
+
+  fmt.Printf("Calibrating key derivation for a %s unlock time.\n", target)
+
+  if kdf, err = crypto.Calibrate(kdf, target); err != nil {
+    return kdf, err
+  }
+
+  fmt.Printf("Using %s.\n", kdf)
+  if weaknesses := kdf.Weaknesses(); weaknesses != nil {
+    printError("Below current recommendations: %s.\n", strings.Join(weaknesses, "; "))
+  }
+
+  return kdf, nil
+}
+
+func (app *App) kdfStatusCommand(cmd *cli.Cmd) {
+  cmd.Action = func() {
+    app.runKDFStatus()
+  }
+}
+
+func (app *App) runKDFStatus() {
+  db := app.openStore()
+  defer db.Close()
+
+  kdf, err := db.KDF()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  fmt.Printf("Key derivation: %s\n", kdf)
+  fmt.Printf("Cipher suite: %s\n", db.CipherSuite())
+
+  if elapsed, err := crypto.Benchmark(kdf); err == nil {
+    fmt.Printf("Unlock time on this machine: %s\n", elapsed.Round(time.Millisecond))
+  }
+
+  if db.CipherSuite() == crypto.SuiteAES128GCM {
+    printError("The vault uses 128-bit keys. Upgrade it with 'ward rekey --cipher %s'.\n", crypto.DefaultSuite)
+  }
+
+  if weaknesses := kdf.Weaknesses(); weaknesses != nil {
+    printError("Below current recommendations: %s. Strengthen it with 'ward master --kdf-time 1s'.\n", strings.Join(weaknesses, "; "))
+    return
+  }
+
+  printSuccess("Key derivation meets current recommendations.\n")
+}
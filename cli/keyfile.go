@@ -0,0 +1,45 @@
+package main
+
+import (
+  "github.com/schmich/ward/crypto"
+  "path/filepath"
+  "io/ioutil"
+  "errors"
+  "fmt"
+  "os"
+)
+
+// Reads a key file. A key file that does not exist is created with random
+// contents if create is set.
+func readKeyFile(fileName string, create bool) ([]byte, error) {
+  keyFile, err := ioutil.ReadFile(fileName)
+  if err == nil {
+    if len(keyFile) == 0 {
+      return nil, errors.New(fmt.Sprintf("Key file %s is empty.", fileName))
+    }
+
+    return keyFile, nil
+  }
+
+  if !os.IsNotExist(err) || !create {
+    return nil, errors.New(fmt.Sprintf("Failed to read key file: %s.", err))
+  }
+
+  file, err := os.OpenFile(fileName, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0400)
+  if err != nil {
+    return nil, errors.New(fmt.Sprintf("Failed to create key file: %s.", err))
+  }
+
+  defer file.Close()
+
+  keyFile = crypto.NewKeyFile()
+  if _, err = file.Write(keyFile); err != nil {
+    os.Remove(fileName)
+    return nil, errors.New(fmt.Sprintf("Failed to create key file: %s.", err))
+  }
+
+  fullPath, _ := filepath.Abs(fileName)
+  printSuccess("Key file created at %s. Keep a copy: the vault cannot be opened without it.\n", fullPath)
+
+  return keyFile, nil
+}
@@ -4,26 +4,55 @@ import (
   "github.com/jawher/mow.cli"
   "github.com/rodaine/table"
   "github.com/fatih/color"
+  "strings"
 )
 
 func (app *App) listCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--tag...] [--ids]"
+
+  tags := cmd.StringsOpt("tag", nil, "Only list credentials with this tag.")
+  ids := cmd.BoolOpt("ids", false, "Show the ID of each credential.")
+
   cmd.Action = func() {
-    app.runList()
+    app.runList(*tags, *ids)
   }
 }
 
-func (app *App) runList() {
+func (app *App) runList(tags []string, ids bool) {
   db := app.openStore()
   defer db.Close()
 
   headerFmt := color.New(color.FgCyan, color.Underline).SprintfFunc()
 
-  table := table.New("Login", "Realm")
+  columns := []interface {} { "Login", "Realm", "Tags", "Created", "Modified", "Used" }
+  if ids {
+    columns = append([]interface {} { "ID" }, columns...)
+  }
+
+  table := table.New(columns...)
   table.WithHeaderFormatter(headerFmt)
 
-  credentials := db.AllCredentials()
-  for _, credential := range credentials {
-    table.AddRow(credential.Login, credential.Realm)
+  credentials, err := db.FindCredentials(nil)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  for _, credential := range filterTagged(credentials, tags) {
+    row := []interface {} {
+      credential.Login,
+      credential.Realm,
+      strings.Join(credential.Tags, ", "),
+      formatTime(credential.Created),
+      formatTime(credential.Modified),
+      formatTime(credential.Accessed),
+    }
+
+    if ids {
+      row = append([]interface {} { credential.UUID }, row...)
+    }
+
+    table.AddRow(row...)
   }
 
   table.Print()
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "github.com/schmich/ward/store"
+  "github.com/jawher/mow.cli"
+  "github.com/rodaine/table"
+  "github.com/fatih/color"
+)
+
+func (app *App) logCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--verify]"
+
+  verify := cmd.BoolOpt("verify", false, "Only verify the audit log.")
+
+  cmd.Action = func() {
+    app.runLog(*verify)
+  }
+}
+
+func (app *App) runLog(verifyOnly bool) {
+  db := app.openStore()
+  defer db.Close()
+
+  entries, err := db.AuditLog()
+  if _, ok := err.(store.AuditLogError); err != nil && !ok {
+    printError("%s\n", err)
+    return
+  }
+
+  if !verifyOnly {
+    headerFmt := color.New(color.FgCyan, color.Underline).SprintfFunc()
+
+    table := table.New("Time", "User", "Host", "Action", "Credential")
+    table.WithHeaderFormatter(headerFmt)
+
+    for _, entry := range entries {
+      table.AddRow(
+        entry.Time.Local().Format("2006-01-02 15:04:05"),
+        entry.User,
+        entry.Host,
+        entry.Action,
+        entry.Credential)
+    }
+
+    table.Print()
+  }
+
+  if err != nil {
+    printError("%s\n", err)
+  } else {
+    printSuccess("Audit log verified (%s).\n", pluralize(len(entries), "entry"))
+  }
+}
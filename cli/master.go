@@ -5,23 +5,76 @@ import (
 )
 
 func (app *App) masterCommand(cmd *cli.Cmd) {
-  stretch := cmd.IntOpt("stretch", 200000, "Password key stretch iterations.")
+  cmd.Spec = "[" + kdfOptionsSpec + "]... | --add-key-file | --remove-key-file"
+
+  kdf := addKDFOptions(cmd)
+  addKeyFile := cmd.StringOpt("add-key-file", "", "Require a key file in addition to the master password. Created if it does not exist.")
+  removeKeyFile := cmd.BoolOpt("remove-key-file", false, "Stop requiring a key file.")
 
   cmd.Action = func() {
-    app.runUpdateMasterPassword(*stretch)
+    if *addKeyFile != "" {
+      app.runAddKeyFile(*addKeyFile)
+    } else if *removeKeyFile {
+      app.runRemoveKeyFile()
+    } else {
+      app.runUpdateMasterPassword(kdf)
+    }
   }
 }
 
-func (app *App) runUpdateMasterPassword(keyStretch int) {
+func (app *App) runUpdateMasterPassword(options *kdfOptions) {
   db := app.openStore()
   defer db.Close()
 
-  password := readPasswordConfirm("New master password")
-  err := db.UpdateMasterPassword(password, keyStretch)
+  // Slots unlocked by a key file alone have no key derivation to keep.
+  current, _ := db.KDF()
+
+  kdf, err := options.update(current)
   if err != nil {
     printError("%s\n", err)
     return
   }
 
+  password := readPasswordConfirm("New master password")
+  if err = db.UpdateMasterPassword(password, kdf); err != nil {
+    printError("%s\n", err)
+    return
+  }
+
   printSuccess("Master password updated.\n")
 }
+
+func (app *App) runAddKeyFile(fileName string) {
+  db := app.openStore()
+  defer db.Close()
+
+  keyFile, err := readKeyFile(fileName, true)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  if err = db.SetKeyFile(keyFile); err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  printSuccess("Key file added. Unlock with --key-file %s or WARDKEYFILE.\n", fileName)
+}
+
+func (app *App) runRemoveKeyFile() {
+  db := app.openStore()
+  defer db.Close()
+
+  if !db.HasKeyFile() {
+    printError("This vault does not use a key file.\n")
+    return
+  }
+
+  if err := db.SetKeyFile(nil); err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  printSuccess("Key file removed. Only the master password is needed to unlock.\n")
+}
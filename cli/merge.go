@@ -0,0 +1,79 @@
+package main
+
+import (
+  "github.com/schmich/ward/store"
+  "github.com/jawher/mow.cli"
+  "path/filepath"
+  "fmt"
+  "os"
+)
+
+func (app *App) mergeCommand(cmd *cli.Cmd) {
+  file := cmd.StringArg("FILE", "", "Other copy of the database, e.g. a conflicted copy from a file sync service.")
+
+  cmd.Action = func() {
+    app.runMerge(*file)
+  }
+}
+
+func (app *App) runMerge(fileName string) {
+  fullPath, _ := filepath.Abs(fileName)
+  if fullPath == app.storeFileName {
+    printError("Cannot merge a database with itself.\n")
+    return
+  }
+
+  if _, err := os.Stat(fullPath); err != nil {
+    printError("Failed to open %s: %s\n", fileName, err)
+    return
+  }
+
+  db := app.openStore()
+  defer db.Close()
+
+  other := app.openStoreFile(fullPath, fmt.Sprintf("Master password for %s: ", fileName))
+  defer other.Close()
+
+  changes, err := db.PlanMerge(other)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  for _, change := range changes {
+    if change.Conflict {
+      change.UseOther = resolveConflict(change, fileName)
+    }
+  }
+
+  count, err := db.ApplyMerge(other, changes)
+  if err != nil {
+    printError("Failed to merge: %s\n", err)
+    return
+  }
+
+  printSuccess("Merged %s from %s.\n", pluralize(count, "change"), fileName)
+}
+
+// Asks which version of a credential changed in both databases to keep.
+func resolveConflict(change *store.MergeChange, fileName string) bool {
+  fmt.Fprintf(os.Stderr, "Conflict:\n")
+  fmt.Fprintf(os.Stderr, "  Local: %s\n", describeMergeVersion(change.Local))
+  fmt.Fprintf(os.Stderr, "  %s: %s\n", fileName, describeMergeVersion(change.Other))
+
+  response := readChar(fmt.Sprintf("Keep local or %s version (l/o)? ", fileName), "lo")
+  return response == 'o'
+}
+
+func describeMergeVersion(credential *store.Credential) string {
+  if credential == nil {
+    return "permanently deleted"
+  }
+
+  description := fmt.Sprintf("%s, modified %s", formatCredential(credential), formatTime(credential.Modified))
+  if !credential.Deleted.IsZero() {
+    description += fmt.Sprintf(", deleted %s", formatTime(credential.Deleted))
+  }
+
+  return description
+}
@@ -26,7 +26,7 @@ func (app *App) runQr(query []string) {
   db := app.openStore()
   defer db.Close()
 
-  credential := findCredential(db, query)
+  credential := findCredential(db, query, nil)
   if credential == nil {
     return
   }
@@ -42,4 +42,8 @@ func (app *App) runQr(query []string) {
 
   stdout := colorable.NewColorableStdout()
   qrc.PrintAA(stdout, grid, false)
+
+  if err := db.TouchCredential(credential); err != nil {
+    printError("Failed to update last used time: %s\n", err)
+  }
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "github.com/schmich/ward/store"
+  "github.com/schmich/ward/crypto"
+  "github.com/jawher/mow.cli"
+  "github.com/mattn/go-colorable"
+  "github.com/qpliu/qrencode-go/qrencode"
+  "github.com/fumiyas/qrc/lib"
+  "strings"
+  "fmt"
+)
+
+func (app *App) recoverCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[" + kdfOptionsSpec + "]..."
+
+  kdf := addKDFOptions(cmd)
+
+  cmd.Action = func() {
+    app.runRecover(kdf)
+  }
+}
+
+func (app *App) runRecover(options *kdfOptions) {
+  var db *store.Store
+  for {
+    recoveryKey, err := crypto.DecodeRecoveryKey(readInput("Recovery key: "))
+    if err != nil {
+      printError("%s\n", err)
+      continue
+    }
+
+    if db, err = store.Recover(app.storeFileName, app.vaultName, recoveryKey); err != nil {
+      printError("%s\n", err)
+      return
+    }
+
+    break
+  }
+
+  defer db.Close()
+
+  // Keep the key derivation of the forgotten password, if its slot remains.
+  current := crypto.KDF{}
+  if slot, err := db.FindKeySlot(store.MasterSlotLabel); err == nil && slot.Password {
+    current = slot.KDF
+  }
+
+  kdf, err := options.update(current)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  password := readPasswordConfirm("New master password")
+  if err = db.ResetMasterPassword(password, kdf); err != nil {
+    printError("Failed to reset master password: %s\n", err)
+    return
+  }
+
+  printSuccess("Master password reset. Your recovery key still works.\n")
+}
+
+func (app *App) addRecoveryKey(db *store.Store) {
+  recoveryKey, err := db.AddRecoveryKey()
+  if err != nil {
+    printError("Failed to add recovery key: %s\n", err)
+    return
+  }
+
+  printRecoveryKey(recoveryKey)
+}
+
+// Shows a recovery key as rows of words and as a QR code. It is only ever
+// shown once.
+func printRecoveryKey(recoveryKey []byte) {
+  encoded := crypto.EncodeRecoveryKey(recoveryKey)
+  words := strings.Fields(encoded)
+
+  printSuccess("Recovery key added. Write it down and keep it somewhere safe, it will not be shown again:\n\n")
+  for i := 0; i < len(words); i += 6 {
+    fmt.Printf("  %s\n", strings.Join(words[i:i + 6], " "))
+  }
+
+  fmt.Println()
+
+  grid, err := qrencode.Encode(encoded, qrencode.ECLevelL)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  stdout := colorable.NewColorableStdout()
+  qrc.PrintAA(stdout, grid, false)
+
+  fmt.Println("Use 'ward recover' with this key to reset a forgotten master password.")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+  "github.com/schmich/ward/store"
+  "github.com/schmich/ward/crypto"
+  "github.com/jawher/mow.cli"
+  "strings"
+  "fmt"
+)
+
+func (app *App) rekeyCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--cipher]"
+  suite := cmd.StringOpt("cipher", "", "Cipher suite for the new key: aes-256-gcm or chacha20-poly1305.")
+
+  cmd.Action = func() {
+    app.runRekey(*suite)
+  }
+}
+
+func (app *App) runRekey(suite string) {
+  if suite != "" {
+    if _, err := crypto.KeySize(suite); err != nil {
+      printError("%s\n", err)
+      return
+    }
+  }
+
+  db := app.openStore()
+  defer db.Close()
+
+  others, err := otherSlots(db)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  if len(others) > 0 {
+    fmt.Printf("Only the key slot you unlocked with can be given the new key. These slots will be removed: %s.\n", strings.Join(others, ", "))
+  }
+
+  if confirm := readYesNo("Re-encrypt all credentials with a new key"); !confirm {
+    printError("Canceled.\n")
+    return
+  }
+
+  if suite == "" || suite == db.CipherSuite() {
+    err = db.Rekey()
+  } else {
+    // Moving from 128-bit keys derives a longer key from the master password.
+    password := ""
+    if _, kdfErr := db.KDF(); kdfErr == nil && db.CipherSuite() == crypto.SuiteAES128GCM {
+      password = readPassword("Master password (again): ")
+    }
+
+    err = db.ChangeCipherSuite(suite, password)
+  }
+
+  if err != nil {
+    printError("Failed to change key: %s\n", err)
+    return
+  }
+
+  printSuccess("All credentials re-encrypted with a new %s key.\n", db.CipherSuite())
+}
+
+// Returns the labels of the key slots that rekeying would remove.
+func otherSlots(db *store.Store) ([]string, error) {
+  slots, err := db.KeySlots()
+  if err != nil {
+    return nil, err
+  }
+
+  labels := make([]string, 0)
+  for _, slot := range slots {
+    if slot.ID != db.UnlockedSlot() {
+      labels = append(labels, slot.Label)
+    }
+  }
+
+  return labels, nil
+}
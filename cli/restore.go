@@ -0,0 +1,37 @@
+package main
+
+import (
+  "github.com/jawher/mow.cli"
+)
+
+func (app *App) restoreCommand(cmd *cli.Cmd) {
+  cmd.Spec = "QUERY..."
+
+  query := cmd.Strings(cli.StringsArg {
+    Name: "QUERY",
+    Desc: "Criteria to match.",
+    Value: []string{},
+    EnvVar: "",
+  })
+
+  cmd.Action = func() {
+    app.runRestore(*query)
+  }
+}
+
+func (app *App) runRestore(query []string) {
+  db := app.openStore()
+  defer db.Close()
+
+  credential := findTrashedCredential(db, query)
+  if credential == nil {
+    return
+  }
+
+  if err := db.RestoreCredential(credential); err != nil {
+    printError("Failed to restore credential: %s\n", err)
+    return
+  }
+
+  printSuccess("Restored %s.\n", formatCredential(credential))
+}
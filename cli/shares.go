@@ -0,0 +1,113 @@
+package main
+
+import (
+  "github.com/schmich/ward/store"
+  "github.com/schmich/ward/crypto"
+  "github.com/jawher/mow.cli"
+  "github.com/mattn/go-colorable"
+  "github.com/qpliu/qrencode-go/qrencode"
+  "github.com/fumiyas/qrc/lib"
+  "fmt"
+)
+
+func (app *App) sharesCommand(cmd *cli.Cmd) {
+  cmd.Command("create", "Split a key that unlocks the vault into shares.", app.sharesCreateCommand)
+  cmd.Command("unlock", "Rebuild the key from shares and run a command on the vault.", app.sharesUnlockCommand)
+}
+
+func (app *App) sharesCreateCommand(cmd *cli.Cmd) {
+  cmd.Spec = "--threshold --count"
+
+  threshold := cmd.IntOpt("threshold", 0, "Number of shares needed to unlock the vault.")
+  count := cmd.IntOpt("count", 0, "Number of shares to create.")
+
+  cmd.Action = func() {
+    app.runSharesCreate(*threshold, *count)
+  }
+}
+
+func (app *App) runSharesCreate(threshold int, count int) {
+  db := app.openStore()
+  defer db.Close()
+
+  shares, err := db.CreateShares(threshold, count)
+  if err != nil {
+    printError("Failed to create shares: %s\n", err)
+    return
+  }
+
+  printSuccess("Created %d shares, any %d of which unlock the vault. Give each to a different person; they will not be shown again.\n", count, threshold)
+
+  stdout := colorable.NewColorableStdout()
+  for _, share := range shares {
+    encoded := crypto.EncodeShare(share)
+    fmt.Printf("\nShare %d of %d:\n\n  %s\n\n", share.Index, count, encoded)
+
+    grid, err := qrencode.Encode(encoded, qrencode.ECLevelL)
+    if err != nil {
+      printError("%s\n", err)
+      return
+    }
+
+    qrc.PrintAA(stdout, grid, false)
+  }
+
+  fmt.Println("Use 'ward shares unlock COMMAND' with the shares to open the vault. Creating new shares revokes these.")
+}
+
+func (app *App) sharesUnlockCommand(cmd *cli.Cmd) {
+  cmd.Spec = "COMMAND..."
+
+  args := cmd.Strings(cli.StringsArg {
+    Name: "COMMAND",
+    Desc: "Command to run on the unlocked vault, e.g. list. Put -- before commands with options.",
+    Value: []string{},
+    EnvVar: "",
+  })
+
+  cmd.Action = func() {
+    app.runSharesUnlock(*args)
+  }
+}
+
+// Rebuilds the key from shares and runs a command on the vault it unlocks.
+// The key is only kept in memory for the command, so no one is left holding
+// it afterwards.
+func (app *App) runSharesUnlock(args []string) {
+  shares := make([]crypto.Share, 0)
+  for len(shares) == 0 || len(shares) < shares[0].Threshold {
+    share, err := crypto.DecodeShare(readInput(fmt.Sprintf("Share %d: ", len(shares) + 1)))
+    if err != nil {
+      printError("%s\n", err)
+      continue
+    }
+
+    if len(shares) > 0 && (share.Set != shares[0].Set || share.Threshold != shares[0].Threshold) {
+      printError("This share was not created with the others.\n")
+      continue
+    }
+
+    duplicate := false
+    for _, other := range shares {
+      duplicate = duplicate || other.Index == share.Index
+    }
+
+    if duplicate {
+      printError("Share %d was already given.\n", share.Index)
+      continue
+    }
+
+    shares = append(shares, share)
+  }
+
+  db, err := store.OpenShares(app.storeFileName, app.vaultName, shares)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  printSuccess("Vault unlocked.\n")
+
+  app.unlocked = db
+  app.Run(append([]string { "ward", "--vault", app.vaultName }, args...))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+  "github.com/schmich/ward/store"
+  "github.com/jawher/mow.cli"
+  "github.com/rodaine/table"
+  "github.com/fatih/color"
+  "strings"
+  "fmt"
+)
+
+func (app *App) slotCommand(cmd *cli.Cmd) {
+  cmd.Command("list", "List the key slots that unlock the vault.", app.slotListCommand)
+  cmd.Command("add", "Add a password or key file that unlocks the vault.", app.slotAddCommand)
+  cmd.Command("remove", "Revoke a key slot.", app.slotRemoveCommand)
+  cmd.Command("recovery-key", "Add a recovery key that resets a forgotten master password.", app.slotRecoveryKeyCommand)
+}
+
+func (app *App) slotListCommand(cmd *cli.Cmd) {
+  cmd.Action = func() {
+    app.runSlotList()
+  }
+}
+
+func (app *App) runSlotList() {
+  db := app.openStore()
+  defer db.Close()
+
+  slots, err := db.KeySlots()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  headerFmt := color.New(color.FgCyan, color.Underline).SprintfFunc()
+
+  table := table.New("ID", "Label", "Unlock with", "Key derivation")
+  table.WithHeaderFormatter(headerFmt)
+
+  for _, slot := range slots {
+    label := slot.Label
+    if slot.ID == db.UnlockedSlot() {
+      label += " (current)"
+    }
+
+    factors := make([]string, 0)
+    kdf := ""
+    if slot.Password {
+      factors = append(factors, "password")
+      kdf = slot.KDF.String()
+    }
+
+    if slot.Label == store.RecoverySlotLabel {
+      factors = append(factors, "recovery key")
+    } else if slot.Label == store.SharesSlotLabel {
+      factors = append(factors, "shares")
+    } else if slot.KeyFile {
+      factors = append(factors, "key file")
+    }
+
+    table.AddRow(slot.ID, label, strings.Join(factors, " + "), kdf)
+  }
+
+  table.Print()
+}
+
+func (app *App) slotAddCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[" + kdfOptionsSpec + " | --key-file | --no-password]... LABEL"
+
+  kdf := addKDFOptions(cmd)
+  keyFile := cmd.StringOpt("key-file", "", "Require a key file. Created if it does not exist.")
+  noPassword := cmd.BoolOpt("no-password", false, "Unlock with the key file alone.")
+  label := cmd.StringArg("LABEL", "", "Label for the key slot, e.g. spouse.")
+
+  cmd.Action = func() {
+    app.runSlotAdd(*label, kdf, *keyFile, *noPassword)
+  }
+}
+
+func (app *App) runSlotAdd(label string, options *kdfOptions, keyFileName string, noPassword bool) {
+  if noPassword && keyFileName == "" {
+    printError("A key slot without a password requires --key-file.\n")
+    return
+  }
+
+  kdf, err := options.kdf()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  db := app.openStore()
+  defer db.Close()
+
+  var keyFile []byte
+  if keyFileName != "" {
+    if keyFile, err = readKeyFile(keyFileName, true); err != nil {
+      printError("%s\n", err)
+      return
+    }
+  }
+
+  password := ""
+  if !noPassword {
+    password = readPasswordConfirm(fmt.Sprintf("Password for key slot \"%s\"", label))
+  }
+
+  if _, err = db.AddKeySlot(label, password, keyFile, kdf); err != nil {
+    printError("Failed to add key slot: %s\n", err)
+    return
+  }
+
+  printSuccess("Key slot \"%s\" added.\n", label)
+}
+
+func (app *App) slotRemoveCommand(cmd *cli.Cmd) {
+  slot := cmd.StringArg("SLOT", "", "Label or ID of the key slot to remove.")
+
+  cmd.Action = func() {
+    app.runSlotRemove(*slot)
+  }
+}
+
+func (app *App) runSlotRemove(name string) {
+  db := app.openStore()
+  defer db.Close()
+
+  slot, err := db.FindKeySlot(name)
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  if confirm := readYesNo(fmt.Sprintf("Revoke key slot \"%s\"", slot.Label)); !confirm {
+    printError("Canceled.\n")
+    return
+  }
+
+  if err = db.RemoveKeySlot(slot.ID); err != nil {
+    printError("Failed to remove key slot: %s\n", err)
+    return
+  }
+
+  printSuccess("Key slot \"%s\" removed.\n", slot.Label)
+}
+
+func (app *App) slotRecoveryKeyCommand(cmd *cli.Cmd) {
+  cmd.Action = func() {
+    app.runSlotRecoveryKey()
+  }
+}
+
+func (app *App) runSlotRecoveryKey() {
+  db := app.openStore()
+  defer db.Close()
+
+  app.addRecoveryKey(db)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+  "github.com/jawher/mow.cli"
+  "github.com/rodaine/table"
+  "github.com/fatih/color"
+  "time"
+)
+
+func (app *App) trashCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[--empty [--days]]"
+
+  empty := cmd.BoolOpt("empty", false, "Permanently delete credentials in the trash.")
+  days := cmd.IntOpt("days", 0, "Only delete credentials in the trash for at least this many days.")
+
+  cmd.Action = func() {
+    if *empty {
+      app.runEmptyTrash(*days)
+    } else {
+      app.runTrash()
+    }
+  }
+}
+
+func (app *App) runTrash() {
+  db := app.openStore()
+  defer db.Close()
+
+  credentials, err := db.TrashedCredentials()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  if len(credentials) == 0 {
+    printSuccess("Trash is empty.\n")
+    return
+  }
+
+  headerFmt := color.New(color.FgCyan, color.Underline).SprintfFunc()
+
+  table := table.New("Login", "Realm", "Deleted")
+  table.WithHeaderFormatter(headerFmt)
+
+  for _, credential := range credentials {
+    table.AddRow(credential.Login, credential.Realm, formatTime(credential.Deleted))
+  }
+
+  table.Print()
+}
+
+func (app *App) runEmptyTrash(days int) {
+  if days < 0 {
+    printError("Invalid number of days: %d.\n", days)
+    return
+  }
+
+  db := app.openStore()
+  defer db.Close()
+
+  prompt := "Permanently delete all credentials in the trash"
+  if days > 0 {
+    prompt = "Permanently delete credentials in the trash for more than " + pluralize(days, "day")
+  }
+
+  if confirm := readYesNo(prompt); !confirm {
+    printError("Canceled.\n")
+    return
+  }
+
+  count, err := db.EmptyTrash(time.Duration(days) * 24 * time.Hour)
+  if err != nil {
+    printError("Failed to empty trash: %s\n", err)
+    return
+  }
+
+  printSuccess("Permanently deleted %s.\n", pluralize(count, "credential"))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+  "github.com/jawher/mow.cli"
+  "fmt"
+)
+
+func (app *App) vaultCommand(cmd *cli.Cmd) {
+  cmd.Command("create", "Create a new vault with its own master password.", app.vaultCreateCommand)
+  cmd.Command("list", "List the vaults in the database.", app.vaultListCommand)
+  cmd.Command("remove", "Permanently delete a vault and its credentials.", app.vaultRemoveCommand)
+}
+
+func (app *App) vaultCreateCommand(cmd *cli.Cmd) {
+  cmd.Spec = "[" + kdfOptionsSpec + "]... NAME"
+
+  kdf := addKDFOptions(cmd)
+  name := cmd.StringArg("NAME", "", "Name of the new vault.")
+
+  cmd.Action = func() {
+    app.runVaultCreate(*name, kdf)
+  }
+}
+
+func (app *App) runVaultCreate(name string, options *kdfOptions) {
+  kdf, err := options.kdf()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  db := app.openStore()
+  defer db.Close()
+
+  password := readPasswordConfirm(fmt.Sprintf("Master password for vault \"%s\"", name))
+  if err := db.CreateVault(name, password, kdf); err != nil {
+    printError("Failed to create vault: %s\n", err)
+    return
+  }
+
+  printSuccess("Vault \"%s\" created. Use it with --vault %s.\n", name, name)
+}
+
+func (app *App) vaultListCommand(cmd *cli.Cmd) {
+  cmd.Action = func() {
+    app.runVaultList()
+  }
+}
+
+func (app *App) runVaultList() {
+  db := app.openStore()
+  defer db.Close()
+
+  vaults, err := db.Vaults()
+  if err != nil {
+    printError("%s\n", err)
+    return
+  }
+
+  for _, vault := range vaults {
+    fmt.Println(vault)
+  }
+}
+
+func (app *App) vaultRemoveCommand(cmd *cli.Cmd) {
+  name := cmd.StringArg("NAME", "", "Name of the vault to remove.")
+
+  cmd.Action = func() {
+    app.runVaultRemove(*name)
+  }
+}
+
+func (app *App) runVaultRemove(name string) {
+  app.vaultName = name
+
+  db := app.openStore()
+  defer db.Close()
+
+  if confirm := readYesNo(fmt.Sprintf("Permanently delete vault \"%s\" and all of its credentials", name)); !confirm {
+    printError("Canceled.\n")
+    return
+  }
+
+  if err := db.RemoveVault(); err != nil {
+    printError("Failed to remove vault: %s\n", err)
+    return
+  }
+
+  printSuccess("Vault \"%s\" removed.\n", name)
+}
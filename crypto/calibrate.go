@@ -0,0 +1,162 @@
+package crypto
+
+import (
+  "errors"
+  "fmt"
+  "time"
+)
+
+// The least memory, in KiB, that Argon2id should use for a given number of
+// passes, following the OWASP password storage recommendations. More passes
+// allow less memory.
+var argon2idMinimums = []struct {
+  passes int
+  memory int
+} {
+  { 5, 7 * 1024 },
+  { 4, 9 * 1024 },
+  { 3, 12 * 1024 },
+  { 2, 19 * 1024 },
+  { 1, 46 * 1024 },
+}
+
+// The least number of PBKDF2 iterations recommended by OWASP.
+const MinPBKDF2Iterations = 210000
+
+// Returns the ways in which the parameters fall short of current
+// recommendations, or nil if they meet them.
+func (kdf KDF) Weaknesses() []string {
+  weaknesses := make([]string, 0)
+
+  switch kdf.Name {
+  case KDFPBKDF2:
+    if kdf.Time < MinPBKDF2Iterations {
+      weaknesses = append(weaknesses, fmt.Sprintf("PBKDF2 uses fewer than %d iterations", MinPBKDF2Iterations))
+    }
+  case KDFArgon2id:
+    if minimum := minArgon2idMemory(kdf.Time); kdf.Memory < minimum {
+      weaknesses = append(weaknesses, fmt.Sprintf("Argon2id with %d passes uses less than %d MiB of memory", kdf.Time, minimum / 1024))
+    }
+  default:
+    weaknesses = append(weaknesses, fmt.Sprintf("unsupported key derivation function %s", kdf.Name))
+  }
+
+  if len(weaknesses) == 0 {
+    return nil
+  }
+
+  return weaknesses
+}
+
+// Returns the least memory, in KiB, that Argon2id should use with the given
+// number of passes.
+func minArgon2idMemory(passes int) int {
+  for _, minimum := range argon2idMinimums {
+    if passes >= minimum.passes {
+      return minimum.memory
+    }
+  }
+
+  return argon2idMinimums[len(argon2idMinimums) - 1].memory
+}
+
+// Returns how long deriving a key with the given parameters takes on this
+// machine.
+func Benchmark(kdf KDF) (time.Duration, error) {
+  salt := make([]byte, 64)
+
+  start := time.Now()
+  if _, err := LoadPasswordKey("benchmark", salt, kdf, 32); err != nil {
+    return 0, err
+  }
+
+  return time.Since(start), nil
+}
+
+// Measures key derivation during calibration; replaced in tests.
+var benchmark = Benchmark
+
+// Returns parameters that take about the target time to derive a key on this
+// machine. For Argon2id, the memory and threads are kept and the number of
+// passes is chosen; if a single pass takes longer than the target, the memory
+// is reduced, but not below the recommended minimum for a single pass. For
+// PBKDF2, the iteration count is chosen. Fails if the target is too short to
+// meet current recommendations.
+func Calibrate(kdf KDF, target time.Duration) (KDF, error) {
+  if target <= 0 {
+    return kdf, errors.New("Target unlock time must be positive.")
+  }
+
+  if kdf.Name == KDFPBKDF2 {
+    return calibratePBKDF2(target)
+  }
+
+  kdf.Time = 1
+  if err := kdf.Validate(); err != nil {
+    return kdf, err
+  }
+
+  for {
+    elapsed, err := benchmark(kdf)
+    if err != nil {
+      return kdf, err
+    }
+
+    if elapsed > target {
+      if kdf.Memory / 2 >= minArgon2idMemory(1) && kdf.Memory / 2 >= 8 * kdf.Threads {
+        kdf.Memory /= 2
+        continue
+      }
+
+      return kdf, errors.New(fmt.Sprintf("Target unlock time %s is too short: one Argon2id pass over %d MiB takes %s on this machine.", target, kdf.Memory / 1024, elapsed.Round(time.Millisecond)))
+    }
+
+    // Fixed costs make a single pass a poor predictor of many passes, so the
+    // estimate is measured and corrected once.
+    if kdf.Time = scale(1, elapsed, target); kdf.Time > 1 {
+      if elapsed, err = benchmark(kdf); err != nil {
+        return kdf, err
+      }
+
+      kdf.Time = scale(kdf.Time, elapsed, target)
+    }
+
+    return kdf, nil
+  }
+}
+
+func calibratePBKDF2(target time.Duration) (KDF, error) {
+  // Short runs are dominated by timer resolution and warmup.
+  kdf := PBKDF2Params(1000)
+  for {
+    elapsed, err := benchmark(kdf)
+    if err != nil {
+      return kdf, err
+    }
+
+    if elapsed >= target / 10 || elapsed >= 100 * time.Millisecond {
+      if kdf.Time = scale(kdf.Time, elapsed, target); kdf.Time < MinPBKDF2Iterations {
+        return kdf, errors.New(fmt.Sprintf("Target unlock time %s is too short: PBKDF2 needs at least %d iterations.", target, MinPBKDF2Iterations))
+      }
+
+      return kdf, nil
+    }
+
+    kdf.Time *= 2
+  }
+}
+
+// Scales a cost measured to take elapsed time so that it takes the target
+// time, assuming the time is proportional to the cost.
+func scale(cost int, elapsed, target time.Duration) int {
+  if elapsed <= 0 {
+    elapsed = 1
+  }
+
+  scaled := int(float64(cost) * float64(target) / float64(elapsed))
+  if scaled < 1 {
+    return 1
+  }
+
+  return scaled
+}
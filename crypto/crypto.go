@@ -1,13 +1,20 @@
 package crypto
 
 import (
+  "golang.org/x/crypto/chacha20poly1305"
+  "golang.org/x/crypto/argon2"
   "golang.org/x/crypto/pbkdf2"
+  "golang.org/x/crypto/hkdf"
   "golang.org/x/crypto/sha3"
   gocipher "crypto/cipher"
+  "crypto/hmac"
   "crypto/aes"
   "crypto/rand"
-  "math/big"
+  "encoding/binary"
   "errors"
+  "math"
+  "fmt"
+  "io"
 )
 
 type IncorrectPasswordError string
@@ -22,23 +29,136 @@ func (s InvalidPasswordError) Error() string {
   return "Invalid password."
 }
 
+type CorruptCiphertextError string
+
+func (s CorruptCiphertextError) Error() string {
+  return "Corrupt ciphertext."
+}
+
+// Nonces are a random prefix chosen when the cipher is created followed by a
+// counter. Every process picks its own prefix, so copies of a database that
+// are modified independently, e.g. on two machines syncing the same file,
+// never reuse a nonce under the same key.
 type Cipher struct {
   aead gocipher.AEAD
-  nonce *big.Int
+  prefix []byte
+  counter uint32
+}
+
+const noncePrefixSize = 8
+
+// Authenticated encryption algorithms, identified by the names stored with
+// encrypted data. AES-128-GCM is only supported for data encrypted before
+// 256-bit keys were introduced.
+const (
+  SuiteAES128GCM = "aes-128-gcm"
+  SuiteAES256GCM = "aes-256-gcm"
+  SuiteChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// The suite used for new keys.
+const DefaultSuite = SuiteAES256GCM
+
+// Returns the key size of a suite in bytes.
+func KeySize(suite string) (int, error) {
+  switch suite {
+  case SuiteAES128GCM:
+    return 16, nil
+  case SuiteAES256GCM, SuiteChaCha20Poly1305:
+    return 32, nil
+  }
+
+  return 0, errors.New(fmt.Sprintf("Unsupported cipher suite: %s.", suite))
 }
 
+// Generates a random 256-bit key.
 func NewKey() []byte {
-  key := make([]byte, aes.BlockSize)
+  key, _ := NewSuiteKey(DefaultSuite)
+  return key
+}
+
+// Generates a random key for the given suite.
+func NewSuiteKey(suite string) ([]byte, error) {
+  size, err := KeySize(suite)
+  if err != nil {
+    return nil, err
+  }
+
+  key := make([]byte, size)
   count, err := rand.Read(key)
 
   if (err != nil) || (count != len(key)) {
     panic("Failed to generate random key.")
   }
 
-  return key
+  return key, nil
+}
+
+// Functions for deriving a key from the master password.
+const (
+  KDFPBKDF2 = "pbkdf2-sha3-512"
+  KDFArgon2id = "argon2id"
+)
+
+// Parameters for deriving a key from the master password. For PBKDF2, Time
+// is the iteration count and the other parameters are unused. For Argon2id,
+// Time is the number of passes, Memory is in KiB, and Threads is the degree
+// of parallelism.
+type KDF struct {
+  Name string
+  Time int
+  Memory int
+  Threads int
+}
+
+func PBKDF2Params(iterations int) KDF {
+  return KDF { Name: KDFPBKDF2, Time: iterations }
+}
+
+func Argon2idParams(time, memory, threads int) KDF {
+  return KDF { Name: KDFArgon2id, Time: time, Memory: memory, Threads: threads }
+}
+
+func (kdf KDF) Validate() error {
+  switch kdf.Name {
+  case KDFPBKDF2:
+    if kdf.Time < 1 {
+      return errors.New("Key stretch must be at least 1.")
+    }
+  case KDFArgon2id:
+    if kdf.Time < 1 {
+      return errors.New("Argon2id passes must be at least 1.")
+    }
+
+    if kdf.Threads < 1 || kdf.Threads > math.MaxUint8 {
+      return errors.New(fmt.Sprintf("Argon2id threads must be between 1 and %d.", math.MaxUint8))
+    }
+
+    if kdf.Memory < 8 * kdf.Threads {
+      return errors.New("Argon2id memory must be at least 8 KiB per thread.")
+    }
+  default:
+    return errors.New(fmt.Sprintf("Unsupported key derivation function: %s.", kdf.Name))
+  }
+
+  return nil
+}
+
+func (kdf KDF) String() string {
+  if kdf.Name == KDFArgon2id {
+    memory := fmt.Sprintf("%d MiB", kdf.Memory / 1024)
+    if kdf.Memory % 1024 != 0 {
+      memory = fmt.Sprintf("%d KiB", kdf.Memory)
+    }
+
+    return fmt.Sprintf("%s (%d passes, %s, %d threads)", kdf.Name, kdf.Time, memory, kdf.Threads)
+  }
+
+  return fmt.Sprintf("%s (%d iterations)", kdf.Name, kdf.Time)
 }
 
-func NewPasswordKey(password string, stretch int) ([]byte, []byte, error) {
+// Derives a key of the given size from a password and a new random salt.
+func NewPasswordKey(password string, kdf KDF, size int) ([]byte, []byte, error) {
   salt := make([]byte, 64)
   count, err := rand.Read(salt)
   if err != nil {
@@ -49,7 +169,7 @@ func NewPasswordKey(password string, stretch int) ([]byte, []byte, error) {
     return nil, nil, errors.New("Failed to generate random salt.")
   }
 
-  key, err := LoadPasswordKey(password, salt, stretch)
+  key, err := LoadPasswordKey(password, salt, kdf, size)
   if err != nil {
     return nil, nil, err
   }
@@ -57,7 +177,7 @@ func NewPasswordKey(password string, stretch int) ([]byte, []byte, error) {
   return key, salt, err
 }
 
-func LoadPasswordKey(password string, salt []byte, stretch int) ([]byte, error) {
+func LoadPasswordKey(password string, salt []byte, kdf KDF, size int) ([]byte, error) {
   if len(password) == 0 {
     var e InvalidPasswordError
     return nil, e
@@ -67,88 +187,200 @@ func LoadPasswordKey(password string, salt []byte, stretch int) ([]byte, error)
     return nil, errors.New("Invalid salt.")
   }
 
-  if stretch < 1 {
-    return nil, errors.New("Key stretch must be at least 1.")
+  if err := kdf.Validate(); err != nil {
+    return nil, err
+  }
+
+  if kdf.Name == KDFArgon2id {
+    return argon2.IDKey([]byte(password), salt, uint32(kdf.Time), uint32(kdf.Memory), uint8(kdf.Threads), uint32(size)), nil
+  }
+
+  return pbkdf2.Key([]byte(password), salt, kdf.Time, size, sha3.New512), nil
+}
+
+// Derives an independent 256-bit subkey for the given purpose, e.g. for MACs.
+func DeriveKey(key []byte, purpose string) []byte {
+  subkey := make([]byte, 32)
+  reader := hkdf.New(sha3.New256, key, nil, []byte(purpose))
+  if _, err := io.ReadFull(reader, subkey); err != nil {
+    panic("Failed to derive key.")
+  }
+
+  return subkey
+}
+
+// Combines a key derived from a password with the contents of a key file, so
+// that both are needed to reproduce the result.
+func CombineKeyFile(passwordKey []byte, keyFile []byte) []byte {
+  digest := sha3.Sum256(keyFile)
+  key := make([]byte, len(passwordKey))
+  reader := hkdf.New(sha3.New256, passwordKey, digest[:], []byte("ward key file"))
+  if _, err := io.ReadFull(reader, key); err != nil {
+    panic("Failed to derive key.")
   }
 
-  return pbkdf2.Key([]byte(password), salt, stretch, aes.BlockSize, sha3.New512), nil
+  return key
 }
 
+// Generates random contents for a new key file.
+func NewKeyFile() []byte {
+  keyFile := make([]byte, 64)
+  count, err := rand.Read(keyFile)
+
+  if (err != nil) || (count != len(keyFile)) {
+    panic("Failed to generate key file.")
+  }
+
+  return keyFile
+}
+
+// Computes an HMAC-SHA3-256 over the concatenated data.
+func MAC(key []byte, data ...[]byte) []byte {
+  mac := hmac.New(sha3.New256, key)
+  for _, buffer := range data {
+    mac.Write(buffer)
+  }
+
+  return mac.Sum(nil)
+}
+
+// Returns an AES-GCM cipher, using AES-128 or AES-256 depending on the key
+// size.
 func NewCipher(key []byte) (*Cipher, error) {
-  nonce := make([]byte, 12)
-  cipher, err := LoadCipher(key, nonce)
-  if err != nil {
-    return nil, err
+  if len(key) == 16 {
+    return NewSuiteCipher(SuiteAES128GCM, key)
   }
 
-  return cipher, nil
+  return NewSuiteCipher(SuiteAES256GCM, key)
 }
 
-func LoadCipher(key, nonce []byte) (*Cipher, error) {
-  if len(key) != aes.BlockSize {
+func NewSuiteCipher(suite string, key []byte) (*Cipher, error) {
+  size, err := KeySize(suite)
+  if err != nil {
+    return nil, err
+  }
+
+  if len(key) != size {
     return nil, errors.New("Invalid key.")
   }
 
-  if len(nonce) < 12 {
-    return nil, errors.New("Invalid nonce.")
+  var aead gocipher.AEAD
+  if suite == SuiteChaCha20Poly1305 {
+    if aead, err = chacha20poly1305.New(key); err != nil {
+      return nil, err
+    }
+  } else {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+      return nil, err
+    }
+
+    if aead, err = gocipher.NewGCM(block); err != nil {
+      return nil, err
+    }
   }
 
-  block, err := aes.NewCipher(key)
-  if err != nil {
+  cipher := &Cipher { aead: aead }
+  if err = cipher.newPrefix(); err != nil {
     return nil, err
   }
 
-  aead, err := gocipher.NewGCM(block)
+  return cipher, nil
+}
+
+func (cipher *Cipher) newPrefix() error {
+  prefix := make([]byte, noncePrefixSize)
+  count, err := rand.Read(prefix)
   if err != nil {
-    return nil, err
+    return err
   }
 
-  nonceInt := big.NewInt(0)
-  nonceInt.SetBytes(nonce)
+  if count != len(prefix) {
+    return errors.New("Failed to generate random nonce.")
+  }
 
-  return &Cipher {
-    aead: aead,
-    nonce: nonceInt,
-  }, nil
+  cipher.prefix = prefix
+  cipher.counter = 0
+  return nil
 }
 
-func (cipher *Cipher) GetNonce() []byte {
-  nonceBytes := cipher.nonce.Bytes()
+func (cipher *Cipher) nextNonce() []byte {
+  // A prefix is never used for more nonces than its counter can represent.
+  if cipher.counter == math.MaxUint32 {
+    if err := cipher.newPrefix(); err != nil {
+      panic("Failed to generate random nonce.")
+    }
+  }
+
   nonce := make([]byte, cipher.aead.NonceSize())
-  copy(nonce[len(nonce) - len(nonceBytes):], nonceBytes)
+  copy(nonce, cipher.prefix)
+  binary.BigEndian.PutUint32(nonce[noncePrefixSize:], cipher.counter)
+  cipher.counter++
+
   return nonce
 }
 
 func (cipher *Cipher) Encrypt(plaintext []byte) []byte {
+  return cipher.EncryptWithData(plaintext, nil)
+}
+
+// Encrypts plaintext and authenticates it together with associated data,
+// e.g. where the ciphertext is stored. The same data must be given to
+// DecryptWithData.
+func (cipher *Cipher) EncryptWithData(plaintext []byte, data []byte) []byte {
   plaintextBuffer := pad(plaintext)
 
-  nonce := cipher.GetNonce()
-  cipher.nonce = cipher.nonce.Add(cipher.nonce, big.NewInt(1))
+  nonce := cipher.nextNonce()
 
   var ciphertext []byte
-  ciphertext = cipher.aead.Seal(ciphertext, nonce, plaintextBuffer, []byte{})
+  ciphertext = cipher.aead.Seal(ciphertext, nonce, plaintextBuffer, data)
 
   return append(ciphertext, nonce...)
 }
 
+// Decrypts ciphertext sealed with a password-derived key. Authentication
+// failures are reported as IncorrectPasswordError.
 func (cipher *Cipher) TryDecrypt(ciphertext []byte) ([]byte, error) {
+  plaintext, err := cipher.Decrypt(ciphertext)
+  if _, ok := err.(CorruptCiphertextError); ok {
+    var e IncorrectPasswordError
+    return []byte{}, e
+  }
+
+  return plaintext, err
+}
+
+// Decrypts ciphertext produced by Encrypt. Malformed or unauthenticated
+// ciphertext is reported as CorruptCiphertextError.
+func (cipher *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
+  return cipher.DecryptWithData(ciphertext, nil)
+}
+
+// Decrypts ciphertext produced by EncryptWithData. Ciphertext encrypted with
+// different associated data is reported as CorruptCiphertextError.
+func (cipher *Cipher) DecryptWithData(ciphertext []byte, data []byte) ([]byte, error) {
+  var e CorruptCiphertextError
+
   nonceStart := len(ciphertext) - cipher.aead.NonceSize()
+  if nonceStart < cipher.aead.Overhead() {
+    return []byte{}, e
+  }
+
   nonce := ciphertext[nonceStart:]
   ciphertext = ciphertext[:nonceStart]
 
   var plaintext []byte
-  plaintext, err := cipher.aead.Open(plaintext, nonce, ciphertext, []byte{})
+  plaintext, err := cipher.aead.Open(plaintext, nonce, ciphertext, data)
   if err != nil {
-    var e IncorrectPasswordError
     return []byte{}, e
   }
 
-  return depad(plaintext), nil
-}
+  plaintext, ok := depad(plaintext)
+  if !ok {
+    return []byte{}, e
+  }
 
-func (cipher *Cipher) Decrypt(ciphertext []byte) []byte {
-  plaintext, _ := cipher.TryDecrypt(ciphertext)
-  return plaintext
+  return plaintext, nil
 }
 
 func pad(buffer []byte) []byte {
@@ -163,8 +395,16 @@ func pad(buffer []byte) []byte {
   return append(buffer, padBuffer...)
 }
 
-func depad(buffer []byte) []byte {
+func depad(buffer []byte) ([]byte, bool) {
   // See http://tools.ietf.org/html/rfc5652#section-6.3
+  if len(buffer) == 0 {
+    return nil, false
+  }
+
   padLength := int(buffer[len(buffer) - 1])
-  return buffer[:len(buffer) - padLength]
+  if padLength == 0 || padLength > len(buffer) {
+    return nil, false
+  }
+
+  return buffer[:len(buffer) - padLength], true
 }
@@ -1,9 +1,11 @@
 package crypto_test
 
 import (
+  "strings"
   "testing"
   "github.com/schmich/ward/crypto"
   . "gopkg.in/check.v1"
+  "time"
 )
 
 func Test(t *testing.T) {
@@ -21,22 +23,22 @@ func (s *CryptoSuite) TestNewKey(c *C) {
 }
 
 func (s *CryptoSuite) TestNewPasswordKey(c *C) {
-  key, salt, err := crypto.NewPasswordKey("pass", 1)
+  key, salt, err := crypto.NewPasswordKey("pass", crypto.PBKDF2Params(1), 32)
   c.Assert(key, NotNil)
   c.Assert(salt, NotNil)
   c.Assert(err, IsNil)
-  key, salt, err = crypto.NewPasswordKey("pass", 100)
+  key, salt, err = crypto.NewPasswordKey("pass", crypto.PBKDF2Params(100), 32)
   c.Assert(key, NotNil)
   c.Assert(salt, NotNil)
   c.Assert(err, IsNil)
 }
 
 func (s *CryptoSuite) TestNewPasswordKeyFail(c *C) {
-  key, salt, err := crypto.NewPasswordKey("", 1)
+  key, salt, err := crypto.NewPasswordKey("", crypto.PBKDF2Params(1), 32)
   c.Assert(key, IsNil)
   c.Assert(salt, IsNil)
   c.Assert(err, NotNil)
-  key, salt, err = crypto.NewPasswordKey("pass", 0)
+  key, salt, err = crypto.NewPasswordKey("pass", crypto.PBKDF2Params(0), 32)
   c.Assert(key, IsNil)
   c.Assert(salt, IsNil)
   c.Assert(err, NotNil)
@@ -44,67 +46,198 @@ func (s *CryptoSuite) TestNewPasswordKeyFail(c *C) {
 
 func (s *CryptoSuite) TestLoadPasswordKey(c *C) {
   salt := make([]byte, 64)
-  key, err := crypto.LoadPasswordKey("pass", salt, 1)
+  key, err := crypto.LoadPasswordKey("pass", salt, crypto.PBKDF2Params(1), 32)
   c.Assert(key, NotNil)
   c.Assert(err, IsNil)
 }
 
 func (s *CryptoSuite) TestNewLoadPasswordKey(c *C) {
   password := "pass"
-  stretch := 1
-  newKey, salt, _ := crypto.NewPasswordKey(password, stretch)
-  loadKey, _ := crypto.LoadPasswordKey(password, salt, stretch)
+  kdf := crypto.PBKDF2Params(1)
+  newKey, salt, _ := crypto.NewPasswordKey(password, kdf, 32)
+  loadKey, _ := crypto.LoadPasswordKey(password, salt, kdf, 32)
   c.Assert(newKey, DeepEquals, loadKey)
 }
 
+func (s *CryptoSuite) TestArgon2id(c *C) {
+  password := "pass"
+  kdf := crypto.Argon2idParams(1, 64, 1)
+  newKey, salt, err := crypto.NewPasswordKey(password, kdf, 32)
+  c.Assert(err, IsNil)
+  loadKey, _ := crypto.LoadPasswordKey(password, salt, kdf, 32)
+  c.Assert(newKey, DeepEquals, loadKey)
+  pbkdf2Key, _ := crypto.LoadPasswordKey(password, salt, crypto.PBKDF2Params(1), 32)
+  c.Assert(pbkdf2Key, Not(DeepEquals), loadKey)
+  otherKey, _ := crypto.LoadPasswordKey(password, salt, crypto.Argon2idParams(2, 64, 1), 32)
+  c.Assert(otherKey, Not(DeepEquals), loadKey)
+  for _, invalid := range []crypto.KDF {
+    crypto.Argon2idParams(0, 64, 1),
+    crypto.Argon2idParams(1, 64, 0),
+    crypto.Argon2idParams(1, 4, 1),
+    crypto.Argon2idParams(1, 64 * 1024, 256),
+    { Name: "scrypt", Time: 1 },
+  } {
+    _, err = crypto.LoadPasswordKey(password, salt, invalid, 32)
+    c.Assert(err, NotNil)
+  }
+}
+
+func (s *CryptoSuite) TestKDFString(c *C) {
+  c.Assert(crypto.Argon2idParams(3, 64 * 1024, 4).String(), Equals, "argon2id (3 passes, 64 MiB, 4 threads)")
+  c.Assert(crypto.Argon2idParams(1, 64, 1).String(), Equals, "argon2id (1 passes, 64 KiB, 1 threads)")
+  c.Assert(crypto.Argon2idParams(1, 1536, 1).String(), Equals, "argon2id (1 passes, 1536 KiB, 1 threads)")
+  c.Assert(crypto.PBKDF2Params(100000).String(), Equals, "pbkdf2-sha3-512 (100000 iterations)")
+}
+
 func (s *CryptoSuite) TestNewCipher(c *C) {
   cipher, err := crypto.NewCipher(crypto.NewKey())
   c.Assert(cipher, NotNil)
   c.Assert(err, IsNil)
 }
 
-func (s *CryptoSuite) TestNewCipherFail(c *C) {
-  cipher, err := crypto.NewCipher([]byte{})
-  c.Assert(cipher, IsNil)
+func (s *CryptoSuite) TestSuites(c *C) {
+  plaintext := []byte("plaintext")
+  for _, suite := range []string { crypto.SuiteAES128GCM, crypto.SuiteAES256GCM, crypto.SuiteChaCha20Poly1305 } {
+    key, err := crypto.NewSuiteKey(suite)
+    c.Assert(err, IsNil)
+    size, _ := crypto.KeySize(suite)
+    c.Assert(key, HasLen, size)
+    cipher, err := crypto.NewSuiteCipher(suite, key)
+    c.Assert(err, IsNil)
+    decrypted, err := cipher.DecryptWithData(cipher.EncryptWithData(plaintext, []byte("data")), []byte("data"))
+    c.Assert(err, IsNil)
+    c.Assert(decrypted, DeepEquals, plaintext)
+  }
+  c.Assert(crypto.NewKey(), HasLen, 32)
+  key := crypto.NewKey()
+  aes, _ := crypto.NewSuiteCipher(crypto.SuiteAES256GCM, key)
+  chacha, _ := crypto.NewSuiteCipher(crypto.SuiteChaCha20Poly1305, key)
+  _, err := chacha.Decrypt(aes.Encrypt(plaintext))
+  c.Assert(err, NotNil)
+  _, err = crypto.NewSuiteCipher(crypto.SuiteAES128GCM, key)
+  c.Assert(err, NotNil)
+  _, err = crypto.NewSuiteCipher("rot13", key)
+  c.Assert(err, NotNil)
+  _, err = crypto.NewSuiteKey("rot13")
   c.Assert(err, NotNil)
 }
 
-func (s *CryptoSuite) TestLoadCipher(c *C) {
-  nonce := make([]byte, 12)
-  cipher, err := crypto.LoadCipher(crypto.NewKey(), nonce)
-  c.Assert(cipher, NotNil)
+func (s *CryptoSuite) TestCombineKeyFile(c *C) {
+  key := crypto.NewKey()
+  keyFile := crypto.NewKeyFile()
+  c.Assert(keyFile, HasLen, 64)
+  combined := crypto.CombineKeyFile(key, keyFile)
+  c.Assert(combined, HasLen, len(key))
+  c.Assert(combined, DeepEquals, crypto.CombineKeyFile(key, keyFile))
+  c.Assert(combined, Not(DeepEquals), key)
+  c.Assert(combined, Not(DeepEquals), crypto.CombineKeyFile(key, crypto.NewKeyFile()))
+  c.Assert(combined, Not(DeepEquals), crypto.CombineKeyFile(crypto.NewKey(), keyFile))
+}
+
+func (s *CryptoSuite) TestRecoveryKey(c *C) {
+  key := crypto.NewRecoveryKey()
+  c.Assert(key, HasLen, crypto.RecoveryKeySize)
+  encoded := crypto.EncodeRecoveryKey(key)
+  words := strings.Fields(encoded)
+  c.Assert(words, HasLen, 18)
+  decoded, err := crypto.DecodeRecoveryKey(encoded)
+  c.Assert(err, IsNil)
+  c.Assert(decoded, DeepEquals, key)
+  decoded, err = crypto.DecodeRecoveryKey("  " + strings.ToUpper(strings.Join(words, "-")) + "\n")
   c.Assert(err, IsNil)
+  c.Assert(decoded, DeepEquals, key)
+  _, err = crypto.DecodeRecoveryKey(strings.Join(words[1:], " "))
+  c.Assert(err, NotNil)
+  _, err = crypto.DecodeRecoveryKey(strings.Join(append([]string { "xylophone" }, words[1:]...), " "))
+  c.Assert(err, NotNil)
+  swapped := append([]string { words[1], words[0] }, words[2:]...)
+  if words[0] != words[1] {
+    _, err = crypto.DecodeRecoveryKey(strings.Join(swapped, " "))
+    c.Assert(err, NotNil)
+  }
 }
 
-func (s *CryptoSuite) TestNewLoadCipher(c *C) {
-  key := crypto.NewKey()
-  newCipher, _ := crypto.NewCipher(key)
-  loadCipher, _ := crypto.LoadCipher(key, newCipher.GetNonce())
-  c.Assert(loadCipher, NotNil)
-  c.Assert(loadCipher.GetNonce(), DeepEquals, newCipher.GetNonce())
+func (s *CryptoSuite) TestShares(c *C) {
+  secret := crypto.NewKey()
+  shares, err := crypto.SplitSecret(secret, 3, 5)
+  c.Assert(err, IsNil)
+  c.Assert(shares, HasLen, 5)
+  for _, subset := range [][]int { { 0, 1, 2 }, { 4, 2, 0 }, { 1, 3, 4 }, { 0, 1, 2, 3, 4 } } {
+    given := []crypto.Share {}
+    for _, i := range subset {
+      given = append(given, shares[i])
+    }
+
+    combined, err := crypto.CombineShares(given)
+    c.Assert(err, IsNil)
+    c.Assert(combined, DeepEquals, secret)
+  }
+
+  _, err = crypto.CombineShares(shares[:2])
+  c.Assert(err, NotNil)
+  _, err = crypto.CombineShares([]crypto.Share { shares[0], shares[0], shares[1] })
+  c.Assert(err, NotNil)
+  others, _ := crypto.SplitSecret(secret, 3, 5)
+  if others[0].Set != shares[0].Set {
+    _, err = crypto.CombineShares([]crypto.Share { shares[0], shares[1], others[2] })
+    c.Assert(err, NotNil)
+  }
+
+  _, err = crypto.SplitSecret(secret, 1, 5)
+  c.Assert(err, NotNil)
+  _, err = crypto.SplitSecret(secret, 6, 5)
+  c.Assert(err, NotNil)
+
+  encoded := crypto.EncodeShare(shares[3])
+  decoded, err := crypto.DecodeShare(strings.ToUpper(strings.Replace(encoded, "-", " ", -1)))
+  c.Assert(err, IsNil)
+  c.Assert(decoded, DeepEquals, shares[3])
+  typo := []byte(encoded)
+  if typo[0] == 'a' {
+    typo[0] = 'b'
+  } else {
+    typo[0] = 'a'
+  }
+
+  _, err = crypto.DecodeShare(string(typo))
+  c.Assert(err, NotNil)
 }
 
-func (s *CryptoSuite) TestGetNonce(c *C) {
-  cipher, _ := crypto.NewCipher(crypto.NewKey())
-  nonce := cipher.GetNonce()
-  c.Assert(nonce, NotNil)
+func (s *CryptoSuite) TestNewCipherFail(c *C) {
+  cipher, err := crypto.NewCipher([]byte{})
+  c.Assert(cipher, IsNil)
+  c.Assert(err, NotNil)
+}
+
+func nonce(ciphertext []byte) []byte {
+  return ciphertext[len(ciphertext) - 12:]
 }
 
 func (s *CryptoSuite) TestEncrypt(c *C) {
   cipher, _ := crypto.NewCipher(crypto.NewKey())
-  nonce0 := cipher.GetNonce()
   plaintext := []byte { 1, 2, 3, 4, 5 }
   ciphertext1 := cipher.Encrypt(plaintext)
-  nonce1 := cipher.GetNonce()
   c.Assert(ciphertext1, NotNil)
   c.Assert(len(ciphertext1), Not(Equals), 0)
   c.Assert(ciphertext1, Not(DeepEquals), plaintext)
-  c.Assert(nonce0, Not(DeepEquals), nonce1)
   ciphertext2 := cipher.Encrypt(plaintext)
-  nonce2 := cipher.GetNonce()
   c.Assert(ciphertext2, Not(DeepEquals), plaintext)
   c.Assert(ciphertext2, Not(DeepEquals), ciphertext1)
-  c.Assert(nonce1, Not(DeepEquals), nonce2)
+  c.Assert(nonce(ciphertext1), Not(DeepEquals), nonce(ciphertext2))
+}
+
+func (s *CryptoSuite) TestNoncePrefix(c *C) {
+  key := crypto.NewKey()
+  first, _ := crypto.NewCipher(key)
+  second, _ := crypto.NewCipher(key)
+  nonces := make(map[string]bool)
+  for i := 0; i < 100; i++ {
+    for _, cipher := range []*crypto.Cipher { first, second } {
+      n := string(nonce(cipher.Encrypt([]byte { 1 })))
+      c.Assert(nonces[n], Equals, false)
+      nonces[n] = true
+    }
+  }
 }
 
 func (s *CryptoSuite) TestTryDecrypt(c *C) {
@@ -124,7 +257,7 @@ func (s *CryptoSuite) TestTryDecryptFail(c *C) {
   ciphertext := encipher.Encrypt(plaintext)
   newKey := crypto.NewKey()
   c.Assert(key, Not(DeepEquals), newKey)
-  decipher, _ := crypto.LoadCipher(newKey, encipher.GetNonce())
+  decipher, _ := crypto.NewCipher(newKey)
   plaintextVerify, err := decipher.TryDecrypt(ciphertext)
   c.Assert(err, NotNil)
   c.Assert(len(plaintextVerify), Equals, 0)
@@ -135,8 +268,106 @@ func (s *CryptoSuite) TestDecrypt(c *C) {
   encipher, _ := crypto.NewCipher(key)
   plaintext := []byte { 1, 2, 3, 4, 5 }
   ciphertext := encipher.Encrypt(plaintext)
-  decipher, _ := crypto.LoadCipher(key, encipher.GetNonce())
-  plaintextVerify := decipher.Decrypt(ciphertext)
+  decipher, _ := crypto.NewCipher(key)
+  plaintextVerify, err := decipher.Decrypt(ciphertext)
+  c.Assert(err, IsNil)
   c.Assert(plaintextVerify, NotNil)
   c.Assert(plaintextVerify, DeepEquals, plaintext)
 }
+
+func (s *CryptoSuite) TestDecryptCorrupt(c *C) {
+  cipher, _ := crypto.NewCipher(crypto.NewKey())
+  ciphertext := cipher.Encrypt([]byte { 1, 2, 3, 4, 5 })
+  ciphertext[0] ^= 1
+  plaintext, err := cipher.Decrypt(ciphertext)
+  c.Assert(err, FitsTypeOf, crypto.CorruptCiphertextError(""))
+  c.Assert(len(plaintext), Equals, 0)
+  plaintext, err = cipher.Decrypt([]byte { 1, 2, 3 })
+  c.Assert(err, FitsTypeOf, crypto.CorruptCiphertextError(""))
+  c.Assert(len(plaintext), Equals, 0)
+}
+
+func (s *CryptoSuite) TestDecryptWithData(c *C) {
+  cipher, _ := crypto.NewCipher(crypto.NewKey())
+  plaintext := []byte { 1, 2, 3, 4, 5 }
+  ciphertext := cipher.EncryptWithData(plaintext, []byte("login"))
+  plaintextVerify, err := cipher.DecryptWithData(ciphertext, []byte("login"))
+  c.Assert(err, IsNil)
+  c.Assert(plaintextVerify, DeepEquals, plaintext)
+  _, err = cipher.DecryptWithData(ciphertext, []byte("password"))
+  c.Assert(err, FitsTypeOf, crypto.CorruptCiphertextError(""))
+  _, err = cipher.Decrypt(ciphertext)
+  c.Assert(err, FitsTypeOf, crypto.CorruptCiphertextError(""))
+  plaintextVerify, err = cipher.DecryptWithData(cipher.Encrypt(plaintext), nil)
+  c.Assert(err, IsNil)
+  c.Assert(plaintextVerify, DeepEquals, plaintext)
+}
+
+func (s *CryptoSuite) TestDeriveKey(c *C) {
+  key := crypto.NewKey()
+  audit := crypto.DeriveKey(key, "audit")
+  c.Assert(len(audit), Equals, 32)
+  c.Assert(crypto.DeriveKey(key, "audit"), DeepEquals, audit)
+  c.Assert(crypto.DeriveKey(key, "index"), Not(DeepEquals), audit)
+  c.Assert(crypto.DeriveKey(crypto.NewKey(), "audit"), Not(DeepEquals), audit)
+}
+
+func (s *CryptoSuite) TestMAC(c *C) {
+  key := crypto.DeriveKey(crypto.NewKey(), "test")
+  mac := crypto.MAC(key, []byte { 1, 2 }, []byte { 3 })
+  c.Assert(len(mac), Equals, 32)
+  c.Assert(crypto.MAC(key, []byte { 1, 2, 3 }), DeepEquals, mac)
+  c.Assert(crypto.MAC(key, []byte { 1, 2, 4 }), Not(DeepEquals), mac)
+  c.Assert(crypto.MAC(crypto.NewKey(), []byte { 1, 2, 3 }), Not(DeepEquals), mac)
+}
+
+func (s *CryptoSuite) TestWeaknesses(c *C) {
+  c.Assert(crypto.PBKDF2Params(crypto.MinPBKDF2Iterations).Weaknesses(), IsNil)
+  c.Assert(crypto.PBKDF2Params(200000).Weaknesses(), HasLen, 1)
+  c.Assert(crypto.Argon2idParams(3, 64 * 1024, 4).Weaknesses(), IsNil)
+  c.Assert(crypto.Argon2idParams(1, 46 * 1024, 1).Weaknesses(), IsNil)
+  c.Assert(crypto.Argon2idParams(1, 19 * 1024, 1).Weaknesses(), HasLen, 1)
+  c.Assert(crypto.Argon2idParams(2, 19 * 1024, 1).Weaknesses(), IsNil)
+  c.Assert(crypto.Argon2idParams(10, 1024, 1).Weaknesses(), HasLen, 1)
+}
+
+// A benchmark where each Argon2id pass costs 10ns per KiB and each PBKDF2
+// iteration costs 1µs.
+func fakeBenchmark(kdf crypto.KDF) (time.Duration, error) {
+  if kdf.Name == crypto.KDFPBKDF2 {
+    return time.Duration(kdf.Time) * time.Microsecond, nil
+  }
+
+  return time.Duration(kdf.Time * kdf.Memory * 10), nil
+}
+
+func (s *CryptoSuite) TestCalibrate(c *C) {
+  defer crypto.SetBenchmark(crypto.SetBenchmark(fakeBenchmark))
+
+  kdf, err := crypto.Calibrate(crypto.PBKDF2Params(1), time.Second)
+  c.Assert(err, IsNil)
+  c.Assert(kdf, Equals, crypto.PBKDF2Params(1000000))
+  // One pass over 256 MiB takes 2.6ms, so three fit in 10ms.
+  kdf, err = crypto.Calibrate(crypto.Argon2idParams(1, 256 * 1024, 4), 10 * time.Millisecond)
+  c.Assert(err, IsNil)
+  c.Assert(kdf, Equals, crypto.Argon2idParams(3, 256 * 1024, 4))
+  // A single pass takes longer than the target, so memory is halved until
+  // one pass fits.
+  kdf, err = crypto.Calibrate(crypto.Argon2idParams(1, 256 * 1024, 4), time.Millisecond)
+  c.Assert(err, IsNil)
+  c.Assert(kdf, Equals, crypto.Argon2idParams(1, 64 * 1024, 4))
+  c.Assert(kdf.Weaknesses(), IsNil)
+  _, err = crypto.Calibrate(crypto.PBKDF2Params(1), 0)
+  c.Assert(err, NotNil)
+}
+
+func (s *CryptoSuite) TestCalibrateTooShort(c *C) {
+  defer crypto.SetBenchmark(crypto.SetBenchmark(fakeBenchmark))
+
+  // Memory is not reduced below the recommended minimum of 46 MiB for a
+  // single pass.
+  _, err := crypto.Calibrate(crypto.Argon2idParams(1, 256 * 1024, 4), 100 * time.Microsecond)
+  c.Assert(err, ErrorMatches, "Target unlock time 100µs is too short: one Argon2id pass over 64 MiB takes .*")
+  _, err = crypto.Calibrate(crypto.PBKDF2Params(1), 50 * time.Millisecond)
+  c.Assert(err, ErrorMatches, "Target unlock time 50ms is too short: PBKDF2 needs at least 210000 iterations.")
+}
@@ -0,0 +1,78 @@
+package crypto
+
+import (
+  "golang.org/x/crypto/sha3"
+  "crypto/rand"
+  "strings"
+  "errors"
+  "fmt"
+)
+
+// The size of a recovery key in bytes, and of the checksum appended to it
+// when it is encoded as words.
+const (
+  RecoveryKeySize = 16
+  recoveryChecksumSize = 2
+)
+
+// Generates a random recovery key. Unlike a password, it has enough entropy to
+// be used without a key derivation function.
+func NewRecoveryKey() []byte {
+  key := make([]byte, RecoveryKeySize)
+  count, err := rand.Read(key)
+
+  if (err != nil) || (count != len(key)) {
+    panic("Failed to generate recovery key.")
+  }
+
+  return key
+}
+
+func recoveryChecksum(key []byte) []byte {
+  digest := sha3.Sum256(key)
+  return digest[:recoveryChecksumSize]
+}
+
+// Encodes a recovery key as words, one per byte, followed by checksum words
+// that catch typos.
+func EncodeRecoveryKey(key []byte) string {
+  words := make([]string, 0, len(key) + recoveryChecksumSize)
+  for _, b := range append(append([]byte{}, key...), recoveryChecksum(key)...) {
+    words = append(words, recoveryWords[b])
+  }
+
+  return strings.Join(words, " ")
+}
+
+// Decodes a recovery key from its words. Case, spacing, and hyphens between
+// words are ignored.
+func DecodeRecoveryKey(encoded string) ([]byte, error) {
+  fields := strings.Fields(strings.ToLower(strings.Replace(encoded, "-", " ", -1)))
+  if len(fields) != RecoveryKeySize + recoveryChecksumSize {
+    return nil, errors.New(fmt.Sprintf("A recovery key has %d words.", RecoveryKeySize + recoveryChecksumSize))
+  }
+
+  decoded := make([]byte, len(fields))
+  for i, field := range fields {
+    index := -1
+    for j, word := range recoveryWords {
+      if word == field {
+        index = j
+        break
+      }
+    }
+
+    if index < 0 {
+      return nil, errors.New(fmt.Sprintf("Unknown word in recovery key: %s.", field))
+    }
+
+    decoded[i] = byte(index)
+  }
+
+  key := decoded[:RecoveryKeySize]
+  if string(decoded[RecoveryKeySize:]) != string(recoveryChecksum(key)) {
+    return nil, errors.New("Invalid recovery key. Check the words for typos.")
+  }
+
+  return key, nil
+}
@@ -0,0 +1,215 @@
+package crypto
+
+import (
+  "golang.org/x/crypto/sha3"
+  "encoding/base32"
+  "crypto/rand"
+  "strings"
+  "errors"
+  "fmt"
+)
+
+// One share of a secret split with Shamir's secret sharing. Any Threshold
+// shares with the same Set rebuild the secret; fewer reveal nothing about it.
+type Share struct {
+  Set uint16
+  Threshold int
+  Index int
+  Value []byte
+}
+
+const (
+  maxShares = 255
+  shareChecksumSize = 2
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Multiplies in GF(2^8) with the AES polynomial.
+func gfMul(a, b byte) byte {
+  var product byte
+  for b != 0 {
+    if b & 1 != 0 {
+      product ^= a
+    }
+
+    carry := a & 0x80
+    a <<= 1
+    if carry != 0 {
+      a ^= 0x1b
+    }
+
+    b >>= 1
+  }
+
+  return product
+}
+
+// Inverts a nonzero element of GF(2^8): a^254 = a^-1.
+func gfInv(a byte) byte {
+  result := byte(1)
+  for i := 0; i < 254; i++ {
+    result = gfMul(result, a)
+  }
+
+  return result
+}
+
+func randomBytes(size int) []byte {
+  bytes := make([]byte, size)
+  count, err := rand.Read(bytes)
+
+  if (err != nil) || (count != len(bytes)) {
+    panic("Failed to generate random bytes.")
+  }
+
+  return bytes
+}
+
+// Splits a secret into count shares, any threshold of which rebuild it.
+func SplitSecret(secret []byte, threshold int, count int) ([]Share, error) {
+  if count < 2 || count > maxShares {
+    return nil, errors.New(fmt.Sprintf("The number of shares must be between 2 and %d.", maxShares))
+  }
+
+  if threshold < 2 || threshold > count {
+    return nil, errors.New("The threshold must be at least 2 and at most the number of shares.")
+  }
+
+  if len(secret) == 0 {
+    return nil, errors.New("Cannot split an empty secret.")
+  }
+
+  setBytes := randomBytes(2)
+  set := uint16(setBytes[0]) << 8 | uint16(setBytes[1])
+
+  shares := make([]Share, count)
+  for i := range shares {
+    shares[i] = Share {
+      Set: set,
+      Threshold: threshold,
+      Index: i + 1,
+      Value: make([]byte, len(secret)),
+    }
+  }
+
+  // Each byte of the secret is the constant term of a random polynomial of
+  // degree threshold - 1, and share i holds its value at x = i.
+  coefficients := make([]byte, threshold)
+  for b, s := range secret {
+    coefficients[0] = s
+    copy(coefficients[1:], randomBytes(threshold - 1))
+
+    for i := range shares {
+      x := byte(shares[i].Index)
+      var y byte
+      for c := len(coefficients) - 1; c >= 0; c-- {
+        y = gfMul(y, x) ^ coefficients[c]
+      }
+
+      shares[i].Value[b] = y
+    }
+  }
+
+  return shares, nil
+}
+
+// Rebuilds a secret from at least the threshold number of its shares.
+func CombineShares(shares []Share) ([]byte, error) {
+  if len(shares) == 0 {
+    return nil, errors.New("No shares given.")
+  }
+
+  first := shares[0]
+  if len(shares) < first.Threshold {
+    return nil, errors.New(fmt.Sprintf("%d of %d required shares given.", len(shares), first.Threshold))
+  }
+
+  shares = shares[:first.Threshold]
+  for i, share := range shares {
+    if share.Set != first.Set || share.Threshold != first.Threshold || len(share.Value) != len(first.Value) {
+      return nil, errors.New("The shares were not created together.")
+    }
+
+    if share.Index < 1 || share.Index > maxShares {
+      return nil, errors.New(fmt.Sprintf("Invalid share number: %d.", share.Index))
+    }
+
+    for _, other := range shares[:i] {
+      if other.Index == share.Index {
+        return nil, errors.New(fmt.Sprintf("Share %d was given twice.", share.Index))
+      }
+    }
+  }
+
+  // Lagrange interpolation at x = 0. Addition and subtraction are both XOR.
+  secret := make([]byte, len(first.Value))
+  for i, share := range shares {
+    xi := byte(share.Index)
+    basis := byte(1)
+    for j, other := range shares {
+      if i == j {
+        continue
+      }
+
+      xj := byte(other.Index)
+      basis = gfMul(basis, gfMul(xj, gfInv(xj ^ xi)))
+    }
+
+    for b := range secret {
+      secret[b] ^= gfMul(share.Value[b], basis)
+    }
+  }
+
+  return secret, nil
+}
+
+func shareChecksum(data []byte) []byte {
+  digest := sha3.Sum256(data)
+  return digest[:shareChecksumSize]
+}
+
+// Encodes a share as text: its set, threshold, number, and value, followed by
+// a checksum that catches typos, in groups of five base32 characters.
+func EncodeShare(share Share) string {
+  data := []byte { byte(share.Set >> 8), byte(share.Set), byte(share.Threshold), byte(share.Index) }
+  data = append(data, share.Value...)
+  data = append(data, shareChecksum(data)...)
+
+  encoded := strings.ToLower(shareEncoding.EncodeToString(data))
+  groups := make([]string, 0, len(encoded) / 5 + 1)
+  for len(encoded) > 5 {
+    groups = append(groups, encoded[:5])
+    encoded = encoded[5:]
+  }
+
+  return strings.Join(append(groups, encoded), "-")
+}
+
+// Decodes a share from its text. Case, spacing, and hyphens are ignored.
+func DecodeShare(encoded string) (Share, error) {
+  cleaned := strings.ToUpper(strings.Join(strings.Fields(strings.Replace(encoded, "-", " ", -1)), ""))
+
+  data, err := shareEncoding.DecodeString(cleaned)
+  if err != nil || len(data) <= 4 + shareChecksumSize {
+    return Share{}, errors.New("Invalid share.")
+  }
+
+  body := data[:len(data) - shareChecksumSize]
+  if string(data[len(body):]) != string(shareChecksum(body)) {
+    return Share{}, errors.New("Invalid share. Check it for typos.")
+  }
+
+  share := Share {
+    Set: uint16(body[0]) << 8 | uint16(body[1]),
+    Threshold: int(body[2]),
+    Index: int(body[3]),
+    Value: body[4:],
+  }
+
+  if share.Threshold < 2 || share.Index < 1 {
+    return Share{}, errors.New("Invalid share.")
+  }
+
+  return share, nil
+}
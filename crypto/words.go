@@ -0,0 +1,41 @@
+package crypto
+
+// Words that encode recovery keys, one per byte. The words are short, common,
+// and distinct, so a key can be written down and typed back reliably.
+var recoveryWords = [256]string {
+  "acid", "acorn", "actor", "adobe", "aerial", "agent", "alarm", "album",
+  "alert", "alley", "almond", "alpha", "amber", "anchor", "angle", "ankle",
+  "apple", "apron", "arch", "arena", "armor", "arrow", "ascot", "aspen",
+  "atlas", "atom", "attic", "audio", "august", "autumn", "award", "axis",
+  "bacon", "badge", "bagel", "baker", "bamboo", "banjo", "barley", "barn",
+  "basil", "basin", "beacon", "beaver", "bench", "berry", "binder", "birch",
+  "biscuit", "bison", "blanket", "blossom", "boat", "bonnet", "border",
+  "bottle", "boulder", "bracket", "branch", "bread", "brick", "bridge",
+  "bronze", "brook", "bubble", "bucket", "buffalo", "bugle", "bundle",
+  "burrow", "butter", "button", "cabin", "cactus", "camel", "candle", "canoe",
+  "canyon", "captain", "carbon", "cargo", "carpet", "carrot", "castle",
+  "cedar", "celery", "cellar", "chalk", "channel", "cherry", "chess",
+  "chimney", "circus", "citrus", "clover", "cobalt", "cocoa", "comet",
+  "compass", "copper", "coral", "cotton", "cougar", "cradle", "crane",
+  "crater", "crystal", "cushion", "dagger", "daisy", "dancer", "delta",
+  "denim", "desert", "diamond", "dinner", "dolphin", "domino", "donkey",
+  "dragon", "drum", "eagle", "easel", "echo", "eclipse", "elbow", "elder",
+  "ember", "engine", "falcon", "feather", "fender", "fiddle", "fig", "flannel",
+  "flute", "forest", "fossil", "fountain", "fox", "galaxy", "garden", "garlic",
+  "gazebo", "geyser", "ginger", "giraffe", "glacier", "globe", "goblet",
+  "gopher", "granite", "gravel", "guitar", "hammer", "harbor", "harvest",
+  "hazel", "helmet", "heron", "hickory", "honey", "hornet", "husky", "igloo",
+  "indigo", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly",
+  "jersey", "jigsaw", "jungle", "kayak", "kernel", "kettle", "kitten", "koala",
+  "ladder", "lagoon", "lantern", "laser", "lemon", "lentil", "lily", "linen",
+  "lizard", "lobster", "locket", "lotus", "lumber", "magnet", "mango", "maple",
+  "marble", "meadow", "melon", "meteor", "mitten", "monsoon", "mosaic",
+  "muffin", "mustard", "napkin", "nectar", "needle", "nickel", "noodle",
+  "nutmeg", "oasis", "oatmeal", "ocean", "olive", "onion", "orchid", "otter",
+  "oyster", "paddle", "palace", "pancake", "panda", "panther", "parrot",
+  "pebble", "pepper", "piano", "pickle", "pigeon", "pillow", "planet", "plum",
+  "pocket", "pony", "poppy", "potato", "prairie", "pretzel", "pumpkin",
+  "puzzle", "quartz", "quill", "rabbit", "radish", "raven", "ribbon", "river",
+  "robin", "rocket", "saddle", "salmon", "sandal", "satin", "scarf",
+  "seashell",
+}
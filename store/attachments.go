@@ -0,0 +1,165 @@
+package store
+
+import (
+  "path/filepath"
+  "strings"
+  "errors"
+  "time"
+  "fmt"
+)
+
+// Attachments are stored in the database, so they are limited in size.
+const MaxAttachmentSize = 10 * 1024 * 1024
+
+// A file stored with a credential, e.g. an SSH key or recovery codes.
+type Attachment struct {
+  id int
+  Name string `json:"name"`
+  Data []byte `json:"data"`
+}
+
+// Attachment names are used as file names when extracting, and can come from
+// imported or merged files, so they must not be paths.
+func validateAttachment(attachment *Attachment) error {
+  name := attachment.Name
+  if name == "" || name == "." || filepath.IsAbs(name) || strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") {
+    return errors.New(fmt.Sprintf("Invalid attachment name: %q.", name))
+  }
+
+  if len(attachment.Data) > MaxAttachmentSize {
+    return errors.New(fmt.Sprintf("Attachment is too large (maximum %d bytes).", MaxAttachmentSize))
+  }
+
+  return nil
+}
+
+func (store *Store) insertAttachment(tx Tx, credentialID int, uuid string, attachment *Attachment) error {
+  id, err := tx.Insert("attachments", Row {
+    "credential_id": credentialID,
+    "name": store.sealString("attachments", "name", uuid, attachment.Name),
+    "data": store.seal("attachments", "data", uuid, attachment.Data),
+  })
+
+  if err != nil {
+    return err
+  }
+
+  attachment.id = id
+  return nil
+}
+
+// Sets a credential's modified time to now, e.g. when its attachments change,
+// so that merges pick up the change.
+func (store *Store) touchModified(tx Tx, id int) (time.Time, error) {
+  row, err := store.credentialRow(tx, id)
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  modified := now()
+  _, err = tx.Update("credentials", Row { "id": id, "vault": store.vault }, Row {
+    "modified": store.encryptTime("credentials", "modified", row.String("uuid"), modified),
+  })
+
+  return modified, err
+}
+
+// Stores a file with a credential, which counts as modifying it.
+func (store *Store) AddAttachment(credential *Credential, attachment *Attachment) error {
+  if credential.id == 0 {
+    panic("Invalid credential ID.")
+  }
+
+  if err := validateAttachment(attachment); err != nil {
+    return err
+  }
+
+  return store.update(func(tx Tx) error {
+    uuid, err := store.credentialUUID(tx, credential)
+    if err != nil {
+      return err
+    }
+
+    if err = store.insertAttachment(tx, credential.id, uuid, attachment); err != nil {
+      return err
+    }
+
+    if credential.Modified, err = store.touchModified(tx, credential.id); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionAttach, credential)
+  })
+}
+
+// Returns the files stored with a credential, in the order they were added.
+func (store *Store) Attachments(credential *Credential) ([]*Attachment, error) {
+  if credential.id == 0 {
+    panic("Invalid credential ID.")
+  }
+
+  attachments, err := store.attachments(store.db, credential)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  return attachments, nil
+}
+
+func (store *Store) attachments(q Reader, credential *Credential) ([]*Attachment, error) {
+  uuid, err := store.credentialUUID(q, credential)
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := q.Select("attachments", Row { "credential_id": credential.id })
+  if err != nil {
+    return nil, err
+  }
+
+  attachments := make([]*Attachment, 0, len(rows))
+
+  for _, row := range rows {
+    attachment := &Attachment { id: row.Int("id") }
+
+    if attachment.Name, err = store.decrypt(credential.id, "attachments", "name", uuid, row.Bytes("name")); err != nil {
+      return nil, err
+    }
+
+    if attachment.Data, err = store.open("attachments", "data", uuid, row.Bytes("data")); err != nil {
+      return nil, CorruptCredentialError { ID: credential.id, Err: err }
+    }
+
+    attachments = append(attachments, attachment)
+  }
+
+  return attachments, nil
+}
+
+// Removes a file stored with a credential, which counts as modifying it.
+func (store *Store) DeleteAttachment(attachment *Attachment) error {
+  if attachment.id == 0 {
+    panic("Invalid attachment ID.")
+  }
+
+  return store.update(func(tx Tx) error {
+    rows, err := tx.Select("attachments", Row { "id": attachment.id })
+    if err != nil {
+      return err
+    }
+
+    if err = checkAffected(len(rows), attachment.id); err != nil {
+      return err
+    }
+
+    if _, err = tx.Delete("attachments", Row { "id": attachment.id }); err != nil {
+      return err
+    }
+
+    if _, err = store.touchModified(tx, rows[0].Int("credential_id")); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionDetach, nil)
+  })
+}
@@ -0,0 +1,223 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "encoding/binary"
+  "encoding/json"
+  "crypto/hmac"
+  "os/user"
+  "sort"
+  "fmt"
+  "time"
+  "os"
+)
+
+// Actions recorded in the audit log.
+const (
+  ActionAdd = "add"
+  ActionEdit = "edit"
+  ActionAccess = "access"
+  ActionDelete = "delete"
+  ActionRestore = "restore"
+  ActionPurge = "purge"
+  ActionAttach = "attach"
+  ActionDetach = "detach"
+  ActionExport = "export"
+  ActionMaster = "master"
+  ActionVault = "vault"
+  ActionMerge = "merge"
+  ActionRekey = "rekey"
+  ActionSlot = "slot"
+)
+
+// An audit log entry records who performed an action on the database and when.
+type AuditEntry struct {
+  Time time.Time `json:"time"`
+  User string `json:"user"`
+  Host string `json:"host"`
+  Action string `json:"action"`
+  Credential string `json:"credential,omitempty"`
+}
+
+// The audit log failed verification: an entry was modified, removed, or
+// reordered.
+type AuditLogError struct {
+  Index int
+  Reason string
+}
+
+func (e AuditLogError) Error() string {
+  return fmt.Sprintf("Audit log verification failed at entry %d: %s", e.Index, e.Reason)
+}
+
+// The audit log is a chain of MACs: each entry's MAC covers the previous MAC,
+// the entry's sequence number, and its ciphertext. The MAC of the latest entry
+// and the entry count are stored encrypted in settings so that truncating the
+// log is also detected.
+func (store *Store) auditKey() []byte {
+  return crypto.DeriveKey(store.key, "ward audit log")
+}
+
+func auditMAC(key, previous []byte, sequence uint64, ciphertext []byte) []byte {
+  sequenceBytes := make([]byte, 8)
+  binary.BigEndian.PutUint64(sequenceBytes, sequence)
+  return crypto.MAC(key, previous, sequenceBytes, ciphertext)
+}
+
+func (store *Store) readAuditHead(q Reader) (uint64, []byte, error) {
+  settings, err := store.settings(q)
+  if err != nil {
+    return 0, nil, err
+  }
+
+  cipherHead := settings.Bytes("audit_head")
+  if cipherHead == nil {
+    return 0, nil, nil
+  }
+
+  head, err := store.keyCipher.Decrypt(cipherHead)
+  if err != nil || len(head) < 8 {
+    return 0, nil, AuditLogError { Index: 0, Reason: "invalid log head" }
+  }
+
+  return binary.BigEndian.Uint64(head[:8]), head[8:], nil
+}
+
+func currentUser() string {
+  if current, err := user.Current(); err == nil {
+    return current.Username
+  }
+
+  return os.Getenv("USER")
+}
+
+func auditName(credential *Credential) string {
+  if credential == nil {
+    return ""
+  }
+
+  if credential.Login != "" && credential.Realm != "" {
+    return credential.Login + "@" + credential.Realm
+  }
+
+  return credential.Login + credential.Realm
+}
+
+// Returns the audit log rows of this vault in sequence order.
+func (store *Store) auditRows(q Reader) ([]Row, error) {
+  rows, err := q.Select("audit", Row { "vault": store.vault })
+  if err != nil {
+    return nil, err
+  }
+
+  sort.SliceStable(rows, func(i, j int) bool {
+    return rows[i].Int("sequence") < rows[j].Int("sequence")
+  })
+
+  return rows, nil
+}
+
+// Appends an entry to the audit log as part of the given transaction.
+func (store *Store) audit(tx Tx, action string, credential *Credential) error {
+  count, previous, err := store.readAuditHead(tx)
+  if err != nil {
+    return err
+  }
+
+  host, _ := os.Hostname()
+
+  entry, err := json.Marshal(&AuditEntry {
+    Time: time.Now().UTC(),
+    User: currentUser(),
+    Host: host,
+    Action: action,
+    Credential: auditName(credential),
+  })
+
+  if err != nil {
+    return err
+  }
+
+  ciphertext := store.keyCipher.Encrypt(entry)
+  mac := auditMAC(store.auditKey(), previous, count, ciphertext)
+
+  _, err = tx.Insert("audit", Row {
+    "vault": store.vault,
+    "sequence": int64(count),
+    "entry": ciphertext,
+    "mac": mac,
+  })
+
+  if err != nil {
+    return err
+  }
+
+  head := make([]byte, 8)
+  binary.BigEndian.PutUint64(head, count + 1)
+  head = append(head, mac...)
+
+  return store.updateSettings(tx, Row { "audit_head": store.keyCipher.Encrypt(head) })
+}
+
+// Records an action that does not otherwise modify the database, e.g. export.
+func (store *Store) Audit(action string, credential *Credential) error {
+  return store.update(func(tx Tx) error {
+    return store.audit(tx, action, credential)
+  })
+}
+
+// Returns the audit log, oldest entry first. If the log fails verification,
+// the entries before the failure are returned along with an AuditLogError.
+func (store *Store) AuditLog() ([]*AuditEntry, error) {
+  return store.auditLog(store.db)
+}
+
+func (store *Store) auditLog(q Reader) ([]*AuditEntry, error) {
+  count, head, err := store.readAuditHead(q)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  rows, err := store.auditRows(q)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  key := store.auditKey()
+  entries := make([]*AuditEntry, 0)
+  var previous []byte
+  var index uint64
+
+  for ; index < uint64(len(rows)); index++ {
+    row := rows[index]
+    sequence := row.Int("sequence")
+    ciphertext, mac := row.Bytes("entry"), row.Bytes("mac")
+
+    if uint64(sequence) != index {
+      return entries, AuditLogError { Index: int(index), Reason: "entry missing" }
+    }
+
+    if !hmac.Equal(mac, auditMAC(key, previous, index, ciphertext)) {
+      return entries, AuditLogError { Index: int(index), Reason: "entry modified" }
+    }
+
+    plaintext, err := store.keyCipher.Decrypt(ciphertext)
+    if err != nil {
+      return entries, AuditLogError { Index: int(index), Reason: "entry corrupt" }
+    }
+
+    entry := &AuditEntry {}
+    if err = json.Unmarshal(plaintext, entry); err != nil {
+      return entries, AuditLogError { Index: int(index), Reason: "entry corrupt" }
+    }
+
+    entries = append(entries, entry)
+    previous = mac
+  }
+
+  if index != count || !hmac.Equal(previous, head) {
+    return entries, AuditLogError { Index: int(index), Reason: "entries missing from end of log" }
+  }
+
+  return entries, nil
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+  "bytes"
+  "os"
+)
+
+// A row of a table, by column name. Values are []byte, int64, string, or nil
+// for NULL. Missing columns read as NULL.
+type Row map[string]interface {}
+
+// Reads rows from a backend.
+type Reader interface {
+  // Returns the rows of a table whose columns equal every value in where, in
+  // the order they were inserted. A nil value in where matches NULL.
+  Select(table string, where Row) ([]Row, error)
+}
+
+// Persists the encrypted tables of a credential database. Values are
+// encrypted by Store before they reach the backend, so backends only ever see
+// ciphertext, salts, and nonces.
+type Backend interface {
+  Reader
+  Begin() (Tx, error)
+  Close() error
+}
+
+// A set of changes to a backend that are applied atomically on Commit.
+type Tx interface {
+  Reader
+
+  // Adds a row. If the row has no id, a new unique id is assigned and
+  // returned.
+  Insert(table string, row Row) (int, error)
+
+  // Sets columns on the rows matching where. Returns the number of rows
+  // changed.
+  Update(table string, where Row, values Row) (int, error)
+
+  // Removes the rows matching where. Returns the number of rows removed.
+  Delete(table string, where Row) (int, error)
+
+  // Applies a SQL schema change. Backends without SQL ignore it, and enforce
+  // the constraints of the latest schema themselves.
+  ExecSchema(schema string) error
+
+  Commit() error
+  Rollback() error
+}
+
+// The on-disk format of a credential database, identified by its header.
+type Format int
+
+const (
+  FormatSQLite Format = iota
+  FormatFile
+)
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// Returns the format of a database file from its header. Files that are not
+// in Ward's own format are treated as SQLite.
+func detectFormat(fileName string) (Format, error) {
+  file, err := os.Open(fileName)
+  if err != nil {
+    return FormatSQLite, err
+  }
+
+  defer file.Close()
+
+  header := make([]byte, len(fileHeader))
+  count, _ := file.Read(header)
+
+  if bytes.Equal(header[:count], fileHeader) {
+    return FormatFile, nil
+  }
+
+  return FormatSQLite, nil
+}
+
+func openBackend(fileName string) (Backend, error) {
+  format, err := detectFormat(fileName)
+  if err != nil {
+    return nil, err
+  }
+
+  if format == FormatFile {
+    return openFileBackend(fileName)
+  }
+
+  return openSQLiteBackend(fileName)
+}
+
+func createBackend(fileName string, format Format) (Backend, error) {
+  if format == FormatFile {
+    return createFileBackend(fileName)
+  }
+
+  return openSQLiteBackend(fileName)
+}
+
+func (row Row) Bytes(column string) []byte {
+  switch value := row[column].(type) {
+  case []byte:
+    return value
+  case string:
+    return []byte(value)
+  }
+
+  return nil
+}
+
+func (row Row) String(column string) string {
+  switch value := row[column].(type) {
+  case []byte:
+    return string(value)
+  case string:
+    return value
+  }
+
+  return ""
+}
+
+func (row Row) Int(column string) int {
+  if value, ok := row[column].(int64); ok {
+    return int(value)
+  }
+
+  return 0
+}
+
+func (row Row) Bool(column string) bool {
+  return row.Int(column) != 0
+}
+
+func (row Row) IsNull(column string) bool {
+  return row[column] == nil
+}
+
+// Converts a value to one of the types stored in a Row.
+func normalizeValue(value interface {}) interface {} {
+  switch v := value.(type) {
+  case int:
+    return int64(v)
+  case bool:
+    if v {
+      return int64(1)
+    }
+    return int64(0)
+  case []byte:
+    if v == nil {
+      return nil
+    }
+  }
+
+  return value
+}
+
+func normalizeRow(row Row) Row {
+  normalized := make(Row, len(row))
+  for column, value := range row {
+    normalized[column] = normalizeValue(value)
+  }
+
+  return normalized
+}
+
+// Returns whether every column in where equals the row's value.
+func (row Row) matches(where Row) bool {
+  for column, value := range where {
+    value = normalizeValue(value)
+    actual := row[column]
+
+    if value == nil || actual == nil {
+      if value != actual {
+        return false
+      }
+
+      continue
+    }
+
+    expected, isBytes := value.([]byte)
+    if isBytes {
+      if actualBytes, ok := actual.([]byte); !ok || !bytes.Equal(actualBytes, expected) {
+        return false
+      }
+
+      continue
+    }
+
+    if value != actual {
+      return false
+    }
+  }
+
+  return true
+}
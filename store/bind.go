@@ -0,0 +1,263 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "encoding/binary"
+  "crypto/hmac"
+  "strconv"
+  "errors"
+  "time"
+  "fmt"
+)
+
+// Each encrypted value is authenticated together with its table, its column,
+// and its owner: the UUID of the credential it belongs to, or the vault for
+// tags. A value copied into another column or row fails to decrypt instead of
+// silently changing the credential.
+func associatedData(table, column, owner string) []byte {
+  return []byte(table + "." + column + " " + owner)
+}
+
+// The owner of values shared by the vault's credentials, i.e. tag names.
+func (store *Store) vaultOwner() string {
+  return fmt.Sprintf("vault %d", store.vault)
+}
+
+func sealWith(cipher *crypto.Cipher, bound bool, table, column, owner string, plaintext []byte) []byte {
+  if !bound {
+    return cipher.Encrypt(plaintext)
+  }
+
+  return cipher.EncryptWithData(plaintext, associatedData(table, column, owner))
+}
+
+func openWith(cipher *crypto.Cipher, bound bool, table, column, owner string, ciphertext []byte) ([]byte, error) {
+  if !bound {
+    return cipher.Decrypt(ciphertext)
+  }
+
+  return cipher.DecryptWithData(ciphertext, associatedData(table, column, owner))
+}
+
+// Encrypts a value stored in the given table and column.
+func (store *Store) seal(table, column, owner string, plaintext []byte) []byte {
+  return sealWith(store.keyCipher, store.bound, table, column, owner, plaintext)
+}
+
+func (store *Store) sealString(table, column, owner, plaintext string) []byte {
+  return store.seal(table, column, owner, []byte(plaintext))
+}
+
+// Decrypts a value read from the given table and column.
+func (store *Store) open(table, column, owner string, ciphertext []byte) ([]byte, error) {
+  return openWith(store.keyCipher, store.bound, table, column, owner, ciphertext)
+}
+
+// Decrypts a value belonging to a credential. Failures are reported as
+// CorruptCredentialError.
+func (store *Store) decrypt(id int, table, column, owner string, ciphertext []byte) (string, error) {
+  plaintext, err := store.open(table, column, owner, ciphertext)
+  if err != nil {
+    return "", CorruptCredentialError { ID: id, Err: err }
+  }
+
+  return string(plaintext), nil
+}
+
+func (store *Store) encryptTime(table, column, owner string, t time.Time) []byte {
+  if t.IsZero() {
+    return nil
+  }
+
+  return store.sealString(table, column, owner, t.UTC().Format(time.RFC3339))
+}
+
+// Credentials created before timestamps were tracked have NULL timestamps,
+// which are returned as the zero time.
+func (store *Store) decryptTime(id int, table, column, owner string, ciphertext []byte) (time.Time, error) {
+  if ciphertext == nil {
+    return time.Time{}, nil
+  }
+
+  plaintext, err := store.decrypt(id, table, column, owner, ciphertext)
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  t, err := time.Parse(time.RFC3339, plaintext)
+  if err != nil {
+    return time.Time{}, CorruptCredentialError { ID: id, Err: err }
+  }
+
+  return t, nil
+}
+
+// The settings of a vault are authenticated with a MAC keyed by its data key,
+// so changes such as disabling the blind index or rolling back the audit log
+// head are detected. The MAC also covers the vault's key slots, so a revoked
+// slot cannot be restored from an old copy of the database. The version is
+// shared by all vaults and is not covered; changing it makes the database
+// fail to open.
+func settingsMAC(key []byte, settings Row, slots []Row) []byte {
+  values := [][]byte {
+    []byte(strconv.Itoa(settings.Int("vault"))),
+    []byte(settings.String("name")),
+    settings.Bytes("password_salt"),
+    []byte(strconv.Itoa(settings.Int("password_stretch"))),
+    settings.Bytes("encrypted_key"),
+    settings.Bytes("audit_head"),
+    []byte(strconv.FormatBool(settings.Bool("blind_index"))),
+    []byte(strconv.FormatBool(settings.Bool("associated_data"))),
+  }
+
+  // Columns added after settings were first authenticated are only covered
+  // when they differ from their defaults, so existing MACs stay valid.
+  if kdf := rowKDF(settings); kdf.Name != crypto.KDFPBKDF2 {
+    values = append(values, []byte(kdf.Name), []byte(strconv.Itoa(kdf.Memory)), []byte(strconv.Itoa(kdf.Threads)))
+  }
+
+  if suite := settingsSuite(settings); suite != crypto.SuiteAES128GCM {
+    values = append(values, []byte(suite))
+  }
+
+  if settings.Bool("key_file") {
+    values = append(values, []byte("key file"))
+  }
+
+  if settings.Bool("key_slots") {
+    values = append(values, []byte("key slots"))
+  }
+
+  for _, slot := range slots {
+    kdf := rowKDF(slot)
+    values = append(values,
+      []byte(strconv.Itoa(slot.Int("id"))),
+      []byte(slot.String("label")),
+      slot.Bytes("password_salt"),
+      []byte(kdf.Name),
+      []byte(strconv.Itoa(kdf.Time)),
+      []byte(strconv.Itoa(kdf.Memory)),
+      []byte(strconv.Itoa(kdf.Threads)),
+      []byte(strconv.FormatBool(slot.Bool("key_file"))),
+      slot.Bytes("encrypted_key"))
+  }
+
+  data := make([][]byte, 0, 2 * len(values))
+  for _, value := range values {
+    length := make([]byte, 8)
+    binary.BigEndian.PutUint64(length, uint64(len(value)))
+    data = append(data, length, value)
+  }
+
+  return crypto.MAC(crypto.DeriveKey(key, "ward settings"), data...)
+}
+
+// Returns the key slots covered by the settings MAC of a vault. Vaults
+// upgraded from databases without key slots are covered once they are opened.
+func macSlots(q Reader, settings Row) ([]Row, error) {
+  if !settings.Bool("key_slots") {
+    return nil, nil
+  }
+
+  return selectSlots(q, settings.Int("vault"))
+}
+
+func (store *Store) verifySettings(q Reader, settings Row) error {
+  if !store.bound {
+    return nil
+  }
+
+  slots, err := macSlots(q, settings)
+  if err != nil {
+    return err
+  }
+
+  if !hmac.Equal(settings.Bytes("settings_mac"), settingsMAC(store.key, settings, slots)) {
+    return CorruptDatabaseError { Err: errors.New("vault settings were modified") }
+  }
+
+  return nil
+}
+
+// Changes the settings of this vault and updates their MAC.
+func (store *Store) updateSettings(tx Tx, values Row) error {
+  if _, err := tx.Update("settings", store.settingsWhere(), values); err != nil {
+    return err
+  }
+
+  return store.resignSettings(tx)
+}
+
+// Updates the MAC of this vault's settings after its key slots changed.
+func (store *Store) resignSettings(tx Tx) error {
+  if !store.bound {
+    return nil
+  }
+
+  return signSettings(tx, store.key, store.settingsWhere())
+}
+
+// Updates the MAC of the settings that match where.
+func signSettings(tx Tx, key []byte, where Row) error {
+  rows, err := tx.Select("settings", where)
+  if err != nil {
+    return err
+  }
+
+  if len(rows) == 0 {
+    return errors.New("Invalid settings.")
+  }
+
+  slots, err := macSlots(tx, rows[0])
+  if err != nil {
+    return err
+  }
+
+  _, err = tx.Update("settings", where, Row { "settings_mac": settingsMAC(key, rows[0], slots) })
+  return err
+}
+
+// Converts a vault from a database created before values were bound to where
+// they are stored: every value is re-encrypted with associated data and the
+// settings are authenticated.
+func (store *Store) bind() error {
+  if store.bound || !store.vaults {
+    return nil
+  }
+
+  version, err := readVersion(store.db)
+  if err != nil {
+    return dbError(err)
+  }
+
+  if version < associatedDataVersion {
+    return nil
+  }
+
+  err = store.update(func(tx Tx) error {
+    // Another process may have converted the vault while we waited.
+    settings, err := store.settingsRow(tx)
+    if err != nil {
+      return err
+    }
+
+    if settings.Bool("associated_data") {
+      store.bound = true
+      return store.verifySettings(tx, settings)
+    }
+
+    store.bound = true
+
+    if _, err = store.reencrypt(tx, store.keyCipher, false); err != nil {
+      return err
+    }
+
+    return store.updateSettings(tx, Row { "associated_data": true })
+  })
+
+  if err != nil {
+    store.bound = false
+  }
+
+  return err
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+  "database/sql"
+  "fmt"
+  "os"
+)
+
+// A credential was not found, e.g. because it was deleted by another process.
+type NotFoundError struct {
+  ID int
+}
+
+func (e NotFoundError) Error() string {
+  return "Credential not found."
+}
+
+// The database does not contain a vault with the given name.
+type VaultNotFoundError struct {
+  Name string
+}
+
+func (e VaultNotFoundError) Error() string {
+  return fmt.Sprintf("Vault \"%s\" does not exist.", e.Name)
+}
+
+// The vault requires a key file in addition to its master password.
+type KeyFileRequiredError struct {
+  Vault string
+}
+
+func (e KeyFileRequiredError) Error() string {
+  return fmt.Sprintf("Vault \"%s\" requires a key file.", e.Vault)
+}
+
+// The vault does not have a key slot with the given label or id.
+type KeySlotNotFoundError struct {
+  Slot string
+}
+
+func (e KeySlotNotFoundError) Error() string {
+  return fmt.Sprintf("Key slot \"%s\" does not exist.", e.Slot)
+}
+
+// Another process is writing to the database and did not release its lock in
+// time.
+type LockedError struct {
+  PID int
+  Host string
+}
+
+func (e LockedError) Error() string {
+  return fmt.Sprintf("Database is locked by process %d on %s.", e.PID, e.Host)
+}
+
+// A stored value could not be decrypted or failed authentication.
+type CorruptCredentialError struct {
+  ID int
+  Err error
+}
+
+func (e CorruptCredentialError) Error() string {
+  return fmt.Sprintf("Credential %d is corrupt: %s", e.ID, e.Err)
+}
+
+func (e CorruptCredentialError) Unwrap() error {
+  return e.Err
+}
+
+// A credential with the given UUID already exists in the vault.
+type DuplicateCredentialError struct {
+  UUID string
+}
+
+func (e DuplicateCredentialError) Error() string {
+  return fmt.Sprintf("Credential %s already exists.", e.UUID)
+}
+
+// The database rejected a change because it violates a constraint.
+type ConstraintError struct {
+  Err error
+}
+
+func (e ConstraintError) Error() string {
+  return fmt.Sprintf("Database constraint violated: %s", e.Err)
+}
+
+func (e ConstraintError) Unwrap() error {
+  return e.Err
+}
+
+// The database file is damaged or is not a credential database.
+type CorruptDatabaseError struct {
+  Err error
+}
+
+func (e CorruptDatabaseError) Error() string {
+  return fmt.Sprintf("Credential database is corrupt: %s", e.Err)
+}
+
+func (e CorruptDatabaseError) Unwrap() error {
+  return e.Err
+}
+
+// The database could not be read or written.
+type IOError struct {
+  Err error
+}
+
+func (e IOError) Error() string {
+  return fmt.Sprintf("Database error: %s", e.Err)
+}
+
+func (e IOError) Unwrap() error {
+  return e.Err
+}
+
+// Classifies errors from database/sql and the backends. Other errors, e.g.
+// from crypto, are returned unchanged.
+func dbError(err error) error {
+  if classified, ok := sqliteError(err); ok {
+    return classified
+  }
+
+  if _, ok := err.(*os.PathError); ok {
+    return IOError { Err: err }
+  }
+
+  if err == sql.ErrConnDone || err == sql.ErrTxDone {
+    return IOError { Err: err }
+  }
+
+  return err
+}
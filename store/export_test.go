@@ -0,0 +1,104 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "errors"
+  "time"
+)
+
+// Creates a SQLite database at an older schema version for testing upgrades.
+func CreateVersion(fileName string, password string, passwordStretch int, version int) (*Store, error) {
+  return create(fileName, password, nil, crypto.PBKDF2Params(passwordStretch), FormatSQLite, version)
+}
+
+// Inserts a credential using only the columns from the base schema.
+func (store *Store) AddBaseCredential(credential *Credential) error {
+  return store.update(func(tx Tx) error {
+    _, err := tx.Insert("credentials", Row {
+      "login": store.keyCipher.Encrypt([]byte(credential.Login)),
+      "password": store.keyCipher.Encrypt([]byte(credential.Password)),
+      "realm": store.keyCipher.Encrypt([]byte(credential.Realm)),
+      "note": store.keyCipher.Encrypt([]byte(credential.Note)),
+    })
+
+    return err
+  })
+}
+
+// Inserts a row directly into the backend, e.g. to test its constraints.
+func (store *Store) InsertRow(table string, row Row) error {
+  return store.transact(func(tx Tx) error {
+    _, err := tx.Insert(table, row)
+    return err
+  })
+}
+
+// Updates rows directly in the backend, e.g. to test its constraints.
+func (store *Store) UpdateRows(table string, where Row, values Row) error {
+  return store.transact(func(tx Tx) error {
+    _, err := tx.Update(table, where, values)
+    return err
+  })
+}
+
+// Sets how long to wait for another process to release the database lock.
+func SetLockTimeout(timeout time.Duration) time.Duration {
+  previous := lockTimeout
+  lockTimeout = timeout
+  return previous
+}
+
+func LockFileName(fileName string) string {
+  return lockFileName(fileName)
+}
+
+// Acquires the database lock as another process would, returning a function
+// that releases it.
+func LockFile(fileName string) (func() error, error) {
+  lock, err := lockFile(fileName)
+  if err != nil {
+    return nil, err
+  }
+
+  return lock.unlock, nil
+}
+
+// Inserts a credential with timestamps using the columns from the vaults
+// schema.
+func (store *Store) AddVaultCredential(credential *Credential) error {
+  return store.update(func(tx Tx) error {
+    _, err := tx.Insert("credentials", Row {
+      "vault": store.vault,
+      "login": store.keyCipher.Encrypt([]byte(credential.Login)),
+      "password": store.keyCipher.Encrypt([]byte(credential.Password)),
+      "realm": store.keyCipher.Encrypt([]byte(credential.Realm)),
+      "note": store.keyCipher.Encrypt([]byte(credential.Note)),
+      "created": store.encryptTime("credentials", "created", "", now()),
+      "modified": store.encryptTime("credentials", "modified", "", now()),
+    })
+
+    return err
+  })
+}
+
+// Makes the migration to the given version fail after making its changes.
+// Returns a function that restores the migration.
+func FailMigration(version int) func() {
+  index := version - baseVersion - 1
+  original := migrations[index]
+
+  migrations[index] = migration {
+    description: original.description,
+    migrate: func(store *Store, tx Tx) error {
+      if err := original.migrate(store, tx); err != nil {
+        return err
+      }
+
+      return errors.New("Injected failure.")
+    },
+  }
+
+  return func() {
+    migrations[index] = original
+  }
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+  "strings"
+)
+
+// A custom key/value field on a credential, e.g. a PIN or account number.
+// Concealed fields hold secrets and are not displayed by default.
+type Field struct {
+  Name string `json:"name"`
+  Value string `json:"value"`
+  Concealed bool `json:"concealed,omitempty"`
+}
+
+// Returns the field with the given name, ignoring case, or nil.
+func (credential *Credential) Field(name string) *Field {
+  for i := range credential.Fields {
+    if strings.EqualFold(credential.Fields[i].Name, name) {
+      return &credential.Fields[i]
+    }
+  }
+
+  return nil
+}
+
+// Adds a field or replaces the value of an existing field with the same name.
+func (credential *Credential) SetField(name, value string, concealed bool) {
+  if field := credential.Field(name); field != nil {
+    field.Value = value
+    field.Concealed = concealed
+    return
+  }
+
+  credential.Fields = append(credential.Fields, Field {
+    Name: name,
+    Value: value,
+    Concealed: concealed,
+  })
+}
+
+// Removes the field with the given name, ignoring case.
+func (credential *Credential) RemoveField(name string) {
+  fields := make([]Field, 0, len(credential.Fields))
+  for _, field := range credential.Fields {
+    if !strings.EqualFold(field.Name, name) {
+      fields = append(fields, field)
+    }
+  }
+
+  credential.Fields = fields
+}
+
+// Returns fields by credential ID, in the order they were added.
+func (store *Store) loadCredentialFields(q Reader) (map[int][]Field, error) {
+  uuids, err := store.credentialUUIDs(q)
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := q.Select("fields", nil)
+  if err != nil {
+    return nil, err
+  }
+
+  fields := make(map[int][]Field)
+
+  for _, row := range rows {
+    credentialId := row.Int("credential_id")
+    uuid, ok := uuids[credentialId]
+    if !ok {
+      continue
+    }
+
+    field, err := store.decryptField(row, uuid)
+    if err != nil {
+      return nil, err
+    }
+
+    fields[credentialId] = append(fields[credentialId], field)
+  }
+
+  return fields, nil
+}
+
+// Returns the fields of a single credential, in the order they were added.
+func (store *Store) loadFields(q Reader, credentialId int, uuid string) ([]Field, error) {
+  rows, err := q.Select("fields", Row { "credential_id": credentialId })
+  if err != nil {
+    return nil, err
+  }
+
+  fields := []Field{}
+
+  for _, row := range rows {
+    field, err := store.decryptField(row, uuid)
+    if err != nil {
+      return nil, err
+    }
+
+    fields = append(fields, field)
+  }
+
+  return fields, nil
+}
+
+func (store *Store) decryptField(row Row, uuid string) (Field, error) {
+  credentialId := row.Int("credential_id")
+  field := Field { Concealed: row.Bool("concealed") }
+
+  var err error
+  if field.Name, err = store.decrypt(credentialId, "fields", "name", uuid, row.Bytes("name")); err != nil {
+    return field, err
+  }
+
+  if field.Value, err = store.decrypt(credentialId, "fields", "value", uuid, row.Bytes("value")); err != nil {
+    return field, err
+  }
+
+  return field, nil
+}
+
+// Replaces the fields stored for a credential with the given UUID.
+func (store *Store) saveFields(tx Tx, credential *Credential, uuid string) error {
+  if _, err := tx.Delete("fields", Row { "credential_id": credential.id }); err != nil {
+    return err
+  }
+
+  for _, field := range credential.Fields {
+    if strings.TrimSpace(field.Name) == "" {
+      continue
+    }
+
+    _, err := tx.Insert("fields", Row {
+      "credential_id": credential.id,
+      "name": store.sealString("fields", "name", uuid, field.Name),
+      "value": store.sealString("fields", "value", uuid, field.Value),
+      "concealed": field.Concealed,
+    })
+
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
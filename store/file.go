@@ -0,0 +1,421 @@
+package store
+
+import (
+  "encoding/gob"
+  "io/ioutil"
+  "strings"
+  "bytes"
+  "errors"
+  "sync"
+  "fmt"
+  "os"
+)
+
+// Databases in the single-file format start with this header, followed by
+// the gob-encoded tables.
+var fileHeader = []byte("Ward database 1\x00")
+
+// Stores tables in memory, optionally saving them to a single file on every
+// commit. Pure Go, so it does not require cgo.
+type fileBackend struct {
+  mutex sync.Mutex
+  fileName string
+  tables map[string]*fileTable
+
+  // The file the tables were read from. Every save replaces the file, so a
+  // different file means another process has written to the database.
+  info os.FileInfo
+}
+
+// The file backend does not run SQL schema changes, so it applies the unique
+// keys and non-NULL column defaults of the latest SQLite schema itself. Rows
+// with NULL in a key column, e.g. credentials from before UUIDs, are not
+// checked, as in SQLite.
+var fileUniqueKeys = map[string][][]string {
+  "credentials": { { "vault", "uuid" } },
+  "credential_tags": { { "credential_id", "tag_id" } },
+  "settings": { { "name" } },
+  "audit": { { "vault", "sequence" } },
+}
+
+var fileDefaults = map[string]Row {
+  "credentials": { "vault": int64(1) },
+  "tags": { "vault": int64(1) },
+  "fields": { "concealed": int64(0) },
+  "settings": {
+    "vault": int64(1),
+    "name": "default",
+    "blind_index": int64(0),
+    "associated_data": int64(0),
+    "kdf": "pbkdf2-sha3-512",
+    "kdf_memory": int64(0),
+    "kdf_threads": int64(0),
+    "cipher_suite": "aes-128-gcm",
+    "key_file": int64(0),
+    "key_slots": int64(0),
+  },
+  "key_slots": {
+    "password_stretch": int64(0),
+    "kdf": "",
+    "kdf_memory": int64(0),
+    "kdf_threads": int64(0),
+    "key_file": int64(0),
+  },
+}
+
+type fileTable struct {
+  Rows []Row
+  NextID int64
+}
+
+type fileTx struct {
+  backend *fileBackend
+  tables map[string]*fileTable
+  done bool
+}
+
+// Returns a backend that is not saved to disk, e.g. for tests.
+func NewMemoryBackend() Backend {
+  return &fileBackend {
+    tables: make(map[string]*fileTable),
+  }
+}
+
+func createFileBackend(fileName string) (Backend, error) {
+  if fileName == ":memory:" {
+    return NewMemoryBackend(), nil
+  }
+
+  backend := &fileBackend {
+    fileName: fileName,
+    tables: make(map[string]*fileTable),
+  }
+
+  if err := backend.save(backend.tables); err != nil {
+    return nil, err
+  }
+
+  return backend, nil
+}
+
+func openFileBackend(fileName string) (Backend, error) {
+  backend := &fileBackend { fileName: fileName }
+  if err := backend.load(); err != nil {
+    return nil, err
+  }
+
+  return backend, nil
+}
+
+func (backend *fileBackend) load() error {
+  file, err := os.Open(backend.fileName)
+  if err != nil {
+    return err
+  }
+
+  defer file.Close()
+
+  info, err := file.Stat()
+  if err != nil {
+    return err
+  }
+
+  contents, err := ioutil.ReadAll(file)
+  if err != nil {
+    return err
+  }
+
+  if !bytes.HasPrefix(contents, fileHeader) {
+    return CorruptDatabaseError { Err: errors.New("invalid header") }
+  }
+
+  tables := make(map[string]*fileTable)
+  decoder := gob.NewDecoder(bytes.NewReader(contents[len(fileHeader):]))
+  if err = decoder.Decode(&tables); err != nil {
+    return CorruptDatabaseError { Err: err }
+  }
+
+  backend.tables = tables
+  backend.info = info
+  return nil
+}
+
+// Reloads the tables if another process has replaced the file since they
+// were read.
+func (backend *fileBackend) refresh() error {
+  if backend.fileName == "" {
+    return nil
+  }
+
+  info, err := os.Stat(backend.fileName)
+  if err != nil {
+    return err
+  }
+
+  if backend.info != nil && os.SameFile(info, backend.info) && info.ModTime().Equal(backend.info.ModTime()) && info.Size() == backend.info.Size() {
+    return nil
+  }
+
+  return backend.load()
+}
+
+// Writes the tables to a temporary file and renames it over the database so
+// that the file is never left partially written.
+func (backend *fileBackend) save(tables map[string]*fileTable) error {
+  if backend.fileName == "" {
+    return nil
+  }
+
+  var buffer bytes.Buffer
+  buffer.Write(fileHeader)
+  if err := gob.NewEncoder(&buffer).Encode(tables); err != nil {
+    return err
+  }
+
+  tempFileName := backend.fileName + ".tmp"
+  file, err := os.OpenFile(tempFileName, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+  if err != nil {
+    return err
+  }
+
+  if _, err = file.Write(buffer.Bytes()); err == nil {
+    err = file.Sync()
+  }
+
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+
+  if err != nil {
+    os.Remove(tempFileName)
+    return err
+  }
+
+  if err = os.Rename(tempFileName, backend.fileName); err != nil {
+    return err
+  }
+
+  backend.info, err = os.Stat(backend.fileName)
+  return err
+}
+
+func (backend *fileBackend) Select(table string, where Row) ([]Row, error) {
+  backend.mutex.Lock()
+  defer backend.mutex.Unlock()
+
+  if err := backend.refresh(); err != nil {
+    return nil, err
+  }
+
+  return selectRows(backend.tables, table, where), nil
+}
+
+func (backend *fileBackend) Begin() (Tx, error) {
+  backend.mutex.Lock()
+  defer backend.mutex.Unlock()
+
+  if err := backend.refresh(); err != nil {
+    return nil, err
+  }
+
+  tables := make(map[string]*fileTable, len(backend.tables))
+  for name, table := range backend.tables {
+    rows := make([]Row, len(table.Rows))
+    for i, row := range table.Rows {
+      rows[i] = copyRow(row)
+    }
+
+    tables[name] = &fileTable { Rows: rows, NextID: table.NextID }
+  }
+
+  return &fileTx { backend: backend, tables: tables }, nil
+}
+
+func (backend *fileBackend) Close() error {
+  return nil
+}
+
+func (tx *fileTx) table(name string) *fileTable {
+  table, ok := tx.tables[name]
+  if !ok {
+    table = &fileTable { NextID: 1 }
+    tx.tables[name] = table
+  }
+
+  return table
+}
+
+func (tx *fileTx) Select(table string, where Row) ([]Row, error) {
+  return selectRows(tx.tables, table, where), nil
+}
+
+func (tx *fileTx) Insert(name string, row Row) (int, error) {
+  table := tx.table(name)
+  row = normalizeRow(row)
+
+  for column, value := range fileDefaults[name] {
+    if _, ok := row[column]; !ok {
+      row[column] = value
+    }
+  }
+
+  id, ok := row["id"].(int64)
+  if !ok {
+    id = table.NextID
+    row["id"] = id
+  }
+
+  for _, existing := range table.Rows {
+    if existing["id"] == id {
+      return 0, ConstraintError { Err: errors.New("duplicate id") }
+    }
+  }
+
+  if err := checkUniqueKeys(name, table.Rows, []Row { row }); err != nil {
+    return 0, err
+  }
+
+  if id >= table.NextID {
+    table.NextID = id + 1
+  }
+
+  table.Rows = append(table.Rows, row)
+  return int(id), nil
+}
+
+// Like a SQLite statement, an update that violates a unique key changes
+// nothing.
+func (tx *fileTx) Update(name string, where Row, values Row) (int, error) {
+  table := tx.table(name)
+  values = normalizeRow(values)
+
+  rows := make([]Row, len(table.Rows))
+  changed := make([]Row, 0)
+  others := make([]Row, 0, len(table.Rows))
+  for i, row := range table.Rows {
+    if !row.matches(where) {
+      rows[i] = row
+      others = append(others, row)
+      continue
+    }
+
+    rows[i] = copyRow(row)
+    for column, value := range values {
+      rows[i][column] = value
+    }
+
+    changed = append(changed, rows[i])
+  }
+
+  if err := checkUniqueKeys(name, others, changed); err != nil {
+    return 0, err
+  }
+
+  table.Rows = rows
+  return len(changed), nil
+}
+
+func (tx *fileTx) Delete(name string, where Row) (int, error) {
+  table := tx.table(name)
+  rows := make([]Row, 0, len(table.Rows))
+
+  for _, row := range table.Rows {
+    if !row.matches(where) {
+      rows = append(rows, row)
+    }
+  }
+
+  count := len(table.Rows) - len(rows)
+  table.Rows = rows
+  return count, nil
+}
+
+// Schema changes are not run; see fileUniqueKeys and fileDefaults.
+func (tx *fileTx) ExecSchema(schema string) error {
+  return nil
+}
+
+func (tx *fileTx) Commit() error {
+  if tx.done {
+    return errors.New("Transaction already finished.")
+  }
+
+  tx.done = true
+
+  tx.backend.mutex.Lock()
+  defer tx.backend.mutex.Unlock()
+
+  if err := tx.backend.save(tx.tables); err != nil {
+    return err
+  }
+
+  tx.backend.tables = tx.tables
+  return nil
+}
+
+func (tx *fileTx) Rollback() error {
+  tx.done = true
+  return nil
+}
+
+func selectRows(tables map[string]*fileTable, name string, where Row) []Row {
+  rows := make([]Row, 0)
+
+  table, ok := tables[name]
+  if !ok {
+    return rows
+  }
+
+  for _, row := range table.Rows {
+    if row.matches(where) {
+      rows = append(rows, copyRow(row))
+    }
+  }
+
+  return rows
+}
+
+// Checks that the unique keys of the given rows are distinct from each other
+// and from the existing rows.
+func checkUniqueKeys(name string, existing []Row, rows []Row) error {
+  for _, columns := range fileUniqueKeys[name] {
+    seen := existing
+    for _, row := range rows {
+      key := make(Row, len(columns))
+      for _, column := range columns {
+        key[column] = row[column]
+      }
+
+      if !hasNull(key) {
+        for _, other := range seen {
+          if other.matches(key) {
+            return ConstraintError { Err: errors.New(fmt.Sprintf("duplicate %s (%s)", name, strings.Join(columns, ", "))) }
+          }
+        }
+      }
+
+      seen = append(seen[:len(seen):len(seen)], row)
+    }
+  }
+
+  return nil
+}
+
+func hasNull(row Row) bool {
+  for _, value := range row {
+    if value == nil {
+      return true
+    }
+  }
+
+  return false
+}
+
+func copyRow(row Row) Row {
+  copied := make(Row, len(row))
+  for column, value := range row {
+    copied[column] = value
+  }
+
+  return copied
+}
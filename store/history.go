@@ -0,0 +1,100 @@
+package store
+
+import (
+  "sort"
+  "time"
+)
+
+// A password that was previously set on a credential.
+type HistoryEntry struct {
+  Password string
+  Replaced time.Time
+}
+
+// Saves the credential's stored password to its history if it differs from
+// the password being saved.
+func (store *Store) recordHistory(tx Tx, credential *Credential, replaced time.Time) error {
+  row, err := store.credentialRow(tx, credential.id)
+  if err != nil {
+    return err
+  }
+
+  uuid := row.String("uuid")
+
+  password, err := store.decrypt(credential.id, "credentials", "password", uuid, row.Bytes("password"))
+  if err != nil {
+    return err
+  }
+
+  if password == credential.Password {
+    return nil
+  }
+
+  return store.insertHistory(tx, credential.id, uuid, &HistoryEntry { Password: password, Replaced: replaced })
+}
+
+func (store *Store) insertHistory(tx Tx, credentialID int, uuid string, entry *HistoryEntry) error {
+  _, err := tx.Insert("history", Row {
+    "credential_id": credentialID,
+    "password": store.sealString("history", "password", uuid, entry.Password),
+    "replaced": store.encryptTime("history", "replaced", uuid, entry.Replaced),
+  })
+
+  return err
+}
+
+// Returns the passwords previously set on a credential, most recent first.
+func (store *Store) PasswordHistory(credential *Credential) ([]*HistoryEntry, error) {
+  if credential.id == 0 {
+    panic("Invalid credential ID.")
+  }
+
+  entries, err := store.passwordHistory(store.db, credential)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  return entries, nil
+}
+
+func (store *Store) passwordHistory(q Reader, credential *Credential) ([]*HistoryEntry, error) {
+  uuid, err := store.credentialUUID(q, credential)
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := q.Select("history", Row { "credential_id": credential.id })
+  if err != nil {
+    return nil, err
+  }
+
+  entries := make([]*HistoryEntry, 0, len(rows))
+
+  for i := len(rows) - 1; i >= 0; i-- {
+    entry := &HistoryEntry {}
+
+    if entry.Password, err = store.decrypt(credential.id, "history", "password", uuid, rows[i].Bytes("password")); err != nil {
+      return nil, err
+    }
+
+    if entry.Replaced, err = store.decryptTime(credential.id, "history", "replaced", uuid, rows[i].Bytes("replaced")); err != nil {
+      return nil, err
+    }
+
+    entries = append(entries, entry)
+  }
+
+  // Passwords merged from another database are stored after newer ones.
+  sort.SliceStable(entries, func(i, j int) bool {
+    return entries[i].Replaced.After(entries[j].Replaced)
+  })
+
+  return entries, nil
+}
+
+// Sets a credential's password back to an earlier one. The current password
+// is kept in the history.
+func (store *Store) RestorePassword(credential *Credential, entry *HistoryEntry) error {
+  credential.Password = entry.Password
+  return store.UpdateCredential(credential)
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "strings"
+  "sort"
+)
+
+// The blind index stores a keyed MAC of each credential's login and realm so
+// that exact lookups only decrypt the matching credentials. The MACs reveal
+// which credentials share a login or realm, so the index is disabled unless
+// explicitly enabled.
+func (store *Store) blindIndex(column, value string) []byte {
+  if value == "" {
+    return nil
+  }
+
+  key := crypto.DeriveKey(store.key, "ward blind index " + column)
+  return crypto.MAC(key, []byte(strings.ToLower(value)))
+}
+
+func (store *Store) blindIndexEnabled(q Reader) (bool, error) {
+  settings, err := store.settings(q)
+  if err != nil {
+    return false, err
+  }
+
+  return settings.Bool("blind_index"), nil
+}
+
+// Updates the blind index entries for a credential if the index is enabled.
+func (store *Store) indexCredential(tx Tx, credential *Credential) error {
+  enabled, err := store.blindIndexEnabled(tx)
+  if err != nil || !enabled {
+    return err
+  }
+
+  _, err = tx.Update("credentials", Row { "id": credential.id, "vault": store.vault }, Row {
+    "login_index": store.blindIndex("login", credential.Login),
+    "realm_index": store.blindIndex("realm", credential.Realm),
+  })
+
+  return err
+}
+
+func (store *Store) BlindIndexEnabled() (bool, error) {
+  enabled, err := store.blindIndexEnabled(store.db)
+  return enabled, dbError(err)
+}
+
+// Enables the blind index and builds it for existing credentials, or disables
+// it and removes all index entries.
+func (store *Store) SetBlindIndex(enabled bool) error {
+  return store.update(func(tx Tx) error {
+    if err := store.updateSettings(tx, Row { "blind_index": enabled }); err != nil {
+      return err
+    }
+
+    if !enabled {
+      _, err := tx.Update("credentials", Row { "vault": store.vault }, Row {
+        "login_index": nil,
+        "realm_index": nil,
+      })
+
+      return err
+    }
+
+    return store.buildBlindIndex(tx)
+  })
+}
+
+// Sets the index entries of every credential, e.g. after the index is enabled
+// or the data key changes.
+func (store *Store) buildBlindIndex(tx Tx) error {
+  rows, err := tx.Select("credentials", Row { "vault": store.vault })
+  if err != nil {
+    return err
+  }
+
+  for _, row := range rows {
+    credential := &Credential { id: row.Int("id"), UUID: row.String("uuid") }
+
+    if credential.Login, err = store.decrypt(credential.id, "credentials", "login", credential.UUID, row.Bytes("login")); err != nil {
+      return err
+    }
+
+    if credential.Realm, err = store.decrypt(credential.id, "credentials", "realm", credential.UUID, row.Bytes("realm")); err != nil {
+      return err
+    }
+
+    if err = store.indexCredential(tx, credential); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Returns active credentials whose login or realm exactly matches each term,
+// ignoring case. With the blind index enabled, only the credentials matching
+// the first term are decrypted. As with FindCredentials, passwords and fields
+// are not decrypted.
+func (store *Store) LookupCredentials(terms []string) ([]*Credential, error) {
+  matches := make([]*Credential, 0)
+  if len(terms) == 0 {
+    return matches, nil
+  }
+
+  enabled, err := store.BlindIndexEnabled()
+  if err != nil {
+    return nil, err
+  }
+
+  // Empty values are not indexed, so they can only be found by a scan.
+  var rows []Row
+  if enabled && terms[0] != "" {
+    loginRows, err := store.db.Select("credentials", Row { "vault": store.vault, "login_index": store.blindIndex("login", terms[0]) })
+    if err != nil {
+      return nil, dbError(err)
+    }
+
+    realmRows, err := store.db.Select("credentials", Row { "vault": store.vault, "realm_index": store.blindIndex("realm", terms[0]) })
+    if err != nil {
+      return nil, dbError(err)
+    }
+
+    rows = mergeRows(loginRows, realmRows)
+  } else {
+    if rows, err = store.db.Select("credentials", Row { "vault": store.vault }); err != nil {
+      return nil, dbError(err)
+    }
+  }
+
+  active := make([]Row, 0, len(rows))
+  for _, row := range rows {
+    if row.IsNull("deleted") {
+      active = append(active, row)
+    }
+  }
+
+  err = store.decryptCredentials(store.db, active, false, func(credential *Credential) error {
+    for _, term := range terms {
+      if !strings.EqualFold(credential.Login, term) && !strings.EqualFold(credential.Realm, term) {
+        return nil
+      }
+    }
+
+    matches = append(matches, credential)
+    return nil
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  return matches, nil
+}
+
+// Combines two sets of rows ordered by id, removing duplicates.
+func mergeRows(first, second []Row) []Row {
+  seen := make(map[int]bool)
+  rows := make([]Row, 0, len(first) + len(second))
+
+  for _, row := range append(first, second...) {
+    if !seen[row.Int("id")] {
+      seen[row.Int("id")] = true
+      rows = append(rows, row)
+    }
+  }
+
+  sort.Slice(rows, func(i, j int) bool {
+    return rows[i].Int("id") < rows[j].Int("id")
+  })
+
+  return rows
+}
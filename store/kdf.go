@@ -0,0 +1,62 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "errors"
+)
+
+// Returns the parameters used to derive a password key, stored in a key slot
+// or, before key slots were added, in the settings. Keys derived before the
+// function was stored use PBKDF2.
+func rowKDF(row Row) crypto.KDF {
+  name := row.String("kdf")
+  if name == "" {
+    name = crypto.KDFPBKDF2
+  }
+
+  return crypto.KDF {
+    Name: name,
+    Time: row.Int("password_stretch"),
+    Memory: row.Int("kdf_memory"),
+    Threads: row.Int("kdf_threads"),
+  }
+}
+
+// Returns the key slot or settings columns that store a key derivation
+// function in a database of the given version.
+func kdfSettings(kdf crypto.KDF, version int) (Row, error) {
+  if err := kdf.Validate(); err != nil {
+    return nil, err
+  }
+
+  settings := Row { "password_stretch": kdf.Time }
+
+  if version >= kdfVersion {
+    settings["kdf"] = kdf.Name
+    settings["kdf_memory"] = kdf.Memory
+    settings["kdf_threads"] = kdf.Threads
+  } else if kdf.Name != crypto.KDFPBKDF2 {
+    return nil, errors.New("This database version only supports PBKDF2.")
+  }
+
+  return settings, nil
+}
+
+// Returns the parameters used to derive the open vault's key from its master
+// password, i.e. those of the key slot that unlocked it.
+func (store *Store) KDF() (crypto.KDF, error) {
+  if _, err := store.settings(store.db); err != nil {
+    return crypto.KDF{}, dbError(err)
+  }
+
+  slot, err := store.slotRow(store.db)
+  if err != nil {
+    return crypto.KDF{}, dbError(err)
+  }
+
+  if !slotHasPassword(slot) {
+    return crypto.KDF{}, errors.New("The key slot that unlocked the vault has no password.")
+  }
+
+  return rowKDF(slot), nil
+}
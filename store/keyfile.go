@@ -0,0 +1,70 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "errors"
+)
+
+// Returns the key that encrypts the data key: the key derived from the master
+// password, combined with the key file if there is one. Key slots without a
+// password use an all-zero password key, so only the key file determines the
+// result.
+func unlockKey(passwordKey []byte, keyFile []byte) []byte {
+  if keyFile == nil {
+    return passwordKey
+  }
+
+  return crypto.CombineKeyFile(passwordKey, keyFile)
+}
+
+// Whether the key slot that unlocked the vault requires a key file.
+func (store *Store) HasKeyFile() bool {
+  return store.keyFile != nil
+}
+
+// Requires the contents of a key file, in addition to the master password, to
+// open the vault with the key slot that unlocked it. A nil key file removes
+// the requirement.
+func (store *Store) SetKeyFile(keyFile []byte) error {
+  if keyFile != nil && len(keyFile) == 0 {
+    return errors.New("Key file is empty.")
+  }
+
+  passwordCipher, err := crypto.NewSuiteCipher(store.suite, unlockKey(store.passwordKey, keyFile))
+  if err != nil {
+    return err
+  }
+
+  err = store.update(func(tx Tx) error {
+    slot, err := store.slotRow(tx)
+    if err != nil {
+      return err
+    }
+
+    if err = checkSlotChangeable(slot); err != nil {
+      return err
+    }
+
+    if keyFile == nil && !slotHasPassword(slot) {
+      return errors.New("A key slot without a password requires a key file.")
+    }
+
+    values := Row {
+      "encrypted_key": passwordCipher.Encrypt(store.key),
+      "key_file": keyFile != nil,
+    }
+
+    if err := store.updateSlot(tx, values); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionMaster, nil)
+  })
+
+  if err != nil {
+    return err
+  }
+
+  store.keyFile, store.passwordCipher = keyFile, passwordCipher
+  return nil
+}
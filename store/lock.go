@@ -0,0 +1,130 @@
+package store
+
+import (
+  "io/ioutil"
+  "strconv"
+  "strings"
+  "time"
+  "fmt"
+  "os"
+)
+
+// How long to wait for another process to release the lock.
+var lockTimeout = 10 * time.Second
+
+const lockRetryInterval = 50 * time.Millisecond
+
+// An operating system advisory lock on a file next to the database. The OS
+// releases it when the process holding it exits, even if it crashes, so a
+// lock is never left behind and never has to be broken. While held, the file
+// records the process and host holding the lock.
+type fileLock struct {
+  file *os.File
+}
+
+func lockFileName(fileName string) string {
+  return fileName + ".lock"
+}
+
+// Acquires the lock for a database file, waiting for other processes to
+// release it. The lock file is left in place so that every process locks the
+// same file.
+func lockFile(fileName string) (*fileLock, error) {
+  name := lockFileName(fileName)
+  file, err := os.OpenFile(name, os.O_RDWR | os.O_CREATE, 0600)
+  if err != nil {
+    return nil, err
+  }
+
+  deadline := time.Now().Add(lockTimeout)
+
+  for {
+    locked, err := lockHandle(file)
+    if err != nil {
+      file.Close()
+      return nil, err
+    }
+
+    if locked {
+      break
+    }
+
+    if time.Now().After(deadline) {
+      file.Close()
+      pid, lockHost := readLockOwner(name)
+      return nil, LockedError { PID: pid, Host: lockHost }
+    }
+
+    time.Sleep(lockRetryInterval)
+  }
+
+  host, _ := os.Hostname()
+  owner := fmt.Sprintf("%d %s\n", os.Getpid(), host)
+
+  err = file.Truncate(0)
+  if err == nil {
+    _, err = file.WriteAt([]byte(owner), 0)
+  }
+
+  if err != nil {
+    unlockHandle(file)
+    file.Close()
+    return nil, err
+  }
+
+  return &fileLock { file: file }, nil
+}
+
+// Reads the process and host holding a lock. Both are empty if the lock is
+// being acquired or released.
+func readLockOwner(name string) (int, string) {
+  contents, err := ioutil.ReadFile(name)
+  if err != nil {
+    return 0, ""
+  }
+
+  parts := strings.Fields(string(contents))
+  if len(parts) != 2 {
+    return 0, ""
+  }
+
+  pid, _ := strconv.Atoi(parts[0])
+  return pid, parts[1]
+}
+
+func (lock *fileLock) unlock() error {
+  lock.file.Truncate(0)
+  err := unlockHandle(lock.file)
+  if closeErr := lock.file.Close(); err == nil {
+    err = closeErr
+  }
+
+  return err
+}
+
+// Locks the database file for writing. Locks are reentrant so that e.g. an
+// upgrade can hold the lock across a backup and a migration.
+func (store *Store) lock() (func(), error) {
+  if store.fileName == "" {
+    return func() {}, nil
+  }
+
+  if store.lockDepth == 0 {
+    lock, err := lockFile(store.fileName)
+    if err != nil {
+      return nil, err
+    }
+
+    store.fileLock = lock
+  }
+
+  store.lockDepth++
+
+  return func() {
+    store.lockDepth--
+    if store.lockDepth == 0 {
+      store.fileLock.unlock()
+      store.fileLock = nil
+    }
+  }, nil
+}
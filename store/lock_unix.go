@@ -0,0 +1,23 @@
+// +build !windows
+
+package store
+
+import (
+  "syscall"
+  "os"
+)
+
+// Takes an exclusive flock on the file without waiting. Locks taken through
+// separate opens of the file exclude each other, even within one process.
+func lockHandle(file *os.File) (bool, error) {
+  err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+  if err == syscall.EWOULDBLOCK {
+    return false, nil
+  }
+
+  return err == nil, err
+}
+
+func unlockHandle(file *os.File) error {
+  return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
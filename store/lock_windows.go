@@ -0,0 +1,49 @@
+package store
+
+import (
+  "syscall"
+  "unsafe"
+  "os"
+)
+
+var (
+  kernel32 = syscall.NewLazyDLL("kernel32.dll")
+  procLockFileEx = kernel32.NewProc("LockFileEx")
+  procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+  lockfileFailImmediately = 0x1
+  lockfileExclusiveLock = 0x2
+  errorLockViolation syscall.Errno = 33
+)
+
+// Windows locks byte ranges, and a locked range cannot be read by others. The
+// lock is taken on a byte far past the owner record so that it stays readable.
+func lockRange() *syscall.Overlapped {
+  return &syscall.Overlapped { OffsetHigh: 0x7fffffff }
+}
+
+// Takes an exclusive LockFileEx lock on the file without waiting.
+func lockHandle(file *os.File) (bool, error) {
+  flags := uintptr(lockfileExclusiveLock | lockfileFailImmediately)
+  result, _, err := procLockFileEx.Call(file.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(lockRange())))
+  if result != 0 {
+    return true, nil
+  }
+
+  if err == errorLockViolation {
+    return false, nil
+  }
+
+  return false, err
+}
+
+func unlockHandle(file *os.File) error {
+  result, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockRange())))
+  if result == 0 {
+    return err
+  }
+
+  return nil
+}
@@ -0,0 +1,443 @@
+package store
+
+import (
+  "bytes"
+  "sort"
+  "time"
+)
+
+// A credential that differs between this database and another copy of it.
+// Local or Other is nil if the credential is not in that database, e.g.
+// because it was permanently deleted.
+type MergeChange struct {
+  Local *Credential
+  Other *Credential
+
+  // Whether the local credential is replaced by the other one, or removed if
+  // Other is nil. Set by PlanMerge for changes made in only one database.
+  UseOther bool
+
+  // Whether the credential was changed in both databases since they
+  // diverged. The caller decides which version to keep by setting UseOther.
+  Conflict bool
+}
+
+// Returns the time at which the two databases diverged: the time of the last
+// audit log entry they share. Databases with no shared entries, e.g. ones
+// encrypted with different keys, have no common history and the zero time is
+// returned.
+func (store *Store) mergeBase(other *Store) (time.Time, error) {
+  localRows, err := store.auditRows(store.db)
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  otherRows, err := other.auditRows(other.db)
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  last := -1
+  for i := 0; i < len(localRows) && i < len(otherRows); i++ {
+    if !bytes.Equal(localRows[i].Bytes("mac"), otherRows[i].Bytes("mac")) {
+      break
+    }
+
+    last = i
+  }
+
+  if last < 0 {
+    return time.Time{}, nil
+  }
+
+  entries, err := store.AuditLog()
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  // Timestamps are stored with one second precision, so changes made in the
+  // same second as the last shared entry are treated as changes since.
+  return entries[last].Time.Truncate(time.Second), nil
+}
+
+// Returns all credentials, active and trashed, with secrets decrypted, by
+// UUID and in order of ID.
+func (store *Store) mergeCredentials() (map[string]*Credential, []*Credential, error) {
+  byUUID := make(map[string]*Credential)
+  ordered := make([]*Credential, 0)
+
+  for _, trashed := range []bool { false, true } {
+    err := store.eachCredential(trashed, true, func(credential *Credential) error {
+      byUUID[credential.UUID] = credential
+      ordered = append(ordered, credential)
+      return nil
+    })
+
+    if err != nil {
+      return nil, nil, err
+    }
+  }
+
+  sort.SliceStable(ordered, func(i, j int) bool {
+    return ordered[i].id < ordered[j].id
+  })
+
+  return byUUID, ordered, nil
+}
+
+func lastChanged(credential *Credential) time.Time {
+  changed := credential.Created
+  for _, t := range []time.Time { credential.Modified, credential.Deleted } {
+    if t.After(changed) {
+      changed = t
+    }
+  }
+
+  return changed
+}
+
+// The attachments and password history of a credential, which are merged
+// along with it.
+type mergeDetails struct {
+  attachments []*Attachment
+  history []*HistoryEntry
+}
+
+func (store *Store) mergeDetails(q Reader, credential *Credential) (*mergeDetails, error) {
+  attachments, err := store.attachments(q, credential)
+  if err != nil {
+    return nil, err
+  }
+
+  history, err := store.passwordHistory(q, credential)
+  if err != nil {
+    return nil, err
+  }
+
+  return &mergeDetails { attachments: attachments, history: history }, nil
+}
+
+func hasHistoryEntry(history []*HistoryEntry, entry *HistoryEntry) bool {
+  for _, existing := range history {
+    if existing.Password == entry.Password && existing.Replaced.Equal(entry.Replaced) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// Whether the credential q from another database, with its attachments and
+// history, needs no changes to p. Passwords in p's history that are missing
+// from q's are kept, so they do not count as differences.
+func sameCredential(p, q *Credential, pDetails, qDetails *mergeDetails) bool {
+  if p.Login != q.Login || p.Password != q.Password || p.Realm != q.Realm || p.Note != q.Note {
+    return false
+  }
+
+  if p.Deleted.IsZero() != q.Deleted.IsZero() {
+    return false
+  }
+
+  pTags, qTags := normalizeTags(p.Tags), normalizeTags(q.Tags)
+  if len(pTags) != len(qTags) || len(p.Fields) != len(q.Fields) {
+    return false
+  }
+
+  for i := range pTags {
+    if pTags[i] != qTags[i] {
+      return false
+    }
+  }
+
+  for i := range p.Fields {
+    if p.Fields[i] != q.Fields[i] {
+      return false
+    }
+  }
+
+  if len(pDetails.attachments) != len(qDetails.attachments) {
+    return false
+  }
+
+  for i, attachment := range pDetails.attachments {
+    other := qDetails.attachments[i]
+    if attachment.Name != other.Name || !bytes.Equal(attachment.Data, other.Data) {
+      return false
+    }
+  }
+
+  for _, entry := range qDetails.history {
+    if !hasHistoryEntry(pDetails.history, entry) {
+      return false
+    }
+  }
+
+  return true
+}
+
+// Compares this database with another copy of it, e.g. a conflicted copy
+// created by a file sync service. Credentials are matched by UUID. Changes
+// made in only one database since the copies diverged are kept: newer edits
+// replace older ones, and credentials deleted in either database are deleted.
+// Credentials changed in both databases are returned as conflicts for the
+// caller to resolve.
+func (store *Store) PlanMerge(other *Store) ([]*MergeChange, error) {
+  base, err := store.mergeBase(other)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  changedSinceBase := func(credential *Credential) bool {
+    return !lastChanged(credential).Before(base)
+  }
+
+  existedAtBase := func(credential *Credential) bool {
+    return credential.Created.Before(base)
+  }
+
+  local, localOrdered, err := store.mergeCredentials()
+  if err != nil {
+    return nil, err
+  }
+
+  others, otherOrdered, err := other.mergeCredentials()
+  if err != nil {
+    return nil, err
+  }
+
+  changes := make([]*MergeChange, 0)
+
+  for _, credential := range localOrdered {
+    otherCredential, found := others[credential.UUID]
+
+    if !found {
+      // Credentials created before the databases diverged that are missing
+      // from the other database were permanently deleted there.
+      if existedAtBase(credential) {
+        changes = append(changes, &MergeChange {
+          Local: credential,
+          UseOther: !changedSinceBase(credential),
+          Conflict: changedSinceBase(credential),
+        })
+      }
+
+      continue
+    }
+
+    if !changedSinceBase(otherCredential) {
+      continue
+    }
+
+    localDetails, err := store.mergeDetails(store.db, credential)
+    if err != nil {
+      return nil, dbError(err)
+    }
+
+    otherDetails, err := other.mergeDetails(other.db, otherCredential)
+    if err != nil {
+      return nil, dbError(err)
+    }
+
+    if sameCredential(credential, otherCredential, localDetails, otherDetails) {
+      continue
+    }
+
+    changes = append(changes, &MergeChange {
+      Local: credential,
+      Other: otherCredential,
+      UseOther: !changedSinceBase(credential),
+      Conflict: changedSinceBase(credential),
+    })
+  }
+
+  for _, credential := range otherOrdered {
+    if _, found := local[credential.UUID]; found {
+      continue
+    }
+
+    if !existedAtBase(credential) {
+      changes = append(changes, &MergeChange { Other: credential, UseOther: true })
+    } else if changedSinceBase(credential) {
+      // Permanently deleted here, but changed in the other database.
+      changes = append(changes, &MergeChange { Other: credential, Conflict: true })
+    }
+  }
+
+  return changes, nil
+}
+
+// Applies the changes from PlanMerge that use the other database's version.
+// All changes are made in a single transaction. Returns the number of
+// credentials changed.
+func (store *Store) ApplyMerge(other *Store, changes []*MergeChange) (int, error) {
+  count := 0
+
+  err := store.update(func(tx Tx) error {
+    for _, change := range changes {
+      if !change.UseOther {
+        continue
+      }
+
+      var err error
+      if change.Other == nil {
+        err = store.purge(tx, change.Local)
+      } else if change.Local == nil {
+        err = store.insertMerged(tx, other, change.Other)
+      } else {
+        err = store.replaceMerged(tx, other, change.Local, change.Other)
+      }
+
+      if err != nil {
+        return err
+      }
+
+      count++
+    }
+
+    return nil
+  })
+
+  if err != nil {
+    return 0, err
+  }
+
+  return count, nil
+}
+
+// Adds a credential from another database along with its attachments and
+// password history, keeping its timestamps.
+func (store *Store) insertMerged(tx Tx, other *Store, otherCredential *Credential) error {
+  details, err := other.mergeDetails(other.db, otherCredential)
+  if err != nil {
+    return err
+  }
+
+  credential := *otherCredential
+  uuid := credential.UUID
+
+  id, err := tx.Insert("credentials", Row {
+    "vault": store.vault,
+    "uuid": uuid,
+    "login": store.sealString("credentials", "login", uuid, credential.Login),
+    "password": store.sealString("credentials", "password", uuid, credential.Password),
+    "realm": store.sealString("credentials", "realm", uuid, credential.Realm),
+    "note": store.sealString("credentials", "note", uuid, credential.Note),
+    "created": store.encryptTime("credentials", "created", uuid, credential.Created),
+    "modified": store.encryptTime("credentials", "modified", uuid, credential.Modified),
+    "accessed": store.encryptTime("credentials", "accessed", uuid, credential.Accessed),
+    "deleted": store.encryptTime("credentials", "deleted", uuid, credential.Deleted),
+  })
+
+  if err != nil {
+    return err
+  }
+
+  credential.id = id
+
+  if err = store.saveMergedDetails(tx, &credential, uuid, details); err != nil {
+    return err
+  }
+
+  return store.saveMerged(tx, &credential, uuid)
+}
+
+// Overwrites a credential with its version from another database, keeping
+// the other version's timestamps and attachments. The replaced password is
+// saved to the history, and passwords from the other version's history are
+// added to it.
+func (store *Store) replaceMerged(tx Tx, other *Store, local *Credential, otherCredential *Credential) error {
+  details, err := other.mergeDetails(other.db, otherCredential)
+  if err != nil {
+    return err
+  }
+
+  credential := *otherCredential
+  credential.id = local.id
+
+  uuid, err := store.credentialUUID(tx, &credential)
+  if err != nil {
+    return err
+  }
+
+  if err = store.recordHistory(tx, &credential, credential.Modified); err != nil {
+    return err
+  }
+
+  count, err := tx.Update("credentials", Row { "id": credential.id, "vault": store.vault }, Row {
+    "login": store.sealString("credentials", "login", uuid, credential.Login),
+    "password": store.sealString("credentials", "password", uuid, credential.Password),
+    "realm": store.sealString("credentials", "realm", uuid, credential.Realm),
+    "note": store.sealString("credentials", "note", uuid, credential.Note),
+    "modified": store.encryptTime("credentials", "modified", uuid, credential.Modified),
+    "accessed": store.encryptTime("credentials", "accessed", uuid, credential.Accessed),
+    "deleted": store.encryptTime("credentials", "deleted", uuid, credential.Deleted),
+  })
+
+  if err != nil {
+    return err
+  }
+
+  if err = checkAffected(count, credential.id); err != nil {
+    return err
+  }
+
+  if _, err = tx.Delete("attachments", Row { "credential_id": credential.id }); err != nil {
+    return err
+  }
+
+  if err = store.saveMergedDetails(tx, &credential, uuid, details); err != nil {
+    return err
+  }
+
+  return store.saveMerged(tx, &credential, uuid)
+}
+
+// Stores the attachments of a merged credential, and the passwords from its
+// history that are not already in the local history.
+func (store *Store) saveMergedDetails(tx Tx, credential *Credential, uuid string, details *mergeDetails) error {
+  for _, attachment := range details.attachments {
+    merged := &Attachment { Name: attachment.Name, Data: attachment.Data }
+    if err := validateAttachment(merged); err != nil {
+      return err
+    }
+
+    if err := store.insertAttachment(tx, credential.id, uuid, merged); err != nil {
+      return err
+    }
+  }
+
+  history, err := store.passwordHistory(tx, credential)
+  if err != nil {
+    return err
+  }
+
+  // History is returned newest first, and is stored oldest first.
+  for i := len(details.history) - 1; i >= 0; i-- {
+    if hasHistoryEntry(history, details.history[i]) {
+      continue
+    }
+
+    if err = store.insertHistory(tx, credential.id, uuid, details.history[i]); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func (store *Store) saveMerged(tx Tx, credential *Credential, uuid string) error {
+  if err := store.saveTags(tx, credential); err != nil {
+    return err
+  }
+
+  if err := store.saveFields(tx, credential, uuid); err != nil {
+    return err
+  }
+
+  if err := store.indexCredential(tx, credential); err != nil {
+    return err
+  }
+
+  return store.audit(tx, ActionMerge, credential)
+}
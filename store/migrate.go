@@ -0,0 +1,433 @@
+package store
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "os"
+)
+
+// The schema version of a newly-created database. Databases at this version
+// are upgraded to the latest version with migrations.
+const baseVersion = 1
+
+type migration struct {
+  description string
+  migrate func(store *Store, tx Tx) error
+}
+
+// Ordered schema upgrades. migrations[i] upgrades a database from version
+// baseVersion + i to version baseVersion + i + 1. Migrations must only ever
+// be appended to this list.
+var migrations = []migration {
+  { "credential timestamps", migrateTimestamps },
+  { "password history", migrateHistory },
+  { "tags", migrateTags },
+  { "custom fields", migrateFields },
+  { "attachments", migrateAttachments },
+  { "trash", migrateTrash },
+  { "audit log", migrateAudit },
+  { "blind index", migrateBlindIndex },
+  { "vaults", migrateVaults },
+  { "credential UUIDs", migrateUUIDs },
+  { "associated data", migrateAssociatedData },
+  { "key derivation functions", migrateKDF },
+  { "cipher suites", migrateSuites },
+  { "key files", migrateKeyFiles },
+  { "key slots", migrateKeySlots },
+}
+
+// The first version with support for multiple vaults.
+const vaultsVersion = 10
+
+// The first version that binds encrypted values to where they are stored.
+// Each vault is converted by bind the first time it is opened, since only its
+// own key can re-encrypt it.
+const associatedDataVersion = 12
+
+// The first version that stores each vault's key derivation function.
+const kdfVersion = 13
+
+// The first version that stores each vault's cipher suite. Vaults using
+// AES-128-GCM keep it until ChangeCipherSuite upgrades them.
+const suitesVersion = 14
+
+// The first version that supports key files.
+const keyFilesVersion = 15
+
+// The first version that stores data keys in key slots. The settings MAC of
+// each vault is extended to cover its slots by authenticateSlots when the
+// vault is opened.
+const slotsVersion = 16
+
+func migrateTimestamps(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    ALTER TABLE credentials ADD COLUMN created BLOB;
+    ALTER TABLE credentials ADD COLUMN modified BLOB;
+    ALTER TABLE credentials ADD COLUMN accessed BLOB;
+  `)
+
+  return dbError(err)
+}
+
+func latestVersion() int {
+  return baseVersion + len(migrations)
+}
+
+func readVersion(db Reader) (int, error) {
+  rows, err := db.Select("settings", nil)
+  if err != nil {
+    return 0, err
+  }
+
+  if len(rows) == 0 {
+    return 0, errors.New("Invalid settings.")
+  }
+
+  return rows[0].Int("version"), nil
+}
+
+func backupFileName(fileName string, version int) string {
+  return fmt.Sprintf("%s.v%d.bak", fileName, version)
+}
+
+func backupFile(fileName, backupFileName string) error {
+  input, err := os.Open(fileName)
+  if err != nil {
+    return err
+  }
+
+  defer input.Close()
+
+  output, err := os.OpenFile(backupFileName, os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0600)
+  if err != nil {
+    return err
+  }
+
+  if _, err = io.Copy(output, input); err != nil {
+    output.Close()
+    os.Remove(backupFileName)
+    return err
+  }
+
+  if err = output.Sync(); err != nil {
+    output.Close()
+    os.Remove(backupFileName)
+    return err
+  }
+
+  return output.Close()
+}
+
+// Applies migrations to upgrade the database from one version to another in
+// a single transaction. If any migration fails, the transaction is rolled
+// back and the database is left at its original version.
+func (store *Store) migrate(from, to int) error {
+  if from < baseVersion || from > to || to > latestVersion() {
+    return errors.New(fmt.Sprintf("Unsupported version: %d.", from))
+  }
+
+  if from == to {
+    return nil
+  }
+
+  return store.update(func(tx Tx) error {
+    return store.applyMigrations(tx, from, to)
+  })
+}
+
+func (store *Store) applyMigrations(tx Tx, from, to int) error {
+  for i := from - baseVersion; i < to - baseVersion; i++ {
+    if err := migrations[i].migrate(store, tx); err != nil {
+      return errors.New(fmt.Sprintf("Migration to version %d (%s) failed: %s", baseVersion + i + 1, migrations[i].description, err))
+    }
+  }
+
+  if _, err := tx.Update("settings", nil, Row { "version": to }); err != nil {
+    return dbError(err)
+  }
+
+  store.vaults = to >= vaultsVersion
+  store.slots = to >= slotsVersion
+  return nil
+}
+
+// Upgrades an existing database file to the latest version. The file is
+// copied to a versioned backup before any changes are made.
+func (store *Store) upgrade(version int) error {
+  if version == latestVersion() {
+    return nil
+  }
+
+  unlock, err := store.lock()
+  if err != nil {
+    return err
+  }
+
+  defer unlock()
+
+  // Another process may have upgraded the database while we waited.
+  if version, err = readVersion(store.db); err != nil {
+    return dbError(err)
+  }
+
+  store.vaults = version >= vaultsVersion
+  store.slots = version >= slotsVersion
+  if version == latestVersion() {
+    return nil
+  }
+
+  backup := backupFileName(store.fileName, version)
+  if err := backupFile(store.fileName, backup); err != nil {
+    return errors.New(fmt.Sprintf("Failed to back up database before upgrade: %s", err))
+  }
+
+  if err := store.migrate(version, latestVersion()); err != nil {
+    return errors.New(fmt.Sprintf("%s. The database was not changed. A backup is at %s.", err, backup))
+  }
+
+  return nil
+}
+
+func migrateHistory(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    CREATE TABLE history (
+      id INTEGER NOT NULL PRIMARY KEY,
+      credential_id INTEGER NOT NULL,
+      password BLOB,
+      replaced BLOB
+    );
+
+    CREATE INDEX history_credential_id ON history (credential_id);
+  `)
+
+  return dbError(err)
+}
+
+func migrateTags(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    CREATE TABLE tags (
+      id INTEGER NOT NULL PRIMARY KEY,
+      name BLOB
+    );
+
+    CREATE TABLE credential_tags (
+      credential_id INTEGER NOT NULL,
+      tag_id INTEGER NOT NULL,
+      PRIMARY KEY (credential_id, tag_id)
+    );
+  `)
+
+  return dbError(err)
+}
+
+func migrateFields(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    CREATE TABLE fields (
+      id INTEGER NOT NULL PRIMARY KEY,
+      credential_id INTEGER NOT NULL,
+      name BLOB,
+      value BLOB,
+      concealed INTEGER NOT NULL DEFAULT 0
+    );
+
+    CREATE INDEX fields_credential_id ON fields (credential_id);
+  `)
+
+  return dbError(err)
+}
+
+func migrateAttachments(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    CREATE TABLE attachments (
+      id INTEGER NOT NULL PRIMARY KEY,
+      credential_id INTEGER NOT NULL,
+      name BLOB,
+      data BLOB
+    );
+
+    CREATE INDEX attachments_credential_id ON attachments (credential_id);
+  `)
+
+  return dbError(err)
+}
+
+func migrateTrash(store *Store, tx Tx) error {
+  err := tx.ExecSchema("ALTER TABLE credentials ADD COLUMN deleted BLOB")
+  return dbError(err)
+}
+
+func migrateAudit(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    CREATE TABLE audit (
+      id INTEGER NOT NULL PRIMARY KEY,
+      sequence INTEGER NOT NULL UNIQUE,
+      entry BLOB,
+      mac BLOB
+    );
+
+    ALTER TABLE settings ADD COLUMN audit_head BLOB;
+  `)
+
+  return dbError(err)
+}
+
+func migrateBlindIndex(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    ALTER TABLE credentials ADD COLUMN login_index BLOB;
+    ALTER TABLE credentials ADD COLUMN realm_index BLOB;
+    ALTER TABLE settings ADD COLUMN blind_index INTEGER NOT NULL DEFAULT 0;
+
+    CREATE INDEX credentials_login_index ON credentials (login_index);
+    CREATE INDEX credentials_realm_index ON credentials (realm_index);
+  `)
+
+  return dbError(err)
+}
+
+// Existing data belongs to the default vault. The audit log is rebuilt so that
+// each vault has its own sequence of entries.
+func migrateVaults(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    ALTER TABLE settings ADD COLUMN vault INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE settings ADD COLUMN name TEXT NOT NULL DEFAULT 'default';
+    ALTER TABLE credentials ADD COLUMN vault INTEGER NOT NULL DEFAULT 1;
+    ALTER TABLE tags ADD COLUMN vault INTEGER NOT NULL DEFAULT 1;
+
+    ALTER TABLE audit RENAME TO audit_old;
+
+    CREATE TABLE audit (
+      id INTEGER NOT NULL PRIMARY KEY,
+      vault INTEGER NOT NULL,
+      sequence INTEGER NOT NULL,
+      entry BLOB,
+      mac BLOB,
+      UNIQUE (vault, sequence)
+    );
+
+    INSERT INTO audit (id, vault, sequence, entry, mac)
+    SELECT id, 1, sequence, entry, mac FROM audit_old;
+
+    DROP TABLE audit_old;
+
+    CREATE UNIQUE INDEX settings_name ON settings (name);
+    CREATE INDEX credentials_vault ON credentials (vault);
+  `)
+
+  return dbError(err)
+}
+
+// Existing credentials are assigned UUIDs derived from their encrypted
+// creation time, which is unique and shared by copies of the database, so
+// copies that are upgraded separately can still be merged.
+func migrateUUIDs(store *Store, tx Tx) error {
+  if err := tx.ExecSchema(`ALTER TABLE credentials ADD COLUMN uuid TEXT;`); err != nil {
+    return dbError(err)
+  }
+
+  rows, err := tx.Select("credentials", nil)
+  if err != nil {
+    return dbError(err)
+  }
+
+  for _, row := range rows {
+    uuid := derivedUUID([]byte(fmt.Sprintf("%d %d", row.Int("vault"), row.Int("id"))))
+    if created := row.Bytes("created"); created != nil {
+      uuid = derivedUUID(created)
+    }
+
+    if _, err = tx.Update("credentials", Row { "id": row.Int("id") }, Row { "uuid": uuid }); err != nil {
+      return dbError(err)
+    }
+  }
+
+  err = tx.ExecSchema(`CREATE UNIQUE INDEX credentials_uuid ON credentials (vault, uuid);`)
+  return dbError(err)
+}
+
+func migrateAssociatedData(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    ALTER TABLE settings ADD COLUMN associated_data INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE settings ADD COLUMN settings_mac BLOB;
+  `)
+
+  return dbError(err)
+}
+
+// Existing vaults derive their keys with PBKDF2, which uses password_stretch
+// as its iteration count.
+func migrateKDF(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    ALTER TABLE settings ADD COLUMN kdf TEXT NOT NULL DEFAULT 'pbkdf2-sha3-512';
+    ALTER TABLE settings ADD COLUMN kdf_memory INTEGER NOT NULL DEFAULT 0;
+    ALTER TABLE settings ADD COLUMN kdf_threads INTEGER NOT NULL DEFAULT 0;
+  `)
+
+  return dbError(err)
+}
+
+// Existing vaults use 128-bit AES-GCM keys.
+func migrateSuites(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`ALTER TABLE settings ADD COLUMN cipher_suite TEXT NOT NULL DEFAULT 'aes-128-gcm';`)
+  return dbError(err)
+}
+
+func migrateKeyFiles(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`ALTER TABLE settings ADD COLUMN key_file INTEGER NOT NULL DEFAULT 0;`)
+  return dbError(err)
+}
+
+// Each vault's data key moves from its settings to a key slot with the id of
+// the vault. The settings keep their copy until the vault is opened, since
+// their MAC covers it.
+func migrateKeySlots(store *Store, tx Tx) error {
+  err := tx.ExecSchema(`
+    CREATE TABLE key_slots (
+      id INTEGER NOT NULL PRIMARY KEY,
+      vault INTEGER NOT NULL,
+      label TEXT NOT NULL,
+      password_salt BLOB,
+      password_stretch INTEGER NOT NULL DEFAULT 0,
+      kdf TEXT NOT NULL DEFAULT '',
+      kdf_memory INTEGER NOT NULL DEFAULT 0,
+      kdf_threads INTEGER NOT NULL DEFAULT 0,
+      key_file INTEGER NOT NULL DEFAULT 0,
+      encrypted_key BLOB NOT NULL
+    );
+
+    CREATE INDEX key_slots_vault ON key_slots (vault);
+
+    ALTER TABLE settings ADD COLUMN key_slots INTEGER NOT NULL DEFAULT 0;
+  `)
+
+  if err != nil {
+    return dbError(err)
+  }
+
+  rows, err := tx.Select("settings", nil)
+  if err != nil {
+    return dbError(err)
+  }
+
+  for _, settings := range rows {
+    kdf := rowKDF(settings)
+    _, err = tx.Insert("key_slots", Row {
+      "id": settings.Int("vault"),
+      "vault": settings.Int("vault"),
+      "label": MasterSlotLabel,
+      "password_salt": settings.Bytes("password_salt"),
+      "password_stretch": kdf.Time,
+      "kdf": kdf.Name,
+      "kdf_memory": kdf.Memory,
+      "kdf_threads": kdf.Threads,
+      "key_file": settings.Bool("key_file"),
+      "encrypted_key": settings.Bytes("encrypted_key"),
+    })
+
+    if err != nil {
+      return dbError(err)
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "errors"
+)
+
+// The label of the key slot unlocked by the vault's recovery key. The recovery
+// key is random, so its slot needs no key derivation function and stores it
+// like a key file.
+const RecoverySlotLabel = "recovery key"
+
+// Adds a key slot unlocked by a new random recovery key, which is returned.
+// The recovery key is not stored anywhere else and cannot be shown again.
+func (store *Store) AddRecoveryKey() ([]byte, error) {
+  key := crypto.NewRecoveryKey()
+
+  slot, err := store.newSlot(RecoverySlotLabel, "", key, crypto.KDF{})
+  if err != nil {
+    return nil, err
+  }
+
+  err = store.update(func(tx Tx) error {
+    if _, err := store.settings(tx); err != nil {
+      return err
+    }
+
+    if _, err := store.insertSlot(tx, slot); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionSlot, nil)
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  return key, nil
+}
+
+// Opens a vault with its recovery key.
+func Recover(fileName string, vaultName string, recoveryKey []byte) (*Store, error) {
+  store, err := OpenVaultKeyFile(fileName, vaultName, "", recoveryKey)
+  if err != nil {
+    switch err.(type) {
+    case crypto.IncorrectPasswordError, crypto.InvalidPasswordError, KeyFileRequiredError:
+      return nil, errors.New("Incorrect recovery key, or the vault has no recovery key.")
+    }
+
+    return nil, err
+  }
+
+  return store, nil
+}
+
+// Sets a new password on the vault's master password slot, e.g. after the
+// vault was opened with its recovery key. The slot is created if it was
+// removed, and it no longer requires a key file.
+func (store *Store) ResetMasterPassword(password string, kdf crypto.KDF) error {
+  if password == "" {
+    var e crypto.InvalidPasswordError
+    return e
+  }
+
+  slot, err := store.newSlot(MasterSlotLabel, password, nil, kdf)
+  if err != nil {
+    return err
+  }
+
+  return store.update(func(tx Tx) error {
+    if _, err := store.settings(tx); err != nil {
+      return err
+    }
+
+    slots, err := selectSlots(tx, store.vault)
+    if err != nil {
+      return err
+    }
+
+    for _, existing := range slots {
+      if existing.String("label") != MasterSlotLabel {
+        continue
+      }
+
+      if existing.Int("id") == store.slot {
+        return errors.New("The vault was unlocked with its master password. Change it instead.")
+      }
+
+      if _, err = tx.Delete("key_slots", Row { "id": existing.Int("id") }); err != nil {
+        return err
+      }
+    }
+
+    if _, err = store.insertSlot(tx, slot); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionMaster, nil)
+  })
+}
@@ -0,0 +1,277 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "encoding/binary"
+  "bytes"
+  "errors"
+  "fmt"
+)
+
+// The columns encrypted with a vault's data key, by table. Tables other than
+// credentials and tags belong to a vault through their credential.
+var encryptedColumns = []struct {
+  table string
+  columns []string
+} {
+  { "credentials", []string { "login", "password", "realm", "note", "created", "modified", "accessed", "deleted" } },
+  { "history", []string { "password", "replaced" } },
+  { "fields", []string { "name", "value" } },
+  { "attachments", []string { "name", "data" } },
+  { "tags", []string { "name" } },
+}
+
+// Returns the rows of a table that belong to this vault.
+func (store *Store) vaultRows(tx Tx, table string, uuids map[int]string) ([]Row, error) {
+  if table == "credentials" || table == "tags" {
+    return tx.Select(table, Row { "vault": store.vault })
+  }
+
+  rows, err := tx.Select(table, nil)
+  if err != nil {
+    return nil, err
+  }
+
+  owned := make([]Row, 0, len(rows))
+  for _, row := range rows {
+    if _, ok := uuids[row.Int("credential_id")]; ok {
+      owned = append(owned, row)
+    }
+  }
+
+  return owned, nil
+}
+
+// Returns the owner that a row's values are bound to.
+func (store *Store) rowOwner(table string, row Row, uuids map[int]string) string {
+  switch table {
+  case "credentials":
+    return row.String("uuid")
+  case "tags":
+    return store.vaultOwner()
+  }
+
+  return uuids[row.Int("credential_id")]
+}
+
+// A value that was re-encrypted, kept to verify the result.
+type rekeyedValue struct {
+  table string
+  id int
+  column string
+  owner string
+  plaintext []byte
+}
+
+// Decrypts every value in this vault with a previous cipher, with or without
+// associated data, and encrypts it again with the current cipher and binding.
+func (store *Store) reencrypt(tx Tx, oldCipher *crypto.Cipher, oldBound bool) ([]rekeyedValue, error) {
+  uuids, err := store.credentialUUIDs(tx)
+  if err != nil {
+    return nil, err
+  }
+
+  rekeyed := make([]rekeyedValue, 0)
+
+  for _, encrypted := range encryptedColumns {
+    rows, err := store.vaultRows(tx, encrypted.table, uuids)
+    if err != nil {
+      return nil, err
+    }
+
+    for _, row := range rows {
+      owner := store.rowOwner(encrypted.table, row, uuids)
+      values := Row {}
+
+      for _, column := range encrypted.columns {
+        ciphertext := row.Bytes(column)
+        if ciphertext == nil {
+          continue
+        }
+
+        plaintext, err := openWith(oldCipher, oldBound, encrypted.table, column, owner, ciphertext)
+        if err != nil {
+          return nil, errors.New(fmt.Sprintf("Failed to decrypt %s %d: %s", encrypted.table, row.Int("id"), err))
+        }
+
+        values[column] = store.seal(encrypted.table, column, owner, plaintext)
+        rekeyed = append(rekeyed, rekeyedValue { encrypted.table, row.Int("id"), column, owner, plaintext })
+      }
+
+      if len(values) > 0 {
+        if _, err = tx.Update(encrypted.table, Row { "id": row.Int("id") }, values); err != nil {
+          return nil, err
+        }
+      }
+    }
+  }
+
+  return rekeyed, nil
+}
+
+// Replaces the vault's data key with a new random key and re-encrypts
+// everything protected by it: credentials and their history, fields,
+// attachments, and tags, the audit log, and the blind index. The result is
+// decrypted and checked before the transaction is committed, so a failure
+// leaves the database unchanged. Only the key slot that unlocked the vault
+// can be given the new key, so the other slots are removed.
+func (store *Store) Rekey() error {
+  return store.rekey(store.suite, store.passwordKey, nil)
+}
+
+// Replaces the data key with a new key for the given cipher suite, which
+// encrypts it with the given password key. Other values of the key slot, such
+// as a new password salt, are updated with the encrypted key.
+func (store *Store) rekey(suite string, passwordKey []byte, slot Row) error {
+  old := *store
+
+  newKey, err := crypto.NewSuiteKey(suite)
+  if err != nil {
+    return err
+  }
+
+  newCipher, err := crypto.NewSuiteCipher(suite, newKey)
+  if err != nil {
+    return err
+  }
+
+  passwordCipher, err := crypto.NewSuiteCipher(suite, unlockKey(passwordKey, store.keyFile))
+  if err != nil {
+    return err
+  }
+
+  err = store.update(func(tx Tx) error {
+    // Re-encrypting the log with a new MAC key would hide earlier tampering.
+    entries, err := store.auditLog(tx)
+    if err != nil {
+      return err
+    }
+
+    store.suite, store.key, store.keyCipher = suite, newKey, newCipher
+    store.passwordKey, store.passwordCipher = passwordKey, passwordCipher
+
+    rekeyed, err := store.reencrypt(tx, old.keyCipher, store.bound)
+    if err != nil {
+      return err
+    }
+
+    if err = store.removeOtherSlots(tx); err != nil {
+      return err
+    }
+
+    values := Row { "encrypted_key": passwordCipher.Encrypt(newKey) }
+    for column, value := range slot {
+      values[column] = value
+    }
+
+    if err = store.updateSlot(tx, values); err != nil {
+      return err
+    }
+
+    if err = store.updateSettings(tx, Row { "cipher_suite": suite }); err != nil {
+      return err
+    }
+
+    if err = store.rekeyAuditLog(tx, old.keyCipher); err != nil {
+      return err
+    }
+
+    enabled, err := store.blindIndexEnabled(tx)
+    if err != nil {
+      return err
+    }
+
+    if enabled {
+      if err = store.buildBlindIndex(tx); err != nil {
+        return err
+      }
+    }
+
+    if err = store.audit(tx, ActionRekey, nil); err != nil {
+      return err
+    }
+
+    return store.verifyRekey(tx, rekeyed, len(entries) + 1)
+  })
+
+  if err != nil {
+    store.suite, store.key, store.keyCipher = old.suite, old.key, old.keyCipher
+    store.passwordKey, store.passwordCipher = old.passwordKey, old.passwordCipher
+  }
+
+  return err
+}
+
+// Re-encrypts each audit log entry and rebuilds the MAC chain with the
+// current key.
+func (store *Store) rekeyAuditLog(tx Tx, oldCipher *crypto.Cipher) error {
+  rows, err := store.auditRows(tx)
+  if err != nil {
+    return err
+  }
+
+  key := store.auditKey()
+  var previous []byte
+
+  for _, row := range rows {
+    plaintext, err := oldCipher.Decrypt(row.Bytes("entry"))
+    if err != nil {
+      return AuditLogError { Index: row.Int("sequence"), Reason: "entry corrupt" }
+    }
+
+    ciphertext := store.keyCipher.Encrypt(plaintext)
+    mac := auditMAC(key, previous, uint64(row.Int("sequence")), ciphertext)
+
+    if _, err = tx.Update("audit", Row { "id": row.Int("id") }, Row { "entry": ciphertext, "mac": mac }); err != nil {
+      return err
+    }
+
+    previous = mac
+  }
+
+  head := make([]byte, 8)
+  binary.BigEndian.PutUint64(head, uint64(len(rows)))
+  head = append(head, previous...)
+
+  return store.updateSettings(tx, Row { "audit_head": store.keyCipher.Encrypt(head) })
+}
+
+// Checks that every re-encrypted value decrypts to its original plaintext
+// with the new key, and that the new key can be unlocked and the audit log
+// verified.
+func (store *Store) verifyRekey(tx Tx, rekeyed []rekeyedValue, auditEntries int) error {
+  if err := store.checkKey(tx); err != nil {
+    return err
+  }
+
+  failed := func(reason string) error {
+    return errors.New(fmt.Sprintf("Verification of the new key failed: %s. The database was not changed.", reason))
+  }
+
+  for _, value := range rekeyed {
+    rows, err := tx.Select(value.table, Row { "id": value.id })
+    if err != nil {
+      return err
+    }
+
+    if len(rows) != 1 {
+      return failed(fmt.Sprintf("%s %d is missing", value.table, value.id))
+    }
+
+    plaintext, err := store.open(value.table, value.column, value.owner, rows[0].Bytes(value.column))
+    if err != nil || !bytes.Equal(plaintext, value.plaintext) {
+      return failed(fmt.Sprintf("%s %d has an invalid %s", value.table, value.id, value.column))
+    }
+  }
+
+  entries, err := store.auditLog(tx)
+  if err != nil {
+    return failed(err.Error())
+  }
+
+  if len(entries) != auditEntries {
+    return failed("audit log entries are missing")
+  }
+
+  return nil
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "errors"
+)
+
+// The label of the key slot unlocked by the key split into shares. Like the
+// recovery key, the shares key is random and is stored like a key file.
+const SharesSlotLabel = "shares"
+
+// Splits a new random key into count shares, any threshold of which unlock
+// the vault, and adds a key slot for it. Shares created earlier no longer
+// unlock the vault.
+func (store *Store) CreateShares(threshold int, count int) ([]crypto.Share, error) {
+  key := crypto.NewKey()
+
+  shares, err := crypto.SplitSecret(key, threshold, count)
+  if err != nil {
+    return nil, err
+  }
+
+  slot, err := store.newSlot(SharesSlotLabel, "", key, crypto.KDF{})
+  if err != nil {
+    return nil, err
+  }
+
+  err = store.update(func(tx Tx) error {
+    if _, err := store.settings(tx); err != nil {
+      return err
+    }
+
+    slots, err := selectSlots(tx, store.vault)
+    if err != nil {
+      return err
+    }
+
+    for _, existing := range slots {
+      if existing.String("label") != SharesSlotLabel {
+        continue
+      }
+
+      if existing.Int("id") == store.slot {
+        return errors.New("The vault was unlocked with shares. Unlock it another way to create new shares.")
+      }
+
+      if _, err = tx.Delete("key_slots", Row { "id": existing.Int("id") }); err != nil {
+        return err
+      }
+    }
+
+    if _, err = store.insertSlot(tx, slot); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionSlot, nil)
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  return shares, nil
+}
+
+// Rebuilds the key split into shares and opens the vault with it. The key is
+// only kept in memory.
+func OpenShares(fileName string, vaultName string, shares []crypto.Share) (*Store, error) {
+  key, err := crypto.CombineShares(shares)
+  if err != nil {
+    return nil, err
+  }
+
+  store, err := OpenVaultKeyFile(fileName, vaultName, "", key)
+  if err != nil {
+    switch err.(type) {
+    case crypto.IncorrectPasswordError, crypto.InvalidPasswordError, KeyFileRequiredError:
+      return nil, errors.New("The shares do not unlock the vault. They may have been replaced by newer shares.")
+    }
+
+    return nil, err
+  }
+
+  return store, nil
+}
@@ -0,0 +1,405 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "strings"
+  "errors"
+  "sort"
+  "fmt"
+)
+
+// The label of the key slot created with a vault, and of the slot that holds
+// the data key of a vault created before key slots were added.
+const MasterSlotLabel = "master password"
+
+// A key slot holds a copy of the vault's data key, encrypted with a key
+// derived from a password, a key file, or both. Any slot unlocks the vault.
+type KeySlot struct {
+  ID int
+  Label string
+
+  // Whether the slot is unlocked with a password, and how its key is
+  // derived from it.
+  Password bool
+  KDF crypto.KDF
+
+  // Whether the slot requires a key file.
+  KeyFile bool
+}
+
+// The keys recovered from the key slot that unlocked a vault.
+type slotKeys struct {
+  slot Row
+  passwordKey []byte
+  keyFile []byte
+  passwordCipher *crypto.Cipher
+  key []byte
+}
+
+func selectSlots(q Reader, vault int) ([]Row, error) {
+  slots, err := q.Select("key_slots", Row { "vault": vault })
+  if err != nil {
+    return nil, err
+  }
+
+  sort.Slice(slots, func(i, j int) bool {
+    return slots[i].Int("id") < slots[j].Int("id")
+  })
+
+  return slots, nil
+}
+
+func slotHasPassword(slot Row) bool {
+  return len(slot.Bytes("password_salt")) > 0
+}
+
+// Tries each key slot in turn until one decrypts the data key. Slots that
+// need a key file are skipped if none is given, and slots that need a
+// password are skipped if the password is empty.
+func unlockSlots(slots []Row, suite string, password string, keyFile []byte) (*slotKeys, error) {
+  size, err := crypto.KeySize(suite)
+  if err != nil {
+    return nil, err
+  }
+
+  keyFileRequired := len(slots) > 0
+  passwordRequired := false
+
+  for _, slot := range slots {
+    slotKeyFile := keyFile
+    if !slot.Bool("key_file") {
+      slotKeyFile = nil
+    } else if len(keyFile) == 0 {
+      continue
+    }
+
+    keyFileRequired = false
+
+    passwordKey := make([]byte, size)
+    if slotHasPassword(slot) {
+      if password == "" {
+        passwordRequired = true
+        continue
+      }
+
+      passwordKey, err = crypto.LoadPasswordKey(password, slot.Bytes("password_salt"), rowKDF(slot), size)
+      if err != nil {
+        return nil, err
+      }
+    } else if slotKeyFile == nil {
+      continue
+    }
+
+    passwordCipher, err := crypto.NewSuiteCipher(suite, unlockKey(passwordKey, slotKeyFile))
+    if err != nil {
+      return nil, err
+    }
+
+    key, err := passwordCipher.Decrypt(slot.Bytes("encrypted_key"))
+    if err != nil {
+      continue
+    }
+
+    return &slotKeys {
+      slot: slot,
+      passwordKey: passwordKey,
+      keyFile: slotKeyFile,
+      passwordCipher: passwordCipher,
+      key: key,
+    }, nil
+  }
+
+  if keyFileRequired {
+    return nil, KeyFileRequiredError {}
+  }
+
+  if passwordRequired {
+    var e crypto.InvalidPasswordError
+    return nil, e
+  }
+
+  var e crypto.IncorrectPasswordError
+  return nil, e
+}
+
+// Returns the key slot that unlocked the vault. In databases created before
+// key slots were added, the settings hold the only slot.
+func (store *Store) slotRow(q Reader) (Row, error) {
+  if !store.slots {
+    return store.settingsRow(q)
+  }
+
+  rows, err := q.Select("key_slots", Row { "id": store.slot, "vault": store.vault })
+  if err != nil {
+    return nil, err
+  }
+
+  if len(rows) == 0 {
+    return nil, KeySlotNotFoundError { Slot: fmt.Sprint(store.slot) }
+  }
+
+  return rows[0], nil
+}
+
+// Returns an error if the key slot belongs to the recovery key or to shares,
+// which only unlock with their own random key.
+func checkSlotChangeable(slot Row) error {
+  switch label := slot.String("label"); label {
+  case RecoverySlotLabel, SharesSlotLabel:
+    return errors.New(fmt.Sprintf("The vault was unlocked with its %s, which cannot be changed.", label))
+  }
+
+  return nil
+}
+
+// Changes the key slot that unlocked the vault and updates the settings MAC,
+// which covers it.
+func (store *Store) updateSlot(tx Tx, values Row) error {
+  if !store.slots {
+    return store.updateSettings(tx, values)
+  }
+
+  if _, err := tx.Update("key_slots", Row { "id": store.slot }, values); err != nil {
+    return err
+  }
+
+  return store.resignSettings(tx)
+}
+
+func (store *Store) removeOtherSlots(tx Tx) error {
+  if !store.slots {
+    return nil
+  }
+
+  slots, err := selectSlots(tx, store.vault)
+  if err != nil {
+    return err
+  }
+
+  for _, slot := range slots {
+    if slot.Int("id") == store.slot {
+      continue
+    }
+
+    if _, err = tx.Delete("key_slots", Row { "id": slot.Int("id") }); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Extends the settings MAC of a vault upgraded from a database without key
+// slots to cover its slots, and removes the copy of the data key left in its
+// settings.
+func (store *Store) authenticateSlots() error {
+  if !store.slots || !store.bound {
+    return nil
+  }
+
+  settings, err := store.settingsRow(store.db)
+  if err != nil {
+    return dbError(err)
+  }
+
+  if settings.Bool("key_slots") {
+    return nil
+  }
+
+  return store.update(func(tx Tx) error {
+    // Another process may have converted the vault while we waited.
+    settings, err := store.settings(tx)
+    if err != nil {
+      return err
+    }
+
+    if settings.Bool("key_slots") {
+      return nil
+    }
+
+    return store.updateSettings(tx, Row { "key_slots": true, "encrypted_key": nil, "password_salt": nil })
+  })
+}
+
+// Returns the key slots of the open vault.
+func (store *Store) KeySlots() ([]KeySlot, error) {
+  if _, err := store.settings(store.db); err != nil {
+    return nil, dbError(err)
+  }
+
+  rows, err := selectSlots(store.db, store.vault)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  slots := make([]KeySlot, len(rows))
+  for i, row := range rows {
+    slots[i] = KeySlot {
+      ID: row.Int("id"),
+      Label: row.String("label"),
+      Password: slotHasPassword(row),
+      KeyFile: row.Bool("key_file"),
+    }
+
+    if slots[i].Password {
+      slots[i].KDF = rowKDF(row)
+    }
+  }
+
+  return slots, nil
+}
+
+// Returns the id of the key slot that unlocked the vault.
+func (store *Store) UnlockedSlot() int {
+  return store.slot
+}
+
+// Returns the key slot with the given label, or with the given id if no slot
+// has that label.
+func (store *Store) FindKeySlot(name string) (KeySlot, error) {
+  slots, err := store.KeySlots()
+  if err != nil {
+    return KeySlot{}, err
+  }
+
+  for _, slot := range slots {
+    if slot.Label == name {
+      return slot, nil
+    }
+  }
+
+  for _, slot := range slots {
+    if fmt.Sprint(slot.ID) == name {
+      return slot, nil
+    }
+  }
+
+  return KeySlot{}, KeySlotNotFoundError { Slot: name }
+}
+
+// Adds a key slot that unlocks the vault with a password, a key file, or
+// both. An empty password adds a slot unlocked by the key file alone. Returns
+// the id of the new slot.
+func (store *Store) AddKeySlot(label string, password string, keyFile []byte, kdf crypto.KDF) (int, error) {
+  label = strings.TrimSpace(label)
+  if label == "" || label == RecoverySlotLabel || label == SharesSlotLabel {
+    return 0, errors.New("Invalid key slot label.")
+  }
+
+  slot, err := store.newSlot(label, password, keyFile, kdf)
+  if err != nil {
+    return 0, err
+  }
+
+  var id int
+  err = store.update(func(tx Tx) error {
+    if _, err := store.settings(tx); err != nil {
+      return err
+    }
+
+    if id, err = store.insertSlot(tx, slot); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionSlot, nil)
+  })
+
+  return id, err
+}
+
+// Returns a new key slot row holding the data key, encrypted with a key
+// derived from the password and key file.
+func (store *Store) newSlot(label string, password string, keyFile []byte, kdf crypto.KDF) (Row, error) {
+  if password == "" && len(keyFile) == 0 {
+    return nil, errors.New("A key slot needs a password, a key file, or both.")
+  }
+
+  if keyFile != nil && len(keyFile) == 0 {
+    return nil, errors.New("Key file is empty.")
+  }
+
+  size, err := crypto.KeySize(store.suite)
+  if err != nil {
+    return nil, err
+  }
+
+  slot := Row {}
+  passwordKey := make([]byte, size)
+
+  if password != "" {
+    if slot, err = kdfSettings(kdf, latestVersion()); err != nil {
+      return nil, err
+    }
+
+    var passwordSalt []byte
+    if passwordKey, passwordSalt, err = crypto.NewPasswordKey(password, kdf, size); err != nil {
+      return nil, err
+    }
+
+    slot["password_salt"] = passwordSalt
+  }
+
+  passwordCipher, err := crypto.NewSuiteCipher(store.suite, unlockKey(passwordKey, keyFile))
+  if err != nil {
+    return nil, err
+  }
+
+  slot["vault"] = store.vault
+  slot["label"] = label
+  slot["key_file"] = keyFile != nil
+  slot["encrypted_key"] = passwordCipher.Encrypt(store.key)
+
+  return slot, nil
+}
+
+// Stores a new key slot, whose label must be unique within the vault.
+func (store *Store) insertSlot(tx Tx, slot Row) (int, error) {
+  slots, err := selectSlots(tx, store.vault)
+  if err != nil {
+    return 0, err
+  }
+
+  for _, existing := range slots {
+    if existing.String("label") == slot.String("label") {
+      return 0, errors.New(fmt.Sprintf("Key slot \"%s\" already exists.", slot.String("label")))
+    }
+  }
+
+  id, err := tx.Insert("key_slots", slot)
+  if err != nil {
+    return 0, err
+  }
+
+  return id, store.resignSettings(tx)
+}
+
+// Removes a key slot, so its password or key file no longer unlocks the
+// vault. The slot that unlocked the vault cannot be removed. Anyone who copied
+// the database while the slot existed can still use it on that copy; use
+// Rekey to protect newer data from them.
+func (store *Store) RemoveKeySlot(id int) error {
+  if id == store.slot {
+    return errors.New("The key slot that unlocked the vault cannot be removed.")
+  }
+
+  return store.update(func(tx Tx) error {
+    if _, err := store.settings(tx); err != nil {
+      return err
+    }
+
+    count, err := tx.Delete("key_slots", Row { "id": id, "vault": store.vault })
+    if err != nil {
+      return err
+    }
+
+    if count == 0 {
+      return KeySlotNotFoundError { Slot: fmt.Sprint(id) }
+    }
+
+    if err = store.resignSettings(tx); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionSlot, nil)
+  })
+}
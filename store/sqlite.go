@@ -0,0 +1,200 @@
+// +build !nosqlite
+
+package store
+
+import (
+  "github.com/mattn/go-sqlite3"
+  "database/sql"
+  "strings"
+  "sort"
+)
+
+// Stores tables in a SQLite database. Requires cgo.
+type sqliteBackend struct {
+  db *sql.DB
+}
+
+type sqliteTx struct {
+  tx *sql.Tx
+}
+
+type sqlQueryer interface {
+  Query(query string, args ...interface {}) (*sql.Rows, error)
+}
+
+func openSQLiteBackend(fileName string) (Backend, error) {
+  db, err := sql.Open("sqlite3", fileName)
+  if err != nil {
+    return nil, err
+  }
+
+  return &sqliteBackend { db: db }, nil
+}
+
+func (backend *sqliteBackend) Select(table string, where Row) ([]Row, error) {
+  return sqliteSelect(backend.db, table, where)
+}
+
+func (backend *sqliteBackend) Begin() (Tx, error) {
+  tx, err := backend.db.Begin()
+  if err != nil {
+    return nil, err
+  }
+
+  return &sqliteTx { tx: tx }, nil
+}
+
+func (backend *sqliteBackend) Close() error {
+  return backend.db.Close()
+}
+
+func (tx *sqliteTx) Select(table string, where Row) ([]Row, error) {
+  return sqliteSelect(tx.tx, table, where)
+}
+
+func (tx *sqliteTx) Insert(table string, row Row) (int, error) {
+  columns := sortedColumns(row)
+  placeholders := make([]string, len(columns))
+  args := make([]interface {}, len(columns))
+  for i, column := range columns {
+    placeholders[i] = "?"
+    args[i] = normalizeValue(row[column])
+  }
+
+  query := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")"
+  result, err := tx.tx.Exec(query, args...)
+  if err != nil {
+    return 0, err
+  }
+
+  id, err := result.LastInsertId()
+  return int(id), err
+}
+
+func (tx *sqliteTx) Update(table string, where Row, values Row) (int, error) {
+  columns := sortedColumns(values)
+  assignments := make([]string, len(columns))
+  args := make([]interface {}, 0, len(columns) + len(where))
+  for i, column := range columns {
+    assignments[i] = column + "=?"
+    args = append(args, normalizeValue(values[column]))
+  }
+
+  condition, whereArgs := whereClause(where)
+  result, err := tx.tx.Exec("UPDATE " + table + " SET " + strings.Join(assignments, ", ") + condition, append(args, whereArgs...)...)
+  if err != nil {
+    return 0, err
+  }
+
+  count, err := result.RowsAffected()
+  return int(count), err
+}
+
+func (tx *sqliteTx) Delete(table string, where Row) (int, error) {
+  condition, args := whereClause(where)
+  result, err := tx.tx.Exec("DELETE FROM " + table + condition, args...)
+  if err != nil {
+    return 0, err
+  }
+
+  count, err := result.RowsAffected()
+  return int(count), err
+}
+
+func (tx *sqliteTx) ExecSchema(schema string) error {
+  _, err := tx.tx.Exec(schema)
+  return err
+}
+
+func (tx *sqliteTx) Commit() error {
+  return tx.tx.Commit()
+}
+
+func (tx *sqliteTx) Rollback() error {
+  return tx.tx.Rollback()
+}
+
+func sortedColumns(row Row) []string {
+  columns := make([]string, 0, len(row))
+  for column := range row {
+    columns = append(columns, column)
+  }
+
+  sort.Strings(columns)
+  return columns
+}
+
+func whereClause(where Row) (string, []interface {}) {
+  if len(where) == 0 {
+    return "", nil
+  }
+
+  conditions := make([]string, 0, len(where))
+  args := make([]interface {}, 0, len(where))
+  for _, column := range sortedColumns(where) {
+    value := normalizeValue(where[column])
+    if value == nil {
+      conditions = append(conditions, column + " IS NULL")
+    } else {
+      conditions = append(conditions, column + "=?")
+      args = append(args, value)
+    }
+  }
+
+  return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func sqliteSelect(q sqlQueryer, table string, where Row) ([]Row, error) {
+  condition, args := whereClause(where)
+  rows, err := q.Query("SELECT * FROM " + table + condition + " ORDER BY rowid", args...)
+  if err != nil {
+    return nil, err
+  }
+
+  defer rows.Close()
+
+  columns, err := rows.Columns()
+  if err != nil {
+    return nil, err
+  }
+
+  results := make([]Row, 0)
+
+  for rows.Next() {
+    values := make([]interface {}, len(columns))
+    pointers := make([]interface {}, len(columns))
+    for i := range values {
+      pointers[i] = &values[i]
+    }
+
+    if err = rows.Scan(pointers...); err != nil {
+      return nil, err
+    }
+
+    row := make(Row, len(columns))
+    for i, column := range columns {
+      row[column] = normalizeValue(values[i])
+    }
+
+    results = append(results, row)
+  }
+
+  return results, rows.Err()
+}
+
+// Classifies errors from the SQLite driver.
+func sqliteError(err error) (error, bool) {
+  e, ok := err.(sqlite3.Error)
+  if !ok {
+    return err, false
+  }
+
+  switch e.Code {
+  case sqlite3.ErrConstraint:
+    return ConstraintError { Err: err }, true
+  case sqlite3.ErrCorrupt, sqlite3.ErrNotADB:
+    return CorruptDatabaseError { Err: err }, true
+  }
+
+  return IOError { Err: err }, true
+}
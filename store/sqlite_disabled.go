@@ -0,0 +1,17 @@
+// +build nosqlite
+
+package store
+
+import (
+  "errors"
+)
+
+// Builds with the nosqlite tag do not require cgo and only support the
+// single-file format.
+func openSQLiteBackend(fileName string) (Backend, error) {
+  return nil, errors.New("SQLite databases are not supported by this build.")
+}
+
+func sqliteError(err error) (error, bool) {
+  return err, false
+}
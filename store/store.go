@@ -2,155 +2,390 @@ package store
 
 import (
   "github.com/schmich/ward/crypto"
-  _ "github.com/mattn/go-sqlite3"
-  "database/sql"
   "strings"
   "errors"
+  "bytes"
+  "time"
   "fmt"
   "os"
 )
 
 type Store struct {
-  db *sql.DB
+  db Backend
+
+  // The database file, used to lock it against writes from other processes.
+  // Empty for backends that are not backed by a file.
+  fileName string
+  fileLock *fileLock
+  lockDepth int
+
+  vault int
+  vaultName string
+
+  // Whether the schema supports multiple vaults, i.e. settings has a vault
+  // column. False only while a database is being upgraded.
+  vaults bool
+
+  // Whether data keys are stored in key slots rather than the settings. False
+  // only while a database is being upgraded.
+  slots bool
+
+  // The key slot that unlocked the vault.
+  slot int
+
+  // Whether encrypted values are bound to where they are stored and the
+  // settings are authenticated. False for vaults that have not been
+  // converted yet.
+  bound bool
+
+  // The cipher suite of the data key and the key derived from the master
+  // password.
+  suite string
+  key []byte
+  passwordKey []byte
+
+  // The contents of the vault's key file, or nil if it does not require one.
+  keyFile []byte
+
+  // Encrypts the data key with the password key and key file.
   passwordCipher *crypto.Cipher
   keyCipher *crypto.Cipher
 }
 
 type Credential struct {
   id int
+
+  // Identifies the credential across exports, imports, and copies of the
+  // database. Assigned when the credential is added unless already set.
+  UUID string `json:"uuid"`
   Login string `json:"login"`
   Password string `json:"password"`
   Realm string `json:"realm"`
   Note string `json:"note"`
+  Tags []string `json:"tags"`
+  Fields []Field `json:"fields"`
+  Created time.Time `json:"created"`
+  Modified time.Time `json:"modified"`
+  Accessed time.Time `json:"accessed"`
+  Deleted time.Time `json:"-"`
+
+  // Whether Password and Fields have been decrypted. Searches leave them
+  // encrypted until LoadCredential is called.
+  loaded bool
 }
 
+// Opens the default vault of a credential database.
 func Open(fileName string, password string) (*Store, error) {
+  return OpenVault(fileName, DefaultVault, password)
+}
+
+// Opens a named vault of a credential database. Each vault has its own master
+// password. The database format is detected from the file header.
+func OpenVault(fileName string, vaultName string, password string) (*Store, error) {
+  return OpenVaultKeyFile(fileName, vaultName, password, nil)
+}
+
+// Opens a named vault that may require a key file in addition to its master
+// password. The key file is ignored if the vault does not require one.
+func OpenVaultKeyFile(fileName string, vaultName string, password string, keyFile []byte) (*Store, error) {
   if _, err := os.Stat(fileName); os.IsNotExist(err) {
     return nil, errors.New("Credential database does not exist.")
   }
 
-  db, err := sql.Open("sqlite3", fileName)
+  db, err := openBackend(fileName)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  store, version, err := openStore(db, vaultName, password, keyFile)
   if err != nil {
+    db.Close()
     return nil, err
   }
 
-  query := `
-    SELECT password_salt, password_stretch, password_nonce, encrypted_key, key_nonce, version
-    FROM settings
-  `
+  store.fileName = fileName
+
+  if err = store.upgrade(version); err != nil {
+    db.Close()
+    return nil, err
+  }
+
+  if err = store.bind(); err != nil {
+    db.Close()
+    return nil, err
+  }
 
-  rows, err := db.Query(query)
+  if err = store.authenticateSlots(); err != nil {
+    db.Close()
+    return nil, err
+  }
+
+  return store, nil
+}
+
+// Opens a named vault stored in an arbitrary backend, upgrading it to the
+// latest version if needed.
+func OpenBackend(db Backend, vaultName string, password string) (*Store, error) {
+  store, version, err := openStore(db, vaultName, password, nil)
   if err != nil {
     return nil, err
   }
 
-  defer rows.Close()
+  if err = store.migrate(version, latestVersion()); err != nil {
+    return nil, err
+  }
+
+  if err = store.bind(); err != nil {
+    return nil, err
+  }
+
+  if err = store.authenticateSlots(); err != nil {
+    return nil, err
+  }
+
+  return store, nil
+}
+
+func openStore(db Backend, vaultName string, password string, keyFile []byte) (*Store, int, error) {
+  version, err := readVersion(db)
+  if err != nil {
+    return nil, 0, dbError(err)
+  }
+
+  if version > latestVersion() {
+    return nil, 0, errors.New(fmt.Sprintf("Unsupported version: %d.", version))
+  }
+
+  // Databases created before vaults were added hold only the default vault.
+  where := Row {}
+  if version >= vaultsVersion {
+    where["name"] = vaultName
+  } else if vaultName != DefaultVault {
+    return nil, 0, VaultNotFoundError { Name: vaultName }
+  }
+
+  rows, err := db.Select("settings", where)
+  if err != nil {
+    return nil, 0, dbError(err)
+  }
+
+  if len(rows) == 0 {
+    return nil, 0, VaultNotFoundError { Name: vaultName }
+  }
+
+  settings := rows[0]
+
+  vault := defaultVaultId
+  if version >= vaultsVersion {
+    vault = settings.Int("vault")
+  }
+
+  // Databases created before key slots were added hold the only copy of the
+  // data key in the settings. It is moved to a slot with the id of the vault
+  // when the database is upgraded.
+  slots := []Row { settings }
+  if version >= slotsVersion {
+    if slots, err = selectSlots(db, vault); err != nil {
+      return nil, 0, dbError(err)
+    }
+  }
+
+  suite := settingsSuite(settings)
+  unlocked, err := unlockSlots(slots, suite, password, keyFile)
+  if _, ok := err.(KeyFileRequiredError); ok {
+    return nil, 0, KeyFileRequiredError { Vault: vaultName }
+  } else if err != nil {
+    return nil, 0, err
+  }
+
+  slot := vault
+  if version >= slotsVersion {
+    slot = unlocked.slot.Int("id")
+  }
+
+  keyCipher, err := crypto.NewSuiteCipher(suite, unlocked.key)
+  if err != nil {
+    return nil, 0, err
+  }
+
+  store := &Store {
+    db: db,
+    vault: vault,
+    vaultName: vaultName,
+    vaults: version >= vaultsVersion,
+    slots: version >= slotsVersion,
+    slot: slot,
+    bound: version >= associatedDataVersion && settings.Bool("associated_data"),
+    suite: suite,
+    key: unlocked.key,
+    passwordKey: unlocked.passwordKey,
+    keyFile: unlocked.keyFile,
+    passwordCipher: unlocked.passwordCipher,
+    keyCipher: keyCipher,
+  }
+
+  if err = store.verifySettings(db, settings); err != nil {
+    return nil, 0, err
+  }
 
-  rows.Next()
+  return store, version, nil
+}
 
-  var passwordSalt, passwordNonce, encryptedKey, keyNonce []byte
-  var passwordStretch, version int
-  rows.Scan(&passwordSalt, &passwordStretch, &passwordNonce, &encryptedKey, &keyNonce, &version)
+// Holds a new data key and the key derived from the master password that
+// encrypts it.
+type vaultKeys struct {
+  suite string
+  passwordSalt []byte
+  passwordKey []byte
+  keyFile []byte
+  passwordCipher *crypto.Cipher
+  key []byte
+  keyCipher *crypto.Cipher
+}
 
-  if version > 1 {
-    return nil, errors.New(fmt.Sprintf("Unsupported version: %d.", version))
+// Generates a new data key for the given cipher suite, encrypted with a key
+// derived from the master password and the key file, if any.
+func newKeys(password string, keyFile []byte, kdf crypto.KDF, suite string) (*vaultKeys, error) {
+  if keyFile != nil && len(keyFile) == 0 {
+    return nil, errors.New("Key file is empty.")
   }
 
-  if len(encryptedKey) <= 0 {
-    return nil, errors.New("Invalid encrypted key.")
+  size, err := crypto.KeySize(suite)
+  if err != nil {
+    return nil, err
   }
 
-  passwordKey, err := crypto.LoadPasswordKey(password, passwordSalt, passwordStretch)
+  passwordKey, passwordSalt, err := crypto.NewPasswordKey(password, kdf, size)
   if err != nil {
     return nil, err
   }
 
-  passwordCipher, err := crypto.LoadCipher(passwordKey, passwordNonce)
+  passwordCipher, err := crypto.NewSuiteCipher(suite, unlockKey(passwordKey, keyFile))
   if err != nil {
     return nil, err
   }
 
-  key, err := passwordCipher.TryDecrypt(encryptedKey)
+  key, err := crypto.NewSuiteKey(suite)
   if err != nil {
     return nil, err
   }
 
-  keyCipher, err := crypto.LoadCipher(key, keyNonce)
+  keyCipher, err := crypto.NewSuiteCipher(suite, key)
   if err != nil {
     return nil, err
   }
 
-  return &Store {
-    db: db,
+  return &vaultKeys {
+    suite: suite,
+    passwordSalt: passwordSalt,
+    passwordKey: passwordKey,
+    keyFile: keyFile,
     passwordCipher: passwordCipher,
+    key: key,
     keyCipher: keyCipher,
   }, nil
 }
 
-func createCipher(db *sql.DB, password string, passwordStretch int) (*crypto.Cipher, *crypto.Cipher, error) {
-  const version = 1
-
-  tx, err := db.Begin()
+// Stores the settings of a new vault and its first key slot, which holds the
+// encrypted data key and the parameters needed to derive the key that
+// decrypts it. The settings and slot are authenticated with the data key.
+// Returns the id of the slot.
+func insertSettings(tx Tx, vault int, name string, kdf crypto.KDF, keys *vaultKeys, version int) (int, error) {
+  slot, err := kdfSettings(kdf, version)
   if err != nil {
-    return nil, nil, err
+    return 0, err
   }
 
-  defer func() {
-    if err != nil {
-      tx.Rollback()
-    } else {
-      tx.Commit()
-    }
-  }()
+  slot["password_salt"] = keys.passwordSalt
+  slot["encrypted_key"] = keys.passwordCipher.Encrypt(keys.key)
 
-  passwordKey, passwordSalt, err := crypto.NewPasswordKey(password, passwordStretch)
-  if err != nil {
-    return nil, nil, err
+  if version >= keyFilesVersion {
+    slot["key_file"] = keys.keyFile != nil
+  } else if keys.keyFile != nil {
+    return 0, errors.New("This database version does not support key files.")
   }
 
-  passwordCipher, err := crypto.NewCipher(passwordKey)
-  if err != nil {
-    return nil, nil, err
+  settings := Row { "version": version }
+  where := Row {}
+
+  if version >= suitesVersion {
+    settings["cipher_suite"] = keys.suite
+  } else if keys.suite != crypto.SuiteAES128GCM {
+    return 0, errors.New("This database version only supports AES-128-GCM.")
   }
 
-  key := crypto.NewKey()
-  keyCipher, err := crypto.NewCipher(key)
-  if err != nil {
-    return nil, nil, err
+  if version >= vaultsVersion {
+    settings["vault"] = vault
+    settings["name"] = name
+    where["vault"] = vault
   }
 
-  insert, err := tx.Prepare(`
-    INSERT INTO settings (password_salt, password_stretch, password_nonce, encrypted_key, key_nonce, version)
-    VALUES (?, ?, ?, ?, ?, ?)
-  `)
+  id := vault
+  if version >= slotsVersion {
+    slot["vault"] = vault
+    slot["label"] = MasterSlotLabel
+    if id, err = tx.Insert("key_slots", slot); err != nil {
+      return 0, err
+    }
 
-  if err != nil {
-    return nil, nil, err
+    settings["key_slots"] = true
+  } else {
+    for column, value := range slot {
+      settings[column] = value
+    }
+  }
+
+  if version >= associatedDataVersion {
+    settings["associated_data"] = true
+  }
+
+  if _, err = tx.Insert("settings", settings); err != nil {
+    return 0, err
+  }
+
+  if version >= associatedDataVersion {
+    if err = signSettings(tx, keys.key, where); err != nil {
+      return 0, err
+    }
   }
 
-  defer insert.Close()
+  return id, nil
+}
+
+// Creates a SQLite credential database. The master password is turned into a
+// key with the given key derivation function.
+func Create(fileName string, password string, kdf crypto.KDF) (*Store, error) {
+  return CreateFormat(fileName, password, kdf, FormatSQLite)
+}
+
+// Creates a credential database in the given format.
+func CreateFormat(fileName string, password string, kdf crypto.KDF, format Format) (*Store, error) {
+  return create(fileName, password, nil, kdf, format, latestVersion())
+}
 
-  encryptedKey := passwordCipher.Encrypt(key)
+// Creates a credential database whose default vault requires the contents of
+// a key file in addition to the master password.
+func CreateKeyFile(fileName string, password string, keyFile []byte, kdf crypto.KDF, format Format) (*Store, error) {
+  if len(keyFile) == 0 {
+    return nil, errors.New("Key file is empty.")
+  }
 
-  insert.Exec(
-    passwordSalt,
-    passwordStretch,
-    passwordCipher.GetNonce(),
-    encryptedKey,
-    keyCipher.GetNonce(),
-    version)
+  return create(fileName, password, keyFile, kdf, format, latestVersion())
+}
 
-  return passwordCipher, keyCipher, nil
+// Creates a credential database in an arbitrary backend.
+func CreateBackend(db Backend, password string, kdf crypto.KDF) (*Store, error) {
+  return createStore(db, "", password, nil, kdf, latestVersion())
 }
 
-func Create(fileName string, password string, passwordStretch int) (*Store, error) {
+func create(fileName string, password string, keyFile []byte, kdf crypto.KDF, format Format, version int) (store *Store, err error) {
   if _, err := os.Stat(fileName); err == nil {
     return nil, errors.New("Credential database already exists.")
   }
 
-  db, err := sql.Open("sqlite3", fileName)
+  db, err := createBackend(fileName, format)
   if err != nil {
-    return nil, err
+    return nil, dbError(err)
   }
 
   defer func() {
@@ -160,7 +395,47 @@ func Create(fileName string, password string, passwordStretch int) (*Store, erro
     }
   }()
 
-  create := `
+  // Databases in memory are not shared with other processes.
+  lockName := fileName
+  if fileName == ":memory:" {
+    lockName = ""
+  }
+
+  return createStore(db, lockName, password, keyFile, kdf, version)
+}
+
+func createStore(db Backend, fileName string, password string, keyFile []byte, kdf crypto.KDF, version int) (*Store, error) {
+  // Databases at versions from before cipher suites were stored can only be
+  // created by tests.
+  suite := crypto.DefaultSuite
+  if version < suitesVersion {
+    suite = crypto.SuiteAES128GCM
+  }
+
+  keys, err := newKeys(password, keyFile, kdf, suite)
+  if err != nil {
+    return nil, err
+  }
+
+  store := &Store {
+    db: db,
+    fileName: fileName,
+    vault: defaultVaultId,
+    vaultName: DefaultVault,
+    vaults: version >= vaultsVersion,
+    slots: version >= slotsVersion,
+    bound: version >= associatedDataVersion,
+    suite: suite,
+    key: keys.key,
+    passwordKey: keys.passwordKey,
+    keyFile: keys.keyFile,
+    passwordCipher: keys.passwordCipher,
+    keyCipher: keys.keyCipher,
+  }
+
+  // The nonce columns held nonce counters before nonces were randomized and
+  // are no longer used.
+  schema := `
     CREATE TABLE credentials (
       id INTEGER NOT NULL PRIMARY KEY,
       login BLOB,
@@ -177,134 +452,424 @@ func Create(fileName string, password string, passwordStretch int) (*Store, erro
       key_nonce BLOB,
       version INTEGER
     );
-	`
+  `
+
+  err = store.transact(func(tx Tx) error {
+    if err := tx.ExecSchema(schema); err != nil {
+      return err
+    }
+
+    if err := store.applyMigrations(tx, baseVersion, version); err != nil {
+      return err
+    }
+
+    store.slot, err = insertSettings(tx, defaultVaultId, DefaultVault, kdf, keys, version)
+    return err
+  })
 
-  _, err = db.Exec(create)
   if err != nil {
     return nil, err
   }
 
-  passwordCipher, keyCipher, err := createCipher(db, password, passwordStretch)
+  return store, nil
+}
+
+// Identifies the settings row of the open vault.
+func (store *Store) settingsWhere() Row {
+  if !store.vaults {
+    return Row {}
+  }
+
+  return Row { "vault": store.vault }
+}
+
+// Returns the settings of this vault after checking their MAC.
+func (store *Store) settings(q Reader) (Row, error) {
+  settings, err := store.settingsRow(q)
   if err != nil {
     return nil, err
   }
 
-  return &Store {
-    db: db,
-    passwordCipher: passwordCipher,
-    keyCipher: keyCipher,
-  }, nil
+  if err = store.verifySettings(q, settings); err != nil {
+    return nil, err
+  }
+
+  return settings, nil
 }
 
-func (store *Store) updateNonce(passwordNonce, keyNonce []byte, tx *sql.Tx) error {
-  update, err := tx.Prepare("UPDATE settings SET password_nonce=?, key_nonce=?")
+func (store *Store) settingsRow(q Reader) (Row, error) {
+  rows, err := q.Select("settings", store.settingsWhere())
   if err != nil {
-    return err
+    return nil, err
   }
 
-  defer update.Close()
+  if len(rows) == 0 {
+    return nil, errors.New("Invalid settings.")
+  }
+
+  return rows[0], nil
+}
+
+// Another process may have changed the master password or the data key since
+// the database was opened. Writing with the old key would make the new data
+// unreadable, so the stored key must still match.
+func (store *Store) checkKey(tx Tx) error {
+  changed := errors.New("The database key was changed by another process. Open the database again.")
+
+  slot, err := store.slotRow(tx)
+  if _, ok := err.(KeySlotNotFoundError); ok {
+    return changed
+  } else if err != nil {
+    return err
+  }
 
-  update.Exec(passwordNonce, keyNonce)
+  key, err := store.passwordCipher.Decrypt(slot.Bytes("encrypted_key"))
+  if err != nil || !bytes.Equal(key, store.key) {
+    return changed
+  }
 
   return nil
 }
 
-func (store *Store) update(updateFn func(*sql.Tx) error) error {
-  tx, err := store.db.Begin()
+// Applies changes in a single transaction while holding the database lock.
+func (store *Store) update(updateFn func(Tx) error) error {
+  return store.transact(func(tx Tx) error {
+    if err := store.checkKey(tx); err != nil {
+      return err
+    }
+
+    if _, err := store.settings(tx); err != nil {
+      return err
+    }
+
+    return updateFn(tx)
+  })
+}
+
+// Like update, but without checking the stored key, which does not exist yet
+// while a database is being created.
+func (store *Store) transact(updateFn func(Tx) error) (err error) {
+  unlock, err := store.lock()
   if err != nil {
     return err
   }
 
+  defer unlock()
+
+  tx, err := store.db.Begin()
+  if err != nil {
+    return dbError(err)
+  }
+
   defer func() {
     if err != nil {
       tx.Rollback()
     } else {
-      tx.Commit()
+      err = dbError(tx.Commit())
     }
   }()
 
-  if err = updateFn(tx); err != nil {
-    return err
-  }
+  return dbError(updateFn(tx))
+}
+
+// Timestamps are stored with one second precision.
+func now() time.Time {
+  return time.Now().UTC().Truncate(time.Second)
+}
 
-  return store.updateNonce(
-    store.passwordCipher.GetNonce(),
-    store.keyCipher.GetNonce(),
-    tx)
+// Adds a new credential. The UUID is generated, and Created and Modified are
+// set to the current time, unless already set, e.g. by import. A given UUID
+// that already exists in the vault is a DuplicateCredentialError. A credential that was
+// already added is stored again as a copy with a new UUID.
+func (store *Store) AddCredential(credential *Credential) error {
+  return store.ImportCredential(credential, nil)
 }
 
-func (store *Store) AddCredential(credential *Credential) {
-  store.update(func(tx *sql.Tx) error {
-    insert, err := tx.Prepare(`
-      INSERT INTO credentials (login, password, realm, note)
-      VALUES (?, ?, ?, ?)
-    `)
+// Adds a new credential along with its attachments, e.g. from an export.
+// Unlike AddAttachment, the attachments do not change the credential's
+// modified time.
+func (store *Store) ImportCredential(credential *Credential, attachments []*Attachment) error {
+  for _, attachment := range attachments {
+    if err := validateAttachment(attachment); err != nil {
+      return err
+    }
+  }
+
+  uuid := newUUID()
+  if credential.UUID != "" && credential.id == 0 {
+    var err error
+    if uuid, err = parseUUID(credential.UUID); err != nil {
+      return err
+    }
+  }
+
+  if credential.Created.IsZero() {
+    credential.Created = now()
+  }
+
+  if credential.Modified.IsZero() {
+    credential.Modified = credential.Created
+  }
 
+  return store.update(func(tx Tx) error {
+    existing, err := tx.Select("credentials", Row { "vault": store.vault, "uuid": uuid })
     if err != nil {
       return err
     }
 
-    defer insert.Close()
+    if len(existing) > 0 {
+      return DuplicateCredentialError { UUID: uuid }
+    }
 
-    insert.Exec(
-      store.keyCipher.Encrypt([]byte(credential.Login)),
-      store.keyCipher.Encrypt([]byte(credential.Password)),
-      store.keyCipher.Encrypt([]byte(credential.Realm)),
-      store.keyCipher.Encrypt([]byte(credential.Note)),
-    )
+    id, err := tx.Insert("credentials", Row {
+      "vault": store.vault,
+      "uuid": uuid,
+      "login": store.sealString("credentials", "login", uuid, credential.Login),
+      "password": store.sealString("credentials", "password", uuid, credential.Password),
+      "realm": store.sealString("credentials", "realm", uuid, credential.Realm),
+      "note": store.sealString("credentials", "note", uuid, credential.Note),
+      "created": store.encryptTime("credentials", "created", uuid, credential.Created),
+      "modified": store.encryptTime("credentials", "modified", uuid, credential.Modified),
+      "accessed": store.encryptTime("credentials", "accessed", uuid, credential.Accessed),
+    })
 
-    return nil
+    if err != nil {
+      return err
+    }
+
+    credential.id = id
+    credential.UUID = uuid
+    credential.loaded = true
+
+    if err = store.saveTags(tx, credential); err != nil {
+      return err
+    }
+
+    if err = store.saveFields(tx, credential, uuid); err != nil {
+      return err
+    }
+
+    if err = store.indexCredential(tx, credential); err != nil {
+      return err
+    }
+
+    for _, attachment := range attachments {
+      if err = store.insertAttachment(tx, id, uuid, attachment); err != nil {
+        return err
+      }
+    }
+
+    return store.audit(tx, ActionAdd, credential)
   })
 }
 
-func (store *Store) eachCredential() chan *Credential {
-  yield := make(chan *Credential)
+// Iterates over active credentials, or over credentials in the trash. The
+// password and fields are only decrypted when secrets is set.
+func (store *Store) eachCredential(trashed bool, secrets bool, credentialFn func(*Credential) error) error {
+  rows, err := store.db.Select("credentials", Row { "vault": store.vault })
+  if err != nil {
+    return dbError(err)
+  }
+
+  matching := make([]Row, 0, len(rows))
+  for _, row := range rows {
+    if row.IsNull("deleted") != trashed {
+      matching = append(matching, row)
+    }
+  }
+
+  return store.decryptCredentials(store.db, matching, secrets, credentialFn)
+}
+
+// Decrypts credential rows from this vault, reading their tags and fields
+// with q.
+func (store *Store) decryptCredentials(q Reader, rows []Row, secrets bool, credentialFn func(*Credential) error) error {
+  credentialTags, err := store.loadCredentialTags(q)
+  if err != nil {
+    return dbError(err)
+  }
 
-  go func() {
-    defer close(yield)
+  var credentialFields map[int][]Field
+  if secrets {
+    if credentialFields, err = store.loadCredentialFields(q); err != nil {
+      return dbError(err)
+    }
+  }
 
-    rows, err := store.db.Query(`
-      SELECT id, login, password, realm, note
-      FROM credentials
-    `)
+  for _, row := range rows {
+    id := row.Int("id")
+    uuid := row.String("uuid")
 
-    if err != nil {
-      panic(err)
+    decrypt := func(column string) (string, error) {
+      return store.decrypt(id, "credentials", column, uuid, row.Bytes(column))
+    }
+
+    decryptTime := func(column string) (time.Time, error) {
+      return store.decryptTime(id, "credentials", column, uuid, row.Bytes(column))
+    }
+
+    credential := &Credential {
+      id: id,
+      UUID: uuid,
+      Tags: credentialTags[id],
+    }
+
+    if credential.Tags == nil {
+      credential.Tags = []string{}
+    }
+
+    if credential.Login, err = decrypt("login"); err != nil {
+      return err
+    }
+
+    if credential.Realm, err = decrypt("realm"); err != nil {
+      return err
+    }
+
+    if credential.Note, err = decrypt("note"); err != nil {
+      return err
+    }
+
+    if credential.Created, err = decryptTime("created"); err != nil {
+      return err
+    }
+
+    if credential.Modified, err = decryptTime("modified"); err != nil {
+      return err
+    }
+
+    if credential.Accessed, err = decryptTime("accessed"); err != nil {
+      return err
     }
 
-    defer rows.Close()
+    if credential.Deleted, err = decryptTime("deleted"); err != nil {
+      return err
+    }
 
-    for rows.Next() {
-      var id int
-      var cipherLogin, cipherPassword, cipherRealm, cipherNote []byte
-      rows.Scan(&id, &cipherLogin, &cipherPassword, &cipherRealm, &cipherNote)
+    if secrets {
+      if credential.Password, err = decrypt("password"); err != nil {
+        return err
+      }
 
-      credential := &Credential {
-        id: id,
-        Login: string(store.keyCipher.Decrypt(cipherLogin)),
-        Password: string(store.keyCipher.Decrypt(cipherPassword)),
-        Realm: string(store.keyCipher.Decrypt(cipherRealm)),
-        Note: string(store.keyCipher.Decrypt(cipherNote)),
+      credential.Fields = credentialFields[id]
+      if credential.Fields == nil {
+        credential.Fields = []Field{}
       }
 
-      yield <- credential
+      credential.loaded = true
     }
-  }()
 
-  return yield
+    if err = credentialFn(credential); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// Returns the stored row of a credential in this vault.
+func (store *Store) credentialRow(q Reader, id int) (Row, error) {
+  rows, err := q.Select("credentials", Row { "id": id, "vault": store.vault })
+  if err != nil {
+    return nil, err
+  }
+
+  if len(rows) == 0 {
+    return nil, NotFoundError { ID: id }
+  }
+
+  return rows[0], nil
+}
+
+// Returns the UUIDs of the credentials in this vault by ID.
+func (store *Store) credentialUUIDs(q Reader) (map[int]string, error) {
+  rows, err := q.Select("credentials", Row { "vault": store.vault })
+  if err != nil {
+    return nil, err
+  }
+
+  uuids := make(map[int]string, len(rows))
+  for _, row := range rows {
+    uuids[row.Int("id")] = row.String("uuid")
+  }
+
+  return uuids, nil
+}
+
+// Returns the stored UUID of a credential, which its values are bound to.
+func (store *Store) credentialUUID(q Reader, credential *Credential) (string, error) {
+  row, err := store.credentialRow(q, credential.id)
+  if err != nil {
+    return "", err
+  }
+
+  return row.String("uuid"), nil
+}
+
+// Decrypts the password and fields of a credential returned by a search.
+// Credentials must be loaded before they are updated.
+func (store *Store) LoadCredential(credential *Credential) error {
+  if credential.id == 0 {
+    panic("Invalid credential ID.")
+  }
+
+  if credential.loaded {
+    return nil
+  }
+
+  row, err := store.credentialRow(store.db, credential.id)
+  if err != nil {
+    return dbError(err)
+  }
+
+  uuid := row.String("uuid")
+
+  password, err := store.decrypt(credential.id, "credentials", "password", uuid, row.Bytes("password"))
+  if err != nil {
+    return err
+  }
+
+  fields, err := store.loadFields(store.db, credential.id, uuid)
+  if err != nil {
+    return dbError(err)
+  }
+
+  credential.Password = password
+  credential.Fields = fields
+  credential.loaded = true
+
+  return nil
+}
+
+// Returns all active credentials with their passwords and fields decrypted,
+// e.g. for export.
+func (store *Store) AllCredentials() ([]*Credential, error) {
+  return store.allCredentials(false, true)
 }
 
-func (store *Store) AllCredentials() []*Credential {
+func (store *Store) allCredentials(trashed bool, secrets bool) ([]*Credential, error) {
   credentials := make([]*Credential, 0)
 
-  for credential := range store.eachCredential() {
+  err := store.eachCredential(trashed, secrets, func(credential *Credential) error {
     credentials = append(credentials, credential)
+    return nil
+  })
+
+  if err != nil {
+    return nil, err
   }
 
-  return credentials
+  return credentials, nil
+}
+
+// Returns active credentials whose login, realm, or note contain every query
+// string, ignoring case. Passwords and fields are not decrypted; use
+// LoadCredential on the credential that is selected.
+func (store *Store) FindCredentials(query []string) ([]*Credential, error) {
+  return store.findCredentials(query, false)
 }
 
-func (store *Store) FindCredentials(query []string) []*Credential {
+func (store *Store) findCredentials(query []string, trashed bool) ([]*Credential, error) {
   matches := make([]*Credential, 0)
 
   patterns := make([]string, len(query))
@@ -312,7 +877,7 @@ func (store *Store) FindCredentials(query []string) []*Credential {
     patterns[i] = strings.ToLower(queryString)
   }
 
-  for credential := range store.eachCredential() {
+  err := store.eachCredential(trashed, false, func(credential *Credential) error {
     valid := true
     llogin := strings.ToLower(credential.Login)
     lrealm := strings.ToLower(credential.Realm)
@@ -326,110 +891,216 @@ func (store *Store) FindCredentials(query []string) []*Credential {
     if (valid) {
       matches = append(matches, credential)
     }
+    return nil
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  return matches, nil
+}
+
+func checkAffected(count int, id int) error {
+  if count == 0 {
+    return NotFoundError { ID: id }
   }
 
-  return matches
+  return nil
+}
+
+// Identifies an active credential in this vault.
+func (store *Store) activeWhere(credential *Credential) Row {
+  return Row {
+    "id": credential.id,
+    "vault": store.vault,
+    "deleted": nil,
+  }
 }
 
-func (store *Store) UpdateCredential(credential *Credential) {
+// Saves changes to a credential and sets Modified to the current time. If the
+// password changed, the previous password is saved to the history.
+func (store *Store) UpdateCredential(credential *Credential) error {
   if credential.id == 0 {
     panic("Invalid credential ID.")
   }
 
-  store.update(func(tx *sql.Tx) error {
-    update, err := tx.Prepare(`
-      UPDATE credentials
-      SET login=?, password=?, realm=?, note=?
-      WHERE id=?
-    `)
+  if !credential.loaded {
+    panic("Credential not loaded.")
+  }
+
+  credential.Modified = now()
 
+  return store.update(func(tx Tx) error {
+    uuid, err := store.credentialUUID(tx, credential)
     if err != nil {
       return err
     }
 
-    defer update.Close()
+    if err = store.recordHistory(tx, credential, credential.Modified); err != nil {
+      return err
+    }
 
-    update.Exec(
-      store.keyCipher.Encrypt([]byte(credential.Login)),
-      store.keyCipher.Encrypt([]byte(credential.Password)),
-      store.keyCipher.Encrypt([]byte(credential.Realm)),
-      store.keyCipher.Encrypt([]byte(credential.Note)),
-      credential.id,
-    )
+    count, err := tx.Update("credentials", store.activeWhere(credential), Row {
+      "login": store.sealString("credentials", "login", uuid, credential.Login),
+      "password": store.sealString("credentials", "password", uuid, credential.Password),
+      "realm": store.sealString("credentials", "realm", uuid, credential.Realm),
+      "note": store.sealString("credentials", "note", uuid, credential.Note),
+      "modified": store.encryptTime("credentials", "modified", uuid, credential.Modified),
+    })
 
-    return nil
+    if err != nil {
+      return err
+    }
+
+    if err = checkAffected(count, credential.id); err != nil {
+      return err
+    }
+
+    if err = store.saveTags(tx, credential); err != nil {
+      return err
+    }
+
+    if err = store.saveFields(tx, credential, uuid); err != nil {
+      return err
+    }
+
+    if err = store.indexCredential(tx, credential); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionEdit, credential)
   })
 }
 
-func (store *Store) DeleteCredential(credential *Credential) {
+// Records that a credential's password was used, e.g. copied.
+func (store *Store) TouchCredential(credential *Credential) error {
   if credential.id == 0 {
     panic("Invalid credential ID.")
   }
 
-  store.update(func(tx *sql.Tx) error {
-    delete, err := tx.Prepare("DELETE FROM credentials WHERE id=?")
+  credential.Accessed = now()
+
+  return store.update(func(tx Tx) error {
+    uuid, err := store.credentialUUID(tx, credential)
     if err != nil {
       return err
     }
 
-    defer delete.Close()
+    count, err := tx.Update("credentials", store.activeWhere(credential), Row {
+      "accessed": store.encryptTime("credentials", "accessed", uuid, credential.Accessed),
+    })
+
+    if err != nil {
+      return err
+    }
 
-    delete.Exec(credential.id)
+    if err = checkAffected(count, credential.id); err != nil {
+      return err
+    }
 
-    return nil
+    return store.audit(tx, ActionAccess, credential)
   })
 }
 
-func (store *Store) UpdateMasterPassword(password string, passwordStretch int) error {
-  return store.update(func(tx *sql.Tx) error {
-    query := "SELECT encrypted_key FROM settings"
+// Moves a credential to the trash. Trashed credentials are hidden until they
+// are restored or permanently deleted.
+func (store *Store) DeleteCredential(credential *Credential) error {
+  if credential.id == 0 {
+    panic("Invalid credential ID.")
+  }
+
+  deleted := now()
+
+  err := store.update(func(tx Tx) error {
+    uuid, err := store.credentialUUID(tx, credential)
+    if err != nil {
+      return err
+    }
+
+    count, err := tx.Update("credentials", store.activeWhere(credential), Row {
+      "deleted": store.encryptTime("credentials", "deleted", uuid, deleted),
+    })
 
-    rows, err := tx.Query(query)
     if err != nil {
       return err
     }
 
-    defer rows.Close()
-    rows.Next()
+    if err = checkAffected(count, credential.id); err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionDelete, credential)
+  })
 
-    var encryptedKey []byte
-    rows.Scan(&encryptedKey)
+  if err == nil {
+    credential.Deleted = deleted
+  }
 
-    key := store.passwordCipher.Decrypt(encryptedKey)
+  return err
+}
 
-    passwordKey, passwordSalt, err := crypto.NewPasswordKey(password, passwordStretch)
-    if err != nil {
+// Changes the master password of the open vault and the key derivation
+// function used to turn it into a key.
+func (store *Store) UpdateMasterPassword(password string, kdf crypto.KDF) error {
+  size, err := crypto.KeySize(store.suite)
+  if err != nil {
+    return err
+  }
+
+  // Key derivation can take seconds, so it is done before taking the lock.
+  passwordKey, passwordSalt, err := crypto.NewPasswordKey(password, kdf, size)
+  if err != nil {
+    return err
+  }
+
+  passwordCipher, err := crypto.NewSuiteCipher(store.suite, unlockKey(passwordKey, store.keyFile))
+  if err != nil {
+    return err
+  }
+
+  err = store.update(func(tx Tx) error {
+    if _, err := store.settings(tx); err != nil {
       return err
     }
 
-    passwordCipher, err := crypto.NewCipher(passwordKey)
+    slot, err := store.slotRow(tx)
     if err != nil {
       return err
     }
 
-    update, err := tx.Prepare(`
-      UPDATE settings
-      SET password_salt=?, password_stretch=?, password_nonce=?, encrypted_key=?
-    `)
+    if err = checkSlotChangeable(slot); err != nil {
+      return err
+    }
 
+    version, err := readVersion(tx)
     if err != nil {
       return err
     }
 
-    defer update.Close()
+    values, err := kdfSettings(kdf, version)
+    if err != nil {
+      return err
+    }
 
-    update.Exec(
-      passwordSalt,
-      passwordStretch,
-      passwordCipher.GetNonce(),
-      passwordCipher.Encrypt(key))
+    values["password_salt"] = passwordSalt
+    values["encrypted_key"] = passwordCipher.Encrypt(store.key)
 
-    store.passwordCipher = passwordCipher
+    if err = store.updateSlot(tx, values); err != nil {
+      return err
+    }
 
-    return nil
+    return store.audit(tx, ActionMaster, nil)
   })
+
+  if err != nil {
+    return err
+  }
+
+  store.passwordKey, store.passwordCipher = passwordKey, passwordCipher
+  return nil
 }
 
-func (store *Store) Close() {
-  store.db.Close()
+func (store *Store) Close() error {
+  return dbError(store.db.Close())
 }
@@ -3,10 +3,18 @@ package store_test
 import (
   "testing"
   "github.com/schmich/ward/store"
+  "github.com/schmich/ward/crypto"
   . "gopkg.in/check.v1"
+  _ "github.com/mattn/go-sqlite3"
+  "database/sql"
   "path/filepath"
   "strconv"
+  "strings"
+  "errors"
+  "fmt"
   "io/ioutil"
+  "sync/atomic"
+  "time"
   "os"
 )
 
@@ -14,28 +22,58 @@ func Test(t *testing.T) {
   TestingT(t)
 }
 
+// The suite runs against each storage format. The single-file format uses an
+// in-memory backend for ":memory:".
 type StoreSuite struct {
+  format store.Format
 }
 
-var _ = Suite(&StoreSuite{})
+var _ = Suite(&StoreSuite { format: store.FormatSQLite })
+var _ = Suite(&StoreSuite { format: store.FormatFile })
+
+func (s *StoreSuite) create(fileName string, password string, passwordStretch int) (*store.Store, error) {
+  return store.CreateFormat(fileName, password, crypto.PBKDF2Params(passwordStretch), s.format)
+}
+
+// Skips tests that modify the database with SQL.
+func (s *StoreSuite) requireSQLite(c *C) {
+  if s.format != store.FormatSQLite {
+    c.Skip("requires SQLite")
+  }
+}
 
 func (s *StoreSuite) TestCreate(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
+  db, _ := s.create(":memory:", "pass", 1)
   c.Assert(db, NotNil)
-  db, _ = store.Create(":memory:", "pass", 500)
+  db, _ = s.create(":memory:", "pass", 500)
   c.Assert(db, NotNil)
-  db, _ = store.Create(":memory:", "", 1)
+  db, _ = s.create(":memory:", "", 1)
   c.Assert(db, IsNil)
-  db, _ = store.Create(":memory:", "pass", 0)
+  db, _ = s.create(":memory:", "pass", 0)
   c.Assert(db, IsNil)
 }
 
 func (s *StoreSuite) TestEmptyAllCredentials(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
-  credentials := db.AllCredentials()
+  db, _ := s.create(":memory:", "pass", 1)
+  credentials := allCredentials(c, db)
   c.Assert(len(credentials), Equals, 0)
 }
 
+func allCredentials(c *C, db *store.Store) []*store.Credential {
+  credentials, err := db.AllCredentials()
+  c.Assert(err, IsNil)
+  return credentials
+}
+
+func findCredentials(c *C, db *store.Store, query []string) []*store.Credential {
+  credentials, err := db.FindCredentials(query)
+  c.Assert(err, IsNil)
+  for _, credential := range credentials {
+    c.Assert(db.LoadCredential(credential), IsNil)
+  }
+  return credentials
+}
+
 func assertCredentialsEqual(c *C, p *store.Credential, q *store.Credential) {
   c.Assert(p.Login, Equals, q.Login)
   c.Assert(p.Password, Equals, q.Password)
@@ -44,21 +82,21 @@ func assertCredentialsEqual(c *C, p *store.Credential, q *store.Credential) {
 }
 
 func (s *StoreSuite) TestAddCredential(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
+  db, _ := s.create(":memory:", "pass", 1)
   credential := &store.Credential {
     Login: "login",
     Password: "password",
     Realm: "realm",
     Note: "note",
   }
-  db.AddCredential(credential)
-  credentials := db.AllCredentials()
+  c.Assert(db.AddCredential(credential), IsNil)
+  credentials := allCredentials(c, db)
   c.Assert(len(credentials), Equals, 1)
   assertCredentialsEqual(c, credentials[0], credential)
 }
 
 func (s *StoreSuite) TestAddManyCredentials(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
+  db, _ := s.create(":memory:", "pass", 1)
   credential := &store.Credential {
     Login: "login",
     Password: "password",
@@ -66,14 +104,14 @@ func (s *StoreSuite) TestAddManyCredentials(c *C) {
     Note: "note",
   }
   for i := 0; i < 1000; i++ {
-    db.AddCredential(credential)
+    c.Assert(db.AddCredential(credential), IsNil)
   }
-  credentials := db.AllCredentials()
+  credentials := allCredentials(c, db)
   c.Assert(len(credentials), Equals, 1000)
 }
 
 func (s *StoreSuite) TestFindCredentials(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
+  db, _ := s.create(":memory:", "pass", 1)
   foo := &store.Credential {
     Login: "foo",
     Password: "waldo",
@@ -86,15 +124,15 @@ func (s *StoreSuite) TestFindCredentials(c *C) {
     Realm: "shared",
     Note: "wsad",
   }
-  db.AddCredential(foo)
-  db.AddCredential(bar)
-  found := db.FindCredentials([]string { "foo" })
+  c.Assert(db.AddCredential(foo), IsNil)
+  c.Assert(db.AddCredential(bar), IsNil)
+  found := findCredentials(c, db, []string { "foo" })
   c.Assert(len(found), Equals, 1)
   assertCredentialsEqual(c, found[0], foo)
-  found = db.FindCredentials([]string { "bar" })
+  found = findCredentials(c, db, []string { "bar" })
   c.Assert(len(found), Equals, 1)
   assertCredentialsEqual(c, found[0], bar)
-  found = db.FindCredentials([]string { "shared" })
+  found = findCredentials(c, db, []string { "shared" })
   c.Assert(len(found), Equals, 2)
   if found[0].Login == foo.Login {
     assertCredentialsEqual(c, found[0], foo)
@@ -103,55 +141,83 @@ func (s *StoreSuite) TestFindCredentials(c *C) {
     assertCredentialsEqual(c, found[0], bar)
     assertCredentialsEqual(c, found[1], foo)
   }
-  found = db.FindCredentials([]string { "bar", "shared" })
+  found = findCredentials(c, db, []string { "bar", "shared" })
   c.Assert(len(found), Equals, 1)
   assertCredentialsEqual(c, found[0], bar)
-  found = db.FindCredentials([]string { "waldo" })
+  found = findCredentials(c, db, []string { "waldo" })
   c.Assert(len(found), Equals, 0)
-  found = db.FindCredentials([]string { "wsad" })
+  found = findCredentials(c, db, []string { "wsad" })
   c.Assert(len(found), Equals, 1)
   assertCredentialsEqual(c, found[0], bar)
-  found = db.FindCredentials([]string { "bar", "shared", "wsad" })
+  found = findCredentials(c, db, []string { "bar", "shared", "wsad" })
   c.Assert(len(found), Equals, 1)
   assertCredentialsEqual(c, found[0], bar)
-  found = db.FindCredentials([]string { "oo", "uu" })
+  found = findCredentials(c, db, []string { "oo", "uu" })
   c.Assert(len(found), Equals, 1)
   assertCredentialsEqual(c, found[0], foo)
 }
 
 func (s *StoreSuite) TestUpdateCredential(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
+  db, _ := s.create(":memory:", "pass", 1)
   foo := &store.Credential {
     Login: "foo",
     Password: "bar",
     Realm: "baz",
     Note: "quux",
   }
-  db.AddCredential(foo)
-  updated := db.AllCredentials()[0]
+  c.Assert(db.AddCredential(foo), IsNil)
+  updated := allCredentials(c, db)[0]
   updated.Login = "updated"
-  db.UpdateCredential(updated)
-  credentials := db.AllCredentials()
+  c.Assert(db.UpdateCredential(updated), IsNil)
+  credentials := allCredentials(c, db)
   c.Assert(len(credentials), Equals, 1)
   new := credentials[0]
   assertCredentialsEqual(c, new, updated)
 }
 
 func (s *StoreSuite) TestDeleteCredential(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
+  db, _ := s.create(":memory:", "pass", 1)
   foo := &store.Credential {
     Login: "foo",
     Password: "bar",
     Realm: "baz",
     Note: "quux",
   }
-  db.AddCredential(foo)
-  foo = db.AllCredentials()[0]
-  db.DeleteCredential(foo)
-  credentials := db.AllCredentials()
+  c.Assert(db.AddCredential(foo), IsNil)
+  foo = allCredentials(c, db)[0]
+  c.Assert(db.DeleteCredential(foo), IsNil)
+  credentials := allCredentials(c, db)
   c.Assert(len(credentials), Equals, 0)
 }
 
+func (s *StoreSuite) TestUpdateDeletedCredential(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+  foo := allCredentials(c, db)[0]
+  c.Assert(db.DeleteCredential(foo), IsNil)
+  err := db.UpdateCredential(foo)
+  c.Assert(err, FitsTypeOf, store.NotFoundError{})
+  err = db.DeleteCredential(foo)
+  c.Assert(err, FitsTypeOf, store.NotFoundError{})
+}
+
+func (s *StoreSuite) TestCorruptCredential(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  db.Close()
+  raw, _ := sql.Open("sqlite3", fileName)
+  _, err := raw.Exec("UPDATE credentials SET password=x'00010203040506070809'")
+  c.Assert(err, IsNil)
+  raw.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  credentials, err := db.AllCredentials()
+  c.Assert(credentials, IsNil)
+  c.Assert(err, FitsTypeOf, store.CorruptCredentialError{})
+}
+
 func tempFileName() string {
   tempDir, _ := ioutil.TempDir(os.TempDir(), "ward")
   return filepath.Join(tempDir, "ward")
@@ -159,7 +225,7 @@ func tempFileName() string {
 
 func (s *StoreSuite) TestUpdateMasterPassword(c *C) {
   fileName := tempFileName()
-  db, _ := store.Create(fileName, "pass", 1)
+  db, _ := s.create(fileName, "pass", 1)
   credentials := make(map[string]*store.Credential, 100)
   for i := 0; i < 100; i++ {
     login := strconv.Itoa(i)
@@ -169,20 +235,1420 @@ func (s *StoreSuite) TestUpdateMasterPassword(c *C) {
       Realm: "baz",
       Note: "quux",
     }
-    db.AddCredential(credentials[login])
+    c.Assert(db.AddCredential(credentials[login]), IsNil)
   }
-  c.Assert(len(db.AllCredentials()), Equals, len(credentials))
-  db.UpdateMasterPassword("newpass", 100)
+  c.Assert(len(allCredentials(c, db)), Equals, len(credentials))
+  c.Assert(db.UpdateMasterPassword("newpass", crypto.PBKDF2Params(100)), IsNil)
   db.Close()
   db, _ = store.Open(fileName, "newpass")
-  newCredentials := db.AllCredentials()
+  newCredentials := allCredentials(c, db)
   c.Assert(len(newCredentials), Equals, len(credentials))
   for _, credential := range newCredentials {
     assertCredentialsEqual(c, credential, credentials[credential.Login])
   }
 }
 
+func (s *StoreSuite) TestArgon2id(c *C) {
+  fileName := tempFileName()
+  kdf := crypto.Argon2idParams(1, 64, 2)
+  db, err := store.CreateFormat(fileName, "pass", kdf, s.format)
+  c.Assert(err, IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  c.Assert(db.CreateVault("work", "workpass", crypto.Argon2idParams(1, 32, 1)), IsNil)
+  db.Close()
+  _, err = store.Open(fileName, "wrong")
+  c.Assert(err, NotNil)
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+  stored, err := db.KDF()
+  c.Assert(err, IsNil)
+  c.Assert(stored, Equals, kdf)
+  c.Assert(db.UpdateMasterPassword("newpass", crypto.PBKDF2Params(1)), IsNil)
+  c.Assert(db.UpdateMasterPassword("newpass", crypto.Argon2idParams(0, 64, 1)), NotNil)
+  db.Close()
+  db, err = store.Open(fileName, "newpass")
+  c.Assert(err, IsNil)
+  c.Assert(db.UpdateMasterPassword("pass", crypto.Argon2idParams(2, 64, 1)), IsNil)
+  db.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(allCredentials(c, db)[0].Login, Equals, "foo")
+  stored, _ = db.KDF()
+  c.Assert(stored, Equals, crypto.Argon2idParams(2, 64, 1))
+  db.Close()
+  db, err = store.OpenVault(fileName, "work", "workpass")
+  c.Assert(err, IsNil)
+  db.Close()
+}
+
+func (s *StoreSuite) TestKDFTampering(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, _ := store.Create(fileName, "pass", crypto.Argon2idParams(1, 64, 1))
+  db.Close()
+  raw, _ := sql.Open("sqlite3", fileName)
+  _, err := raw.Exec("UPDATE key_slots SET kdf='pbkdf2-sha3-512', kdf_memory=0, kdf_threads=0")
+  c.Assert(err, IsNil)
+  raw.Close()
+  _, err = store.Open(fileName, "pass")
+  c.Assert(err, NotNil)
+}
+
+func (s *StoreSuite) TestOpenLatestVersion(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+  db.Close()
+  db, err := store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(len(allCredentials(c, db)), Equals, 1)
+  db.Close()
+  backups, _ := filepath.Glob(fileName + ".*.bak")
+  c.Assert(len(backups), Equals, 0)
+}
+
+func (s *StoreSuite) TestOpenUnsupportedVersion(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  db.Close()
+  raw, _ := sql.Open("sqlite3", fileName)
+  _, err := raw.Exec("UPDATE settings SET version=1000")
+  c.Assert(err, IsNil)
+  raw.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(db, IsNil)
+  c.Assert(err, NotNil)
+}
+
+func (s *StoreSuite) TestUpgradeFromBaseVersion(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, err := store.CreateVersion(fileName, "pass", 1, 1)
+  c.Assert(err, IsNil)
+  foo := &store.Credential {
+    Login: "foo",
+    Password: "bar",
+    Realm: "baz",
+    Note: "quux",
+  }
+  c.Assert(db.AddBaseCredential(foo), IsNil)
+  db.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  credentials := allCredentials(c, db)
+  c.Assert(len(credentials), Equals, 1)
+  assertCredentialsEqual(c, credentials[0], foo)
+  c.Assert(credentials[0].Created.IsZero(), Equals, true)
+  c.Assert(db.UpdateCredential(credentials[0]), IsNil)
+  db.Close()
+  _, err = os.Stat(fileName + ".v1.bak")
+  c.Assert(err, IsNil)
+  backup, err := store.Open(fileName + ".v1.bak", "pass")
+  c.Assert(err, IsNil)
+  backup.Close()
+}
+
+func (s *StoreSuite) TestFailedUpgrade(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, err := store.CreateVersion(fileName, "pass", 1, 14)
+  c.Assert(err, IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  db.Close()
+  original, err := ioutil.ReadFile(fileName)
+  c.Assert(err, IsNil)
+
+  // The migration to version 15 succeeds and the one to 16 fails, so both
+  // are rolled back.
+  restore := store.FailMigration(16)
+  _, err = store.Open(fileName, "pass")
+  restore()
+  c.Assert(err, ErrorMatches, "Migration to version 16 \\(key slots\\) failed: Injected failure.. The database was not changed. .*")
+  contents, err := ioutil.ReadFile(fileName)
+  c.Assert(err, IsNil)
+  c.Assert(contents, DeepEquals, original)
+  raw, _ := sql.Open("sqlite3", fileName)
+  var version int
+  c.Assert(raw.QueryRow("SELECT version FROM settings").Scan(&version), IsNil)
+  raw.Close()
+  c.Assert(version, Equals, 14)
+  backup, err := ioutil.ReadFile(fileName + ".v14.bak")
+  c.Assert(err, IsNil)
+  c.Assert(backup, DeepEquals, original)
+
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  defer db.Close()
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+}
+
+func (s *StoreSuite) TestUpgradeUUIDs(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, err := store.CreateVersion(fileName, "pass", 1, 10)
+  c.Assert(err, IsNil)
+  c.Assert(db.AddVaultCredential(&store.Credential { Login: "foo" }), IsNil)
+  c.Assert(db.AddVaultCredential(&store.Credential { Login: "bar" }), IsNil)
+  db.Close()
+  copyFileName := copyDatabase(c, fileName)
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  defer db.Close()
+  credentials := allCredentials(c, db)
+  c.Assert(credentials[0].UUID, HasLen, 36)
+  c.Assert(credentials[0].UUID, Not(Equals), credentials[1].UUID)
+  // Copies upgraded separately agree on the UUIDs of shared credentials.
+  other, err := store.Open(copyFileName, "pass")
+  c.Assert(err, IsNil)
+  defer other.Close()
+  otherCredentials := allCredentials(c, other)
+  c.Assert(otherCredentials[0].UUID, Equals, credentials[0].UUID)
+  c.Assert(otherCredentials[1].UUID, Equals, credentials[1].UUID)
+}
+
+func (s *StoreSuite) TestUUIDs(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  defer db.Close()
+  foo := &store.Credential { Login: "foo" }
+  c.Assert(db.AddCredential(foo), IsNil)
+  c.Assert(foo.UUID, HasLen, 36)
+  bar := &store.Credential { Login: "bar", UUID: "6BA7B810-9DAD-41D1-80B4-00C04FD430C8" }
+  c.Assert(db.AddCredential(bar), IsNil)
+  c.Assert(bar.UUID, Equals, "6ba7b810-9dad-41d1-80b4-00c04fd430c8")
+  c.Assert(db.AddCredential(&store.Credential { Login: "bar", UUID: bar.UUID }), FitsTypeOf, store.DuplicateCredentialError{})
+  baz := &store.Credential { Login: "baz" }
+  c.Assert(db.AddCredential(baz), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "baz", UUID: "invalid" }), NotNil)
+  credential, err := db.CredentialByUUID(strings.ToUpper(foo.UUID))
+  c.Assert(err, IsNil)
+  c.Assert(credential.Login, Equals, "foo")
+  c.Assert(db.DeleteCredential(credential), IsNil)
+  credential, err = db.CredentialByUUID(foo.UUID)
+  c.Assert(err, IsNil)
+  c.Assert(credential, IsNil)
+  _, err = db.CredentialByUUID("invalid")
+  c.Assert(err, NotNil)
+  c.Assert(logins(allCredentials(c, db)), DeepEquals, []string { "bar", "baz" })
+  c.Assert(allCredentials(c, db)[0].UUID, Equals, bar.UUID)
+}
+
+func (s *StoreSuite) TestUniqueKeys(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  defer db.Close()
+  foo := &store.Credential { Login: "foo" }
+  c.Assert(db.AddCredential(foo), IsNil)
+  bar := &store.Credential { Login: "bar" }
+  c.Assert(db.AddCredential(bar), IsNil)
+  err := db.InsertRow("credentials", store.Row { "vault": 1, "uuid": foo.UUID })
+  c.Assert(err, FitsTypeOf, store.ConstraintError{})
+  err = db.UpdateRows("credentials", store.Row { "vault": 1, "uuid": bar.UUID }, store.Row { "uuid": foo.UUID })
+  c.Assert(err, FitsTypeOf, store.ConstraintError{})
+  c.Assert(db.InsertRow("settings", store.Row { "vault": 2, "name": store.DefaultVault }), FitsTypeOf, store.ConstraintError{})
+  // UUIDs are only unique within a vault.
+  c.Assert(db.InsertRow("credentials", store.Row { "vault": 2, "uuid": foo.UUID }), IsNil)
+  c.Assert(logins(allCredentials(c, db)), DeepEquals, []string { "foo", "bar" })
+}
+
+func (s *StoreSuite) TestTimestamps(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  before := time.Now().Add(-time.Second)
+  foo := &store.Credential { Login: "foo" }
+  c.Assert(db.AddCredential(foo), IsNil)
+  foo = allCredentials(c, db)[0]
+  c.Assert(foo.Created.After(before), Equals, true)
+  c.Assert(foo.Modified, DeepEquals, foo.Created)
+  c.Assert(foo.Accessed.IsZero(), Equals, true)
+  c.Assert(db.TouchCredential(foo), IsNil)
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  db.Close()
+  db, _ = store.Open(fileName, "pass")
+  updated := allCredentials(c, db)[0]
+  c.Assert(updated.Created, DeepEquals, foo.Created)
+  c.Assert(updated.Modified, DeepEquals, foo.Modified)
+  c.Assert(updated.Accessed, DeepEquals, foo.Accessed)
+  c.Assert(updated.Accessed.IsZero(), Equals, false)
+}
+
+func (s *StoreSuite) TestAddCredentialKeepsTimestamps(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  created := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+  modified := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Created: created, Modified: modified }), IsNil)
+  foo := allCredentials(c, db)[0]
+  c.Assert(foo.Created, DeepEquals, created)
+  c.Assert(foo.Modified, DeepEquals, modified)
+}
+
+func (s *StoreSuite) TestPasswordHistory(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  foo := &store.Credential { Login: "foo", Password: "first" }
+  c.Assert(db.AddCredential(foo), IsNil)
+  foo = allCredentials(c, db)[0]
+  history, err := db.PasswordHistory(foo)
+  c.Assert(err, IsNil)
+  c.Assert(len(history), Equals, 0)
+  foo.Note = "note"
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  history, _ = db.PasswordHistory(foo)
+  c.Assert(len(history), Equals, 0)
+  foo.Password = "second"
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  foo.Password = "third"
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  history, err = db.PasswordHistory(foo)
+  c.Assert(err, IsNil)
+  c.Assert(len(history), Equals, 2)
+  c.Assert(history[0].Password, Equals, "second")
+  c.Assert(history[1].Password, Equals, "first")
+  c.Assert(history[0].Replaced.IsZero(), Equals, false)
+  c.Assert(db.RestorePassword(foo, history[1]), IsNil)
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "first")
+  history, _ = db.PasswordHistory(foo)
+  c.Assert(len(history), Equals, 3)
+  c.Assert(history[0].Password, Equals, "third")
+  c.Assert(db.PurgeCredential(foo), IsNil)
+  history, _ = db.PasswordHistory(foo)
+  c.Assert(len(history), Equals, 0)
+}
+
+func (s *StoreSuite) TestTags(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Tags: []string { "work", " email ", "Work" } }), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "bar", Tags: []string { "home" } }), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "baz" }), IsNil)
+  db.Close()
+  db, _ = store.Open(fileName, "pass")
+  credentials := make(map[string]*store.Credential)
+  for _, credential := range allCredentials(c, db) {
+    credentials[credential.Login] = credential
+  }
+  c.Assert(credentials["foo"].Tags, DeepEquals, []string { "email", "work" })
+  c.Assert(credentials["bar"].Tags, DeepEquals, []string { "home" })
+  c.Assert(credentials["baz"].Tags, DeepEquals, []string {})
+  c.Assert(credentials["foo"].HasTags([]string { "WORK" }), Equals, true)
+  c.Assert(credentials["foo"].HasTags([]string { "work", "home" }), Equals, false)
+  c.Assert(credentials["baz"].HasTags(nil), Equals, true)
+  credentials["bar"].Tags = []string { "work" }
+  c.Assert(db.UpdateCredential(credentials["bar"]), IsNil)
+  c.Assert(db.DeleteCredential(credentials["foo"]), IsNil)
+  remaining := allCredentials(c, db)
+  c.Assert(len(remaining), Equals, 2)
+  for _, credential := range remaining {
+    if credential.Login == "bar" {
+      c.Assert(credential.Tags, DeepEquals, []string { "work" })
+    }
+  }
+}
+
+func (s *StoreSuite) TestFields(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  foo := &store.Credential { Login: "foo" }
+  foo.SetField("PIN", "1234", true)
+  foo.SetField("Account", "98765", false)
+  c.Assert(db.AddCredential(foo), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "bar" }), IsNil)
+  db.Close()
+  db, _ = store.Open(fileName, "pass")
+  credentials := findCredentials(c, db, []string { "foo" })
+  c.Assert(len(credentials), Equals, 1)
+  foo = credentials[0]
+  c.Assert(foo.Fields, DeepEquals, []store.Field {
+    { Name: "PIN", Value: "1234", Concealed: true },
+    { Name: "Account", Value: "98765", Concealed: false },
+  })
+  c.Assert(foo.Field("pin").Value, Equals, "1234")
+  c.Assert(foo.Field("missing"), IsNil)
+  foo.SetField("pin", "4321", true)
+  foo.RemoveField("ACCOUNT")
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  foo = findCredentials(c, db, []string { "foo" })[0]
+  c.Assert(foo.Fields, DeepEquals, []store.Field {
+    { Name: "PIN", Value: "4321", Concealed: true },
+  })
+  bar := findCredentials(c, db, []string { "bar" })[0]
+  c.Assert(bar.Fields, DeepEquals, []store.Field {})
+}
+
+func (s *StoreSuite) TestAttachments(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+  foo := allCredentials(c, db)[0]
+  key := &store.Attachment { Name: "id_rsa", Data: []byte { 0, 1, 2, 255 } }
+  empty := &store.Attachment { Name: "empty", Data: []byte {} }
+  c.Assert(db.AddAttachment(foo, key), IsNil)
+  c.Assert(db.AddAttachment(foo, empty), IsNil)
+  c.Assert(db.AddAttachment(foo, &store.Attachment { Data: []byte { 1 } }), NotNil)
+  c.Assert(db.AddAttachment(foo, &store.Attachment { Name: "large", Data: make([]byte, store.MaxAttachmentSize + 1) }), NotNil)
+  c.Assert(db.AddAttachment(foo, &store.Attachment { Name: "../id_rsa", Data: []byte { 1 } }), NotNil)
+  attachments, err := db.Attachments(foo)
+  c.Assert(err, IsNil)
+  c.Assert(len(attachments), Equals, 2)
+  c.Assert(attachments[0].Name, Equals, "id_rsa")
+  c.Assert(attachments[0].Data, DeepEquals, key.Data)
+  c.Assert(attachments[1].Name, Equals, "empty")
+  c.Assert(len(attachments[1].Data), Equals, 0)
+  c.Assert(db.DeleteAttachment(attachments[1]), IsNil)
+  attachments, _ = db.Attachments(foo)
+  c.Assert(len(attachments), Equals, 1)
+  c.Assert(db.PurgeCredential(foo), IsNil)
+  attachments, _ = db.Attachments(foo)
+  c.Assert(len(attachments), Equals, 0)
+  c.Assert(db.AddAttachment(foo, key), FitsTypeOf, store.NotFoundError{})
+}
+
+func (s *StoreSuite) TestImportAttachmentPath(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  for _, name := range []string { "../../.ssh/authorized_keys", "/home/u/.bashrc", "keys/id_rsa", "keys\\id_rsa", "..", "." } {
+    err := db.ImportCredential(&store.Credential { Login: "foo" }, []*store.Attachment {
+      &store.Attachment { Name: name, Data: []byte { 1 } },
+    })
+    c.Assert(err, ErrorMatches, "Invalid attachment name: .*")
+  }
+  c.Assert(allCredentials(c, db), HasLen, 0)
+}
+
+func (s *StoreSuite) TestTrash(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "first", Tags: []string { "work" } }), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "bar" }), IsNil)
+  foo := findCredentials(c, db, []string { "foo" })[0]
+  foo.Password = "second"
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  c.Assert(db.DeleteCredential(foo), IsNil)
+  c.Assert(foo.Deleted.IsZero(), Equals, false)
+  c.Assert(len(allCredentials(c, db)), Equals, 1)
+  c.Assert(len(findCredentials(c, db, []string { "foo" })), Equals, 0)
+  c.Assert(db.UpdateCredential(foo), FitsTypeOf, store.NotFoundError{})
+  c.Assert(db.DeleteCredential(foo), FitsTypeOf, store.NotFoundError{})
+  trashed, err := db.FindTrashedCredentials([]string { "foo" })
+  c.Assert(err, IsNil)
+  c.Assert(len(trashed), Equals, 1)
+  c.Assert(trashed[0].Deleted.IsZero(), Equals, false)
+  c.Assert(db.RestoreCredential(trashed[0]), IsNil)
+  c.Assert(db.RestoreCredential(trashed[0]), FitsTypeOf, store.NotFoundError{})
+  foo = findCredentials(c, db, []string { "foo" })[0]
+  c.Assert(foo.Password, Equals, "second")
+  c.Assert(foo.Tags, DeepEquals, []string { "work" })
+  history, _ := db.PasswordHistory(foo)
+  c.Assert(len(history), Equals, 1)
+  trashed, _ = db.TrashedCredentials()
+  c.Assert(len(trashed), Equals, 0)
+}
+
+func (s *StoreSuite) TestEmptyTrash(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "bar" }), IsNil)
+  for _, credential := range allCredentials(c, db) {
+    c.Assert(db.DeleteCredential(credential), IsNil)
+  }
+  count, err := db.EmptyTrash(24 * time.Hour)
+  c.Assert(err, IsNil)
+  c.Assert(count, Equals, 0)
+  trashed, _ := db.TrashedCredentials()
+  c.Assert(len(trashed), Equals, 2)
+  count, err = db.EmptyTrash(0)
+  c.Assert(err, IsNil)
+  c.Assert(count, Equals, 2)
+  trashed, _ = db.TrashedCredentials()
+  c.Assert(len(trashed), Equals, 0)
+}
+
+func (s *StoreSuite) TestEmptyTrashRestored(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  defer db.Close()
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+  c.Assert(db.DeleteCredential(allCredentials(c, db)[0]), IsNil)
+  // Another process restores the credential after this one listed the trash.
+  trashed, _ := db.TrashedCredentials()
+  c.Assert(trashed, HasLen, 1)
+  other, err := store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  otherTrashed, _ := other.TrashedCredentials()
+  c.Assert(other.RestoreCredential(otherTrashed[0]), IsNil)
+  other.Close()
+  count, err := db.EmptyTrash(0)
+  c.Assert(err, IsNil)
+  c.Assert(count, Equals, 0)
+  c.Assert(allCredentials(c, db), HasLen, 1)
+}
+
+func auditActions(c *C, db *store.Store) []string {
+  entries, err := db.AuditLog()
+  c.Assert(err, IsNil)
+  actions := make([]string, len(entries))
+  for i, entry := range entries {
+    actions[i] = entry.Action
+  }
+  return actions
+}
+
+func (s *StoreSuite) TestAuditLog(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(auditActions(c, db), DeepEquals, []string {})
+  foo := &store.Credential { Login: "foo", Realm: "example.com" }
+  c.Assert(db.AddCredential(foo), IsNil)
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  c.Assert(db.TouchCredential(foo), IsNil)
+  c.Assert(db.DeleteCredential(foo), IsNil)
+  c.Assert(db.RestoreCredential(foo), IsNil)
+  c.Assert(db.Audit(store.ActionExport, nil), IsNil)
+  c.Assert(db.UpdateMasterPassword("newpass", crypto.PBKDF2Params(1)), IsNil)
+  db.Close()
+  db, _ = store.Open(fileName, "newpass")
+  c.Assert(auditActions(c, db), DeepEquals, []string {
+    store.ActionAdd,
+    store.ActionEdit,
+    store.ActionAccess,
+    store.ActionDelete,
+    store.ActionRestore,
+    store.ActionExport,
+    store.ActionMaster,
+  })
+  entries, _ := db.AuditLog()
+  c.Assert(entries[0].Credential, Equals, "foo@example.com")
+  c.Assert(entries[0].Time.IsZero(), Equals, false)
+  db.Close()
+}
+
+func tamperAuditLog(c *C, statement string) error {
+  fileName := tempFileName()
+  db, _ := store.Create(fileName, "pass", crypto.PBKDF2Params(1))
+  for i := 0; i < 3; i++ {
+    c.Assert(db.AddCredential(&store.Credential { Login: strconv.Itoa(i) }), IsNil)
+  }
+  db.Close()
+  raw, _ := sql.Open("sqlite3", fileName)
+  _, err := raw.Exec(statement)
+  c.Assert(err, IsNil)
+  raw.Close()
+  db, _ = store.Open(fileName, "pass")
+  defer db.Close()
+  _, err = db.AuditLog()
+  return err
+}
+
+func (s *StoreSuite) TestAuditLogTampering(c *C) {
+  s.requireSQLite(c)
+  err := tamperAuditLog(c, "UPDATE audit SET entry=(SELECT entry FROM audit WHERE sequence=0) WHERE sequence=1")
+  c.Assert(err, FitsTypeOf, store.AuditLogError{})
+  err = tamperAuditLog(c, "DELETE FROM audit WHERE sequence=1")
+  c.Assert(err, FitsTypeOf, store.AuditLogError{})
+  err = tamperAuditLog(c, "DELETE FROM audit WHERE sequence=2")
+  c.Assert(err, FitsTypeOf, store.AuditLogError{})
+  err = tamperAuditLog(c, "UPDATE audit SET sequence=sequence+10")
+  c.Assert(err, FitsTypeOf, store.AuditLogError{})
+  err = tamperAuditLog(c, "UPDATE credentials SET note=note")
+  c.Assert(err, IsNil)
+}
+
+func tamperCredentials(c *C, statement string) error {
+  fileName := tempFileName()
+  db, _ := store.Create(fileName, "pass", crypto.PBKDF2Params(1))
+  foo := &store.Credential { Login: "foo", Password: "secret", Fields: []store.Field { { Name: "pin", Value: "1234" } } }
+  c.Assert(db.AddCredential(foo), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "bar", Password: "other" }), IsNil)
+  db.Close()
+  raw, _ := sql.Open("sqlite3", fileName)
+  _, err := raw.Exec(statement)
+  c.Assert(err, IsNil)
+  raw.Close()
+  db, err = store.Open(fileName, "pass")
+  if err != nil {
+    return err
+  }
+  defer db.Close()
+  _, err = db.AllCredentials()
+  return err
+}
+
+func (s *StoreSuite) TestSwappedValues(c *C) {
+  s.requireSQLite(c)
+  err := tamperCredentials(c, "UPDATE credentials SET password=login")
+  c.Assert(err, FitsTypeOf, store.CorruptCredentialError{})
+  err = tamperCredentials(c, "UPDATE credentials SET password=(SELECT password FROM credentials WHERE id=2) WHERE id=1")
+  c.Assert(err, FitsTypeOf, store.CorruptCredentialError{})
+  err = tamperCredentials(c, "UPDATE fields SET name=value")
+  c.Assert(err, FitsTypeOf, store.CorruptCredentialError{})
+  err = tamperCredentials(c, "UPDATE fields SET credential_id=2")
+  c.Assert(err, FitsTypeOf, store.CorruptCredentialError{})
+  err = tamperCredentials(c, "UPDATE credentials SET uuid=(SELECT uuid FROM credentials WHERE id=2) || 'x' WHERE id=1")
+  c.Assert(err, FitsTypeOf, store.CorruptCredentialError{})
+  err = tamperCredentials(c, "UPDATE credentials SET note=note")
+  c.Assert(err, IsNil)
+}
+
+func (s *StoreSuite) TestSettingsTampering(c *C) {
+  s.requireSQLite(c)
+  for _, statement := range []string {
+    "UPDATE settings SET blind_index=0",
+    "UPDATE settings SET audit_head=NULL",
+    "UPDATE settings SET settings_mac=NULL",
+    "UPDATE settings SET associated_data=0",
+    "UPDATE settings SET key_slots=0",
+    "UPDATE key_slots SET label='spouse'",
+  } {
+    fileName := tempFileName()
+    db, _ := store.Create(fileName, "pass", crypto.PBKDF2Params(1))
+    c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+    c.Assert(db.SetBlindIndex(true), IsNil)
+    db.Close()
+    raw, _ := sql.Open("sqlite3", fileName)
+    _, err := raw.Exec(statement)
+    c.Assert(err, IsNil)
+    raw.Close()
+    _, err = store.Open(fileName, "pass")
+    c.Assert(err, NotNil, Commentf(statement))
+  }
+}
+
+func (s *StoreSuite) TestUpgradeAssociatedData(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, err := store.CreateVersion(fileName, "pass", 1, 10)
+  c.Assert(err, IsNil)
+  c.Assert(db.AddVaultCredential(&store.Credential { Login: "foo", Password: "secret" }), IsNil)
+  c.Assert(db.AddVaultCredential(&store.Credential { Login: "bar", Password: "other" }), IsNil)
+  db.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  credentials := allCredentials(c, db)
+  c.Assert(logins(credentials), DeepEquals, []string { "foo", "bar" })
+  c.Assert(credentials[0].Password, Equals, "secret")
+  credentials[0].Tags = []string { "tag" }
+  credentials[0].SetField("pin", "1234", true)
+  c.Assert(db.UpdateCredential(credentials[0]), IsNil)
+  db.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  credentials = allCredentials(c, db)
+  c.Assert(credentials[0].Tags, DeepEquals, []string { "tag" })
+  c.Assert(credentials[0].Field("pin").Value, Equals, "1234")
+  _, err = db.AuditLog()
+  c.Assert(err, IsNil)
+  db.Close()
+  // Converted values are bound to their row.
+  raw, _ := sql.Open("sqlite3", fileName)
+  _, err = raw.Exec("UPDATE credentials SET password=(SELECT password FROM credentials WHERE id=2) WHERE id=1")
+  c.Assert(err, IsNil)
+  raw.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  defer db.Close()
+  _, err = db.AllCredentials()
+  c.Assert(err, FitsTypeOf, store.CorruptCredentialError{})
+}
+
+func (s *StoreSuite) TestUpgradeCipherSuite(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, err := store.CreateVersion(fileName, "pass", 1, 13)
+  c.Assert(err, IsNil)
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteAES128GCM)
+  foo := &store.Credential { Login: "foo", Password: "old", Tags: []string { "tag" } }
+  foo.SetField("pin", "1234", true)
+  c.Assert(db.AddCredential(foo), IsNil)
+  foo.Password = "new"
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  db.Close()
+  // Opening the vault does not change it.
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteAES128GCM)
+  c.Assert(db.ChangeCipherSuite(crypto.SuiteAES256GCM, "wrong"), FitsTypeOf, crypto.IncorrectPasswordError(""))
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteAES128GCM)
+  c.Assert(db.ChangeCipherSuite(crypto.SuiteAES256GCM, "pass"), IsNil)
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteAES256GCM)
+  db.Close()
+  _, err = store.Open(fileName, "wrong")
+  c.Assert(err, NotNil)
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  defer db.Close()
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteAES256GCM)
+  credentials := allCredentials(c, db)
+  c.Assert(credentials[0].Password, Equals, "new")
+  c.Assert(credentials[0].Tags, DeepEquals, []string { "tag" })
+  c.Assert(credentials[0].Field("pin").Value, Equals, "1234")
+  history, _ := db.PasswordHistory(credentials[0])
+  c.Assert(history[0].Password, Equals, "old")
+  actions := auditActions(c, db)
+  c.Assert(actions[len(actions) - 1], Equals, store.ActionRekey)
+}
+
+func (s *StoreSuite) TestChangeCipherSuite(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.CipherSuite(), Equals, crypto.DefaultSuite)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  c.Assert(db.ChangeCipherSuite(crypto.SuiteAES128GCM, ""), NotNil)
+  c.Assert(db.ChangeCipherSuite("rot13", ""), NotNil)
+  c.Assert(db.ChangeCipherSuite(crypto.SuiteChaCha20Poly1305, ""), IsNil)
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteChaCha20Poly1305)
+  c.Assert(db.AddCredential(&store.Credential { Login: "baz" }), IsNil)
+  db.Close()
+  db, err := store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteChaCha20Poly1305)
+  credentials := allCredentials(c, db)
+  c.Assert(logins(credentials), DeepEquals, []string { "foo", "baz" })
+  c.Assert(credentials[0].Password, Equals, "bar")
+  c.Assert(db.UpdateMasterPassword("newpass", crypto.PBKDF2Params(1)), IsNil)
+  c.Assert(db.Rekey(), IsNil)
+  db.Close()
+  db, err = store.Open(fileName, "newpass")
+  c.Assert(err, IsNil)
+  defer db.Close()
+  c.Assert(db.CipherSuite(), Equals, crypto.SuiteChaCha20Poly1305)
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+}
+
+func (s *StoreSuite) TestKeyFile(c *C) {
+  fileName := tempFileName()
+  keyFile := crypto.NewKeyFile()
+  db, err := store.CreateKeyFile(fileName, "pass", keyFile, crypto.PBKDF2Params(1), s.format)
+  c.Assert(err, IsNil)
+  c.Assert(db.HasKeyFile(), Equals, true)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  db.Close()
+  _, err = store.Open(fileName, "pass")
+  c.Assert(err, FitsTypeOf, store.KeyFileRequiredError{})
+  _, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "pass", crypto.NewKeyFile())
+  c.Assert(err, FitsTypeOf, crypto.IncorrectPasswordError(""))
+  _, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "wrong", keyFile)
+  c.Assert(err, FitsTypeOf, crypto.IncorrectPasswordError(""))
+  db, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "pass", keyFile)
+  c.Assert(err, IsNil)
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+  c.Assert(db.UpdateMasterPassword("newpass", crypto.PBKDF2Params(1)), IsNil)
+  c.Assert(db.Rekey(), IsNil)
+  db.Close()
+  _, err = store.Open(fileName, "newpass")
+  c.Assert(err, FitsTypeOf, store.KeyFileRequiredError{})
+  db, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "newpass", keyFile)
+  c.Assert(err, IsNil)
+  c.Assert(db.SetKeyFile([]byte{}), NotNil)
+  c.Assert(db.SetKeyFile(nil), IsNil)
+  c.Assert(db.HasKeyFile(), Equals, false)
+  db.Close()
+  // A key file is ignored by vaults that do not require one.
+  db, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "newpass", keyFile)
+  c.Assert(err, IsNil)
+  c.Assert(db.HasKeyFile(), Equals, false)
+  c.Assert(db.SetKeyFile(keyFile), IsNil)
+  db.Close()
+  db, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "newpass", keyFile)
+  c.Assert(err, IsNil)
+  defer db.Close()
+  c.Assert(allCredentials(c, db)[0].Login, Equals, "foo")
+}
+
+func (s *StoreSuite) TestKeySlots(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  keyFile := crypto.NewKeyFile()
+  spouse, err := db.AddKeySlot("spouse", "spousepass", nil, crypto.PBKDF2Params(1))
+  c.Assert(err, IsNil)
+  _, err = db.AddKeySlot("usb", "", keyFile, crypto.KDF{})
+  c.Assert(err, IsNil)
+  _, err = db.AddKeySlot("spouse", "other", nil, crypto.PBKDF2Params(1))
+  c.Assert(err, NotNil)
+  _, err = db.AddKeySlot("empty", "", nil, crypto.PBKDF2Params(1))
+  c.Assert(err, NotNil)
+  slots, err := db.KeySlots()
+  c.Assert(err, IsNil)
+  c.Assert(slots, HasLen, 3)
+  c.Assert(slots[0].Label, Equals, "master password")
+  c.Assert(slots[0].ID, Equals, db.UnlockedSlot())
+  c.Assert(slots[1].KDF, Equals, crypto.PBKDF2Params(1))
+  c.Assert(slots[2].Password, Equals, false)
+  c.Assert(slots[2].KeyFile, Equals, true)
+  c.Assert(db.RemoveKeySlot(db.UnlockedSlot()), NotNil)
+  db.Close()
+
+  for _, password := range []string { "pass", "spousepass" } {
+    db, err = store.Open(fileName, password)
+    c.Assert(err, IsNil)
+    c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+    db.Close()
+  }
+
+  _, err = store.Open(fileName, "wrong")
+  c.Assert(err, FitsTypeOf, crypto.IncorrectPasswordError(""))
+  db, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "", keyFile)
+  c.Assert(err, IsNil)
+  c.Assert(allCredentials(c, db)[0].Login, Equals, "foo")
+  _, err = db.KDF()
+  c.Assert(err, NotNil)
+  c.Assert(db.SetKeyFile(nil), NotNil)
+  slot, err := db.FindKeySlot("spouse")
+  c.Assert(err, IsNil)
+  c.Assert(slot.ID, Equals, spouse)
+  _, err = db.FindKeySlot("nobody")
+  c.Assert(err, FitsTypeOf, store.KeySlotNotFoundError{})
+  c.Assert(db.RemoveKeySlot(spouse), IsNil)
+  db.Close()
+  _, err = store.Open(fileName, "spousepass")
+  c.Assert(err, NotNil)
+
+  // Rekeying keeps only the slot that unlocked the vault.
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(db.Rekey(), IsNil)
+  slots, _ = db.KeySlots()
+  c.Assert(slots, HasLen, 1)
+  actions := auditActions(c, db)
+  c.Assert(actions[len(actions) - 4:], DeepEquals, []string { store.ActionSlot, store.ActionSlot, store.ActionSlot, store.ActionRekey })
+  db.Close()
+  _, err = store.OpenVaultKeyFile(fileName, store.DefaultVault, "", keyFile)
+  c.Assert(err, NotNil)
+}
+
+func (s *StoreSuite) TestRevokedKeySlot(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, _ := store.Create(fileName, "pass", crypto.PBKDF2Params(1))
+  id, err := db.AddKeySlot("spouse", "spousepass", nil, crypto.PBKDF2Params(1))
+  c.Assert(err, IsNil)
+  db.Close()
+  raw, _ := sql.Open("sqlite3", fileName)
+  defer raw.Close()
+  _, err = raw.Exec("CREATE TABLE revoked AS SELECT * FROM key_slots WHERE id=?", id)
+  c.Assert(err, IsNil)
+  db, _ = store.Open(fileName, "pass")
+  c.Assert(db.RemoveKeySlot(id), IsNil)
+  db.Close()
+  // Restoring a removed slot from an old copy is detected.
+  _, err = raw.Exec("INSERT INTO key_slots SELECT * FROM revoked")
+  c.Assert(err, IsNil)
+  _, err = store.Open(fileName, "spousepass")
+  c.Assert(err, FitsTypeOf, store.CorruptDatabaseError{})
+}
+
+func (s *StoreSuite) TestUpgradeKeySlots(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, err := store.CreateVersion(fileName, "pass", 1, 15)
+  c.Assert(err, IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  db.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  slots, err := db.KeySlots()
+  c.Assert(err, IsNil)
+  c.Assert(slots, HasLen, 1)
+  c.Assert(slots[0].Label, Equals, "master password")
+  c.Assert(slots[0].KDF, Equals, crypto.PBKDF2Params(1))
+  _, err = db.AddKeySlot("spouse", "spousepass", nil, crypto.PBKDF2Params(1))
+  c.Assert(err, IsNil)
+  db.Close()
+  raw, _ := sql.Open("sqlite3", fileName)
+  var count int
+  c.Assert(raw.QueryRow("SELECT COUNT(*) FROM settings WHERE encrypted_key IS NOT NULL").Scan(&count), IsNil)
+  raw.Close()
+  c.Assert(count, Equals, 0)
+  db, err = store.Open(fileName, "spousepass")
+  c.Assert(err, IsNil)
+  defer db.Close()
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+}
+
+func (s *StoreSuite) TestRecoveryKey(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  recoveryKey, err := db.AddRecoveryKey()
+  c.Assert(err, IsNil)
+  c.Assert(recoveryKey, HasLen, crypto.RecoveryKeySize)
+  _, err = db.AddRecoveryKey()
+  c.Assert(err, NotNil)
+  _, err = db.AddKeySlot(store.RecoverySlotLabel, "other", nil, crypto.PBKDF2Params(1))
+  c.Assert(err, NotNil)
+  c.Assert(db.ResetMasterPassword("new", crypto.PBKDF2Params(1)), NotNil)
+  db.Close()
+
+  _, err = store.Recover(fileName, store.DefaultVault, crypto.NewRecoveryKey())
+  c.Assert(err, NotNil)
+  db, err = store.Recover(fileName, store.DefaultVault, recoveryKey)
+  c.Assert(err, IsNil)
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+  c.Assert(db.ResetMasterPassword("", crypto.PBKDF2Params(1)), NotNil)
+  c.Assert(db.UpdateMasterPassword("new", crypto.PBKDF2Params(1)), NotNil)
+  c.Assert(db.ResetMasterPassword("new", crypto.PBKDF2Params(1)), IsNil)
+  db.Close()
+
+  _, err = store.Open(fileName, "pass")
+  c.Assert(err, FitsTypeOf, crypto.IncorrectPasswordError(""))
+  db, err = store.Open(fileName, "new")
+  c.Assert(err, IsNil)
+  c.Assert(allCredentials(c, db)[0].Login, Equals, "foo")
+  db.Close()
+
+  // The recovery key keeps working after the reset.
+  db, err = store.Recover(fileName, store.DefaultVault, recoveryKey)
+  c.Assert(err, IsNil)
+  db.Close()
+}
+
+func (s *StoreSuite) TestShares(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  old, err := db.CreateShares(2, 3)
+  c.Assert(err, IsNil)
+  shares, err := db.CreateShares(2, 3)
+  c.Assert(err, IsNil)
+  c.Assert(shares, HasLen, 3)
+  _, err = db.CreateShares(4, 3)
+  c.Assert(err, NotNil)
+  _, err = db.AddKeySlot(store.SharesSlotLabel, "other", nil, crypto.PBKDF2Params(1))
+  c.Assert(err, NotNil)
+  slots, _ := db.KeySlots()
+  c.Assert(slots, HasLen, 2)
+  db.Close()
+
+  _, err = store.OpenShares(fileName, store.DefaultVault, shares[:1])
+  c.Assert(err, NotNil)
+  _, err = store.OpenShares(fileName, store.DefaultVault, old[1:])
+  c.Assert(err, NotNil)
+  db, err = store.OpenShares(fileName, store.DefaultVault, []crypto.Share { shares[2], shares[0] })
+  c.Assert(err, IsNil)
+  defer db.Close()
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+  _, err = db.CreateShares(2, 3)
+  c.Assert(err, NotNil)
+  // The shares slot keeps unlocking with the shares alone.
+  c.Assert(db.UpdateMasterPassword("new", crypto.PBKDF2Params(1)), NotNil)
+  c.Assert(db.SetKeyFile(crypto.NewKeyFile()), NotNil)
+}
+
+func (s *StoreSuite) TestFindCredentialsLazy(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  foo := &store.Credential { Login: "foo", Password: "secret" }
+  foo.SetField("pin", "1234", true)
+  c.Assert(db.AddCredential(foo), IsNil)
+  found, err := db.FindCredentials([]string { "foo" })
+  c.Assert(err, IsNil)
+  c.Assert(len(found), Equals, 1)
+  foo = found[0]
+  c.Assert(foo.Login, Equals, "foo")
+  c.Assert(foo.Password, Equals, "")
+  c.Assert(len(foo.Fields), Equals, 0)
+  c.Assert(func() { db.UpdateCredential(foo) }, PanicMatches, "Credential not loaded.")
+  c.Assert(db.LoadCredential(foo), IsNil)
+  c.Assert(foo.Password, Equals, "secret")
+  c.Assert(foo.Field("pin").Value, Equals, "1234")
+  c.Assert(db.UpdateCredential(foo), IsNil)
+}
+
+func lookupCredentials(c *C, db *store.Store, terms []string) []string {
+  credentials, err := db.LookupCredentials(terms)
+  c.Assert(err, IsNil)
+  logins := make([]string, 0)
+  for _, credential := range credentials {
+    logins = append(logins, credential.Login)
+  }
+  return logins
+}
+
+func (s *StoreSuite) TestBlindIndex(c *C) {
+  db, _ := s.create(":memory:", "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Realm: "example.com" }), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "bar", Realm: "example.com" }), IsNil)
+  enabled, err := db.BlindIndexEnabled()
+  c.Assert(err, IsNil)
+  c.Assert(enabled, Equals, false)
+  c.Assert(lookupCredentials(c, db, []string { "Example.com" }), DeepEquals, []string { "foo", "bar" })
+  c.Assert(lookupCredentials(c, db, []string { "example" }), DeepEquals, []string {})
+  c.Assert(db.SetBlindIndex(true), IsNil)
+  enabled, _ = db.BlindIndexEnabled()
+  c.Assert(enabled, Equals, true)
+  c.Assert(lookupCredentials(c, db, []string { "Example.com" }), DeepEquals, []string { "foo", "bar" })
+  c.Assert(lookupCredentials(c, db, []string { "example.com", "BAR" }), DeepEquals, []string { "bar" })
+  c.Assert(lookupCredentials(c, db, []string { "example" }), DeepEquals, []string {})
+  baz := &store.Credential { Login: "baz", Realm: "example.org" }
+  c.Assert(db.AddCredential(baz), IsNil)
+  c.Assert(lookupCredentials(c, db, []string { "baz" }), DeepEquals, []string { "baz" })
+  baz.Login = "qux"
+  c.Assert(db.UpdateCredential(baz), IsNil)
+  c.Assert(lookupCredentials(c, db, []string { "baz" }), DeepEquals, []string {})
+  c.Assert(lookupCredentials(c, db, []string { "qux" }), DeepEquals, []string { "qux" })
+  c.Assert(db.DeleteCredential(baz), IsNil)
+  c.Assert(lookupCredentials(c, db, []string { "qux" }), DeepEquals, []string {})
+  c.Assert(db.SetBlindIndex(false), IsNil)
+  c.Assert(lookupCredentials(c, db, []string { "foo" }), DeepEquals, []string { "foo" })
+}
+
+func (s *StoreSuite) TestVaults(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.VaultName(), Equals, store.DefaultVault)
+  c.Assert(db.AddCredential(&store.Credential { Login: "personal", Tags: []string { "shared" } }), IsNil)
+  c.Assert(db.CreateVault("work", "workpass", crypto.PBKDF2Params(1)), IsNil)
+  c.Assert(db.CreateVault("work", "other", crypto.PBKDF2Params(1)), NotNil)
+  c.Assert(db.CreateVault(" ", "other", crypto.PBKDF2Params(1)), NotNil)
+  c.Assert(db.RemoveVault(), NotNil)
+  vaults, err := db.Vaults()
+  c.Assert(err, IsNil)
+  c.Assert(vaults, DeepEquals, []string { store.DefaultVault, "work" })
+  db.Close()
+  _, err = store.OpenVault(fileName, "work", "pass")
+  c.Assert(err, NotNil)
+  _, err = store.OpenVault(fileName, "missing", "pass")
+  c.Assert(err, FitsTypeOf, store.VaultNotFoundError{})
+  db, err = store.OpenVault(fileName, "work", "workpass")
+  c.Assert(err, IsNil)
+  c.Assert(len(allCredentials(c, db)), Equals, 0)
+  c.Assert(db.AddCredential(&store.Credential { Login: "work", Tags: []string { "shared" } }), IsNil)
+  c.Assert(db.SetBlindIndex(true), IsNil)
+  c.Assert(auditActions(c, db), DeepEquals, []string { store.ActionAdd })
+  db.Close()
+  db, _ = store.Open(fileName, "pass")
+  credentials := allCredentials(c, db)
+  c.Assert(len(credentials), Equals, 1)
+  c.Assert(credentials[0].Login, Equals, "personal")
+  c.Assert(credentials[0].Tags, DeepEquals, []string { "shared" })
+  c.Assert(auditActions(c, db), DeepEquals, []string { store.ActionAdd, store.ActionVault })
+  enabled, _ := db.BlindIndexEnabled()
+  c.Assert(enabled, Equals, false)
+  db.Close()
+  db, _ = store.OpenVault(fileName, "work", "workpass")
+  c.Assert(findCredentials(c, db, []string { "work" })[0].Tags, DeepEquals, []string { "shared" })
+  c.Assert(db.RemoveVault(), IsNil)
+  db.Close()
+  _, err = store.OpenVault(fileName, "work", "workpass")
+  c.Assert(err, FitsTypeOf, store.VaultNotFoundError{})
+  db, _ = store.Open(fileName, "pass")
+  c.Assert(len(allCredentials(c, db)), Equals, 1)
+  vaults, _ = db.Vaults()
+  c.Assert(vaults, DeepEquals, []string { store.DefaultVault })
+  db.Close()
+}
+
+func (s *StoreSuite) TestFormatHeader(c *C) {
+  fileName := tempFileName()
+  db, err := s.create(fileName, "pass", 1)
+  c.Assert(err, IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  db.Close()
+  contents, _ := ioutil.ReadFile(fileName)
+  if s.format == store.FormatSQLite {
+    c.Assert(strings.HasPrefix(string(contents), "SQLite format 3"), Equals, true)
+  } else {
+    c.Assert(strings.HasPrefix(string(contents), "Ward database"), Equals, true)
+    c.Assert(strings.Contains(string(contents), "bar"), Equals, false)
+  }
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(findCredentials(c, db, []string { "foo" })[0].Password, Equals, "bar")
+  db.Close()
+}
+
+func (s *StoreSuite) TestMemoryBackend(c *C) {
+  backend := store.NewMemoryBackend()
+  db, err := store.CreateBackend(backend, "pass", crypto.PBKDF2Params(1))
+  c.Assert(err, IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo", Password: "bar" }), IsNil)
+  _, err = store.OpenBackend(backend, store.DefaultVault, "wrong")
+  c.Assert(err, NotNil)
+  db, err = store.OpenBackend(backend, store.DefaultVault, "pass")
+  c.Assert(err, IsNil)
+  c.Assert(allCredentials(c, db)[0].Password, Equals, "bar")
+}
+
+func (s *StoreSuite) TestConcurrentWriters(c *C) {
+  fileName := tempFileName()
+  first, _ := s.create(fileName, "pass", 1)
+  second, err := store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  for i := 0; i < 5; i++ {
+    c.Assert(first.AddCredential(&store.Credential { Login: "first" + strconv.Itoa(i) }), IsNil)
+    c.Assert(second.AddCredential(&store.Credential { Login: "second" + strconv.Itoa(i) }), IsNil)
+  }
+  first.Close()
+  second.Close()
+  db, _ := store.Open(fileName, "pass")
+  c.Assert(allCredentials(c, db), HasLen, 10)
+  _, err = db.AuditLog()
+  c.Assert(err, IsNil)
+}
+
+// Returns the nonces of every encrypted credential value, which must all be
+// distinct.
+func credentialNonces(c *C, fileName string) map[string]bool {
+  raw, _ := sql.Open("sqlite3", fileName)
+  defer raw.Close()
+  rows, err := raw.Query("SELECT login, password, realm, note FROM credentials")
+  c.Assert(err, IsNil)
+  defer rows.Close()
+  nonces := make(map[string]bool)
+  for rows.Next() {
+    values := make([][]byte, 4)
+    c.Assert(rows.Scan(&values[0], &values[1], &values[2], &values[3]), IsNil)
+    for _, value := range values {
+      nonce := string(value[len(value) - 12:])
+      c.Assert(nonces[nonce], Equals, false)
+      nonces[nonce] = true
+    }
+  }
+  return nonces
+}
+
+func (s *StoreSuite) TestNoncesUniqueAcrossWriters(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  first, _ := s.create(fileName, "pass", 1)
+  second, _ := store.Open(fileName, "pass")
+  for i := 0; i < 5; i++ {
+    c.Assert(first.AddCredential(&store.Credential { Login: "first", Password: "pass" }), IsNil)
+    c.Assert(second.AddCredential(&store.Credential { Login: "second", Password: "pass" }), IsNil)
+  }
+  first.Close()
+  second.Close()
+  c.Assert(credentialNonces(c, fileName), HasLen, 40)
+}
+
+func (s *StoreSuite) TestNoncesUniqueAcrossCopies(c *C) {
+  s.requireSQLite(c)
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.AddCredential(&store.Credential { Login: "shared" }), IsNil)
+  db.Close()
+  contents, _ := ioutil.ReadFile(fileName)
+  copyFileName := tempFileName()
+  c.Assert(ioutil.WriteFile(copyFileName, contents, 0600), IsNil)
+  for _, name := range []string { fileName, copyFileName } {
+    db, _ = store.Open(name, "pass")
+    for i := 0; i < 5; i++ {
+      c.Assert(db.AddCredential(&store.Credential { Login: name, Password: "pass" }), IsNil)
+    }
+    db.Close()
+  }
+  nonces := credentialNonces(c, fileName)
+  shared := 0
+  for nonce := range credentialNonces(c, copyFileName) {
+    if nonces[nonce] {
+      shared++
+    }
+  }
+  // Only the credential added before the copy was made has the same nonces.
+  c.Assert(shared, Equals, 4)
+}
+
+func (s *StoreSuite) TestStaleLock(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  defer db.Close()
+  host, _ := os.Hostname()
+  // A lock file left behind by a process that exited is not locked.
+  lock := fmt.Sprintf("%d %s\n", 1 << 30, host)
+  c.Assert(ioutil.WriteFile(store.LockFileName(fileName), []byte(lock), 0600), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+  contents, err := ioutil.ReadFile(store.LockFileName(fileName))
+  c.Assert(err, IsNil)
+  c.Assert(contents, HasLen, 0)
+}
+
+func (s *StoreSuite) TestStaleLockRace(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  db.Close()
+  host, _ := os.Hostname()
+  lock := fmt.Sprintf("%d %s\n", 1 << 30, host)
+  c.Assert(ioutil.WriteFile(store.LockFileName(fileName), []byte(lock), 0600), IsNil)
+
+  const racers = 8
+  var holders int32
+  errs := make(chan error, racers)
+  start := make(chan struct{})
+  for i := 0; i < racers; i++ {
+    go func() {
+      <-start
+      unlock, err := store.LockFile(fileName)
+      if err != nil {
+        errs <- err
+        return
+      }
+
+      if atomic.AddInt32(&holders, 1) != 1 {
+        err = errors.New("Lock held twice.")
+      }
+
+      time.Sleep(10 * time.Millisecond)
+      atomic.AddInt32(&holders, -1)
+      if unlockErr := unlock(); err == nil {
+        err = unlockErr
+      }
+
+      errs <- err
+    }()
+  }
+
+  close(start)
+  for i := 0; i < racers; i++ {
+    c.Assert(<-errs, IsNil)
+  }
+}
+
+func (s *StoreSuite) TestUpdateMasterPasswordFailed(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  unlock, err := store.LockFile(fileName)
+  c.Assert(err, IsNil)
+  defer store.SetLockTimeout(store.SetLockTimeout(100 * time.Millisecond))
+  c.Assert(db.UpdateMasterPassword("newpass", crypto.PBKDF2Params(1)), FitsTypeOf, store.LockedError{})
+  c.Assert(unlock(), IsNil)
+  // The store still holds the old password key, so rekeying keeps the old
+  // password.
+  c.Assert(db.Rekey(), IsNil)
+  db.Close()
+  db, err = store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  db.Close()
+}
+
+func (s *StoreSuite) TestLocked(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  defer db.Close()
+  unlock, err := store.LockFile(fileName)
+  c.Assert(err, IsNil)
+  defer store.SetLockTimeout(store.SetLockTimeout(100 * time.Millisecond))
+  err = db.AddCredential(&store.Credential { Login: "foo" })
+  c.Assert(err, FitsTypeOf, store.LockedError{})
+  c.Assert(err.(store.LockedError).PID, Equals, os.Getpid())
+  c.Assert(unlock(), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "foo" }), IsNil)
+  c.Assert(allCredentials(c, db), HasLen, 1)
+}
+
+func copyDatabase(c *C, fileName string) string {
+  contents, err := ioutil.ReadFile(fileName)
+  c.Assert(err, IsNil)
+  copyFileName := tempFileName()
+  c.Assert(ioutil.WriteFile(copyFileName, contents, 0600), IsNil)
+  return copyFileName
+}
+
+func logins(credentials []*store.Credential) []string {
+  names := make([]string, len(credentials))
+  for i, credential := range credentials {
+    names[i] = credential.Login
+  }
+  return names
+}
+
+func (s *StoreSuite) TestMerge(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  created := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+  for _, login := range []string { "c1", "c2", "c3", "c4" } {
+    c.Assert(db.AddCredential(&store.Credential { Login: login, Password: "old", Created: created }), IsNil)
+  }
+  db.Close()
+  otherFileName := copyDatabase(c, fileName)
+
+  db, _ = store.Open(fileName, "pass")
+  defer db.Close()
+  c1 := findCredentials(c, db, []string { "c1" })[0]
+  c1.Password = "local"
+  c.Assert(db.UpdateCredential(c1), IsNil)
+  c.Assert(db.DeleteCredential(findCredentials(c, db, []string { "c2" })[0]), IsNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "c5" }), IsNil)
+
+  other, _ := store.Open(otherFileName, "pass")
+  defer other.Close()
+  c1 = findCredentials(c, other, []string { "c1" })[0]
+  c1.Password = "other"
+  c.Assert(other.UpdateCredential(c1), IsNil)
+  c3 := findCredentials(c, other, []string { "c3" })[0]
+  c3.Note = "edited"
+  c.Assert(other.UpdateCredential(c3), IsNil)
+  c.Assert(other.PurgeCredential(findCredentials(c, other, []string { "c4" })[0]), IsNil)
+  c6 := &store.Credential { Login: "c6", Password: "new", Tags: []string { "tag" } }
+  c.Assert(other.AddCredential(c6), IsNil)
+  c.Assert(other.AddAttachment(c6, &store.Attachment { Name: "key", Data: []byte { 1, 2, 3 } }), IsNil)
+
+  changes, err := db.PlanMerge(other)
+  c.Assert(err, IsNil)
+  c.Assert(changes, HasLen, 4)
+  c.Assert(changes[0].Conflict, Equals, true)
+  c.Assert(changes[0].Local.Login, Equals, "c1")
+  c.Assert(changes[0].Other.Password, Equals, "other")
+  c.Assert(changes[1].Other.Note, Equals, "edited")
+  c.Assert(changes[1].UseOther, Equals, true)
+  c.Assert(changes[2].Local.Login, Equals, "c4")
+  c.Assert(changes[2].Other, IsNil)
+  c.Assert(changes[2].UseOther, Equals, true)
+  c.Assert(changes[3].Local, IsNil)
+  c.Assert(changes[3].Other.Login, Equals, "c6")
+
+  changes[0].UseOther = true
+  count, err := db.ApplyMerge(other, changes)
+  c.Assert(err, IsNil)
+  c.Assert(count, Equals, 4)
+
+  credentials := allCredentials(c, db)
+  c.Assert(logins(credentials), DeepEquals, []string { "c1", "c3", "c5", "c6" })
+  c.Assert(credentials[0].Password, Equals, "other")
+  c.Assert(credentials[1].Note, Equals, "edited")
+  c.Assert(credentials[3].Tags, DeepEquals, []string { "tag" })
+  attachments, err := db.Attachments(credentials[3])
+  c.Assert(err, IsNil)
+  c.Assert(attachments, HasLen, 1)
+  c.Assert(attachments[0].Data, DeepEquals, []byte { 1, 2, 3 })
+  trashed, _ := db.TrashedCredentials()
+  c.Assert(logins(trashed), DeepEquals, []string { "c2" })
+  history, _ := db.PasswordHistory(credentials[0])
+  c.Assert(history[0].Password, Equals, "local")
+
+  // Merging again finds nothing left to change.
+  changes, err = db.PlanMerge(other)
+  c.Assert(err, IsNil)
+  for _, change := range changes {
+    c.Assert(change.UseOther, Equals, false)
+  }
+}
+
+func (s *StoreSuite) TestMergeAttachmentsAndHistory(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  created := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+  for _, login := range []string { "c1", "c2", "c3" } {
+    c.Assert(db.AddCredential(&store.Credential { Login: login, Password: "old", Created: created }), IsNil)
+  }
+  c3 := findCredentials(c, db, []string { "c3" })[0]
+  c.Assert(db.ImportCredential(&store.Credential { Login: "c4", Created: created }, []*store.Attachment {
+    { Name: "stale", Data: []byte { 9 } },
+  }), IsNil)
+  db.Close()
+  otherFileName := copyDatabase(c, fileName)
+
+  db, _ = store.Open(fileName, "pass")
+  defer db.Close()
+  other, _ := store.Open(otherFileName, "pass")
+  defer other.Close()
+  // An attachment added to an existing credential.
+  c1 := findCredentials(c, other, []string { "c1" })[0]
+  c.Assert(other.AddAttachment(c1, &store.Attachment { Name: "key", Data: []byte { 1, 2, 3 } }), IsNil)
+  // A password change, which adds to the history.
+  c2 := findCredentials(c, other, []string { "c2" })[0]
+  c2.Password = "new"
+  c.Assert(other.UpdateCredential(c2), IsNil)
+  // An attachment removed from a credential.
+  c4 := findCredentials(c, other, []string { "c4" })[0]
+  attachments, _ := other.Attachments(c4)
+  c.Assert(other.DeleteAttachment(attachments[0]), IsNil)
+  // An attachment on a credential replaced for another reason is kept.
+  c3 = findCredentials(c, other, []string { "c3" })[0]
+  c.Assert(other.AddAttachment(c3, &store.Attachment { Name: "codes", Data: []byte { 4 } }), IsNil)
+  c3.Note = "edited"
+  c.Assert(other.UpdateCredential(c3), IsNil)
+
+  changes, err := db.PlanMerge(other)
+  c.Assert(err, IsNil)
+  c.Assert(changes, HasLen, 4)
+  for _, change := range changes {
+    c.Assert(change.UseOther, Equals, true)
+  }
+
+  _, err = db.ApplyMerge(other, changes)
+  c.Assert(err, IsNil)
+  credentials := allCredentials(c, db)
+  c.Assert(logins(credentials), DeepEquals, []string { "c1", "c2", "c3", "c4" })
+  attachments, _ = db.Attachments(credentials[0])
+  c.Assert(attachments, HasLen, 1)
+  c.Assert(attachments[0].Data, DeepEquals, []byte { 1, 2, 3 })
+  history, _ := db.PasswordHistory(credentials[1])
+  c.Assert(history, HasLen, 1)
+  c.Assert(history[0].Password, Equals, "old")
+  attachments, _ = db.Attachments(credentials[2])
+  c.Assert(attachments, HasLen, 1)
+  c.Assert(attachments[0].Name, Equals, "codes")
+  attachments, _ = db.Attachments(credentials[3])
+  c.Assert(attachments, HasLen, 0)
+
+  // Merging again finds nothing left to change.
+  changes, err = db.PlanMerge(other)
+  c.Assert(err, IsNil)
+  c.Assert(changes, HasLen, 0)
+}
+
+func (s *StoreSuite) TestMergeUnrelated(c *C) {
+  db, _ := s.create(tempFileName(), "pass", 1)
+  defer db.Close()
+  c.Assert(db.AddCredential(&store.Credential { Login: "local" }), IsNil)
+  other, _ := s.create(tempFileName(), "other", 1)
+  defer other.Close()
+  c.Assert(other.AddCredential(&store.Credential { Login: "other" }), IsNil)
+  changes, err := db.PlanMerge(other)
+  c.Assert(err, IsNil)
+  c.Assert(changes, HasLen, 1)
+  c.Assert(changes[0].Local, IsNil)
+  c.Assert(changes[0].UseOther, Equals, true)
+  _, err = db.ApplyMerge(other, changes)
+  c.Assert(err, IsNil)
+  c.Assert(logins(allCredentials(c, db)), DeepEquals, []string { "local", "other" })
+}
+
+func (s *StoreSuite) TestRekey(c *C) {
+  fileName := tempFileName()
+  db, _ := s.create(fileName, "pass", 1)
+  c.Assert(db.CreateVault("work", "workpass", crypto.PBKDF2Params(1)), IsNil)
+  foo := &store.Credential { Login: "foo", Password: "old", Realm: "example.com", Tags: []string { "tag" } }
+  foo.SetField("pin", "1234", true)
+  c.Assert(db.AddCredential(foo), IsNil)
+  foo.Password = "new"
+  c.Assert(db.UpdateCredential(foo), IsNil)
+  c.Assert(db.AddAttachment(foo, &store.Attachment { Name: "key", Data: []byte { 1, 2, 3 } }), IsNil)
+  bar := &store.Credential { Login: "bar" }
+  c.Assert(db.AddCredential(bar), IsNil)
+  c.Assert(db.DeleteCredential(bar), IsNil)
+  c.Assert(db.SetBlindIndex(true), IsNil)
+  before := allCredentials(c, db)
+  stale, _ := store.Open(fileName, "pass")
+  defer stale.Close()
+
+  c.Assert(db.Rekey(), IsNil)
+  c.Assert(stale.AddCredential(&store.Credential { Login: "stale" }), NotNil)
+  c.Assert(db.AddCredential(&store.Credential { Login: "baz" }), IsNil)
+  db.Close()
+
+  db, err := store.Open(fileName, "pass")
+  c.Assert(err, IsNil)
+  defer db.Close()
+  after := allCredentials(c, db)
+  c.Assert(after, HasLen, 2)
+  assertCredentialsEqual(c, after[0], before[0])
+  c.Assert(after[0].Tags, DeepEquals, []string { "tag" })
+  c.Assert(after[0].Field("pin").Value, Equals, "1234")
+  c.Assert(after[0].Created, Equals, before[0].Created)
+  history, _ := db.PasswordHistory(after[0])
+  c.Assert(history[0].Password, Equals, "old")
+  attachments, _ := db.Attachments(after[0])
+  c.Assert(attachments[0].Data, DeepEquals, []byte { 1, 2, 3 })
+  trashed, _ := db.TrashedCredentials()
+  c.Assert(logins(trashed), DeepEquals, []string { "bar" })
+  c.Assert(lookupCredentials(c, db, []string { "example.com" }), DeepEquals, []string { "foo" })
+  actions := auditActions(c, db)
+  c.Assert(actions[len(actions) - 2:], DeepEquals, []string { store.ActionRekey, store.ActionAdd })
+
+  work, err := store.OpenVault(fileName, "work", "workpass")
+  c.Assert(err, IsNil)
+  defer work.Close()
+  c.Assert(work.AddCredential(&store.Credential { Login: "work" }), IsNil)
+  c.Assert(logins(allCredentials(c, work)), DeepEquals, []string { "work" })
+}
+
 func (s *StoreSuite) TestClose(c *C) {
-  db, _ := store.Create(":memory:", "pass", 1)
+  db, _ := s.create(":memory:", "pass", 1)
   db.Close()
 }
@@ -0,0 +1,72 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "crypto/subtle"
+  "errors"
+  "fmt"
+)
+
+// Returns the cipher suite of a vault's keys. Vaults created before the suite
+// was stored use AES-128-GCM.
+func settingsSuite(settings Row) string {
+  if suite := settings.String("cipher_suite"); suite != "" {
+    return suite
+  }
+
+  return crypto.SuiteAES128GCM
+}
+
+// Returns the cipher suite that encrypts the open vault.
+func (store *Store) CipherSuite() string {
+  return store.suite
+}
+
+// Re-encrypts the open vault with a new data key for another cipher suite.
+// A vault that uses AES-128-GCM needs its master password to move to a suite
+// with 256-bit keys, since a longer key is derived from it with a new salt.
+// The password is not needed otherwise.
+func (store *Store) ChangeCipherSuite(suite string, password string) error {
+  size, err := crypto.KeySize(suite)
+  if err != nil {
+    return err
+  }
+
+  if suite == crypto.SuiteAES128GCM {
+    return errors.New(fmt.Sprintf("Cannot change the cipher suite to %s.", suite))
+  }
+
+  if size == len(store.passwordKey) {
+    return store.rekey(suite, store.passwordKey, nil)
+  }
+
+  slot, err := store.slotRow(store.db)
+  if err != nil {
+    return dbError(err)
+  }
+
+  // Slots unlocked by a key file alone use an all-zero password key.
+  if !slotHasPassword(slot) {
+    return store.rekey(suite, make([]byte, size), nil)
+  }
+
+  kdf := rowKDF(slot)
+
+  // Wrapping the new key with the wrong password would lock the vault.
+  passwordKey, err := crypto.LoadPasswordKey(password, slot.Bytes("password_salt"), kdf, len(store.passwordKey))
+  if err != nil {
+    return err
+  }
+
+  if subtle.ConstantTimeCompare(passwordKey, store.passwordKey) != 1 {
+    var e crypto.IncorrectPasswordError
+    return e
+  }
+
+  passwordKey, passwordSalt, err := crypto.NewPasswordKey(password, kdf, size)
+  if err != nil {
+    return err
+  }
+
+  return store.rekey(suite, passwordKey, Row { "password_salt": passwordSalt })
+}
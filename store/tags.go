@@ -0,0 +1,174 @@
+package store
+
+import (
+  "strings"
+  "sort"
+)
+
+// Trims, removes duplicates (ignoring case), and sorts tag names.
+func normalizeTags(tags []string) []string {
+  seen := make(map[string]bool)
+  normalized := make([]string, 0, len(tags))
+
+  for _, tag := range tags {
+    tag = strings.TrimSpace(tag)
+    key := strings.ToLower(tag)
+    if tag == "" || seen[key] {
+      continue
+    }
+
+    seen[key] = true
+    normalized = append(normalized, tag)
+  }
+
+  sort.Slice(normalized, func(i, j int) bool {
+    return strings.ToLower(normalized[i]) < strings.ToLower(normalized[j])
+  })
+
+  return normalized
+}
+
+// Reports whether the credential has all of the given tags, ignoring case.
+func (credential *Credential) HasTags(tags []string) bool {
+  for _, tag := range tags {
+    found := false
+    for _, credentialTag := range credential.Tags {
+      if strings.EqualFold(tag, credentialTag) {
+        found = true
+        break
+      }
+    }
+
+    if !found {
+      return false
+    }
+  }
+
+  return true
+}
+
+// Returns tag names by tag ID.
+func (store *Store) loadTags(q Reader) (map[int]string, error) {
+  rows, err := q.Select("tags", Row { "vault": store.vault })
+  if err != nil {
+    return nil, err
+  }
+
+  tags := make(map[int]string)
+
+  for _, row := range rows {
+    name, err := store.open("tags", "name", store.vaultOwner(), row.Bytes("name"))
+    if err != nil {
+      return nil, CorruptDatabaseError { Err: err }
+    }
+
+    tags[row.Int("id")] = string(name)
+  }
+
+  return tags, nil
+}
+
+// Returns tag names by credential ID.
+func (store *Store) loadCredentialTags(q Reader) (map[int][]string, error) {
+  tags, err := store.loadTags(q)
+  if err != nil {
+    return nil, err
+  }
+
+  uuids, err := store.credentialUUIDs(q)
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := q.Select("credential_tags", nil)
+  if err != nil {
+    return nil, err
+  }
+
+  credentialTags := make(map[int][]string)
+
+  for _, row := range rows {
+    credentialId := row.Int("credential_id")
+    if _, ok := uuids[credentialId]; ok {
+      credentialTags[credentialId] = append(credentialTags[credentialId], tags[row.Int("tag_id")])
+    }
+  }
+
+  for id, names := range credentialTags {
+    credentialTags[id] = normalizeTags(names)
+  }
+
+  return credentialTags, nil
+}
+
+// Replaces the tags linked to a credential, creating tags as needed and
+// removing tags that are no longer used.
+func (store *Store) saveTags(tx Tx, credential *Credential) error {
+  credential.Tags = normalizeTags(credential.Tags)
+
+  if _, err := tx.Delete("credential_tags", Row { "credential_id": credential.id }); err != nil {
+    return err
+  }
+
+  existing, err := store.loadTags(tx)
+  if err != nil {
+    return err
+  }
+
+  tagIds := make(map[string]int)
+  for id, name := range existing {
+    tagIds[strings.ToLower(name)] = id
+  }
+
+  for _, tag := range credential.Tags {
+    id, ok := tagIds[strings.ToLower(tag)]
+    if !ok {
+      id, err = tx.Insert("tags", Row {
+        "vault": store.vault,
+        "name": store.sealString("tags", "name", store.vaultOwner(), tag),
+      })
+
+      if err != nil {
+        return err
+      }
+    }
+
+    _, err = tx.Insert("credential_tags", Row {
+      "credential_id": credential.id,
+      "tag_id": id,
+    })
+
+    if err != nil {
+      return err
+    }
+  }
+
+  return store.deleteUnusedTags(tx)
+}
+
+func (store *Store) deleteUnusedTags(tx Tx) error {
+  rows, err := tx.Select("credential_tags", nil)
+  if err != nil {
+    return err
+  }
+
+  used := make(map[int]bool)
+  for _, row := range rows {
+    used[row.Int("tag_id")] = true
+  }
+
+  tags, err := tx.Select("tags", nil)
+  if err != nil {
+    return err
+  }
+
+  for _, tag := range tags {
+    if !used[tag.Int("id")] {
+      if _, err = tx.Delete("tags", Row { "id": tag.Int("id") }); err != nil {
+        return err
+      }
+    }
+  }
+
+  return nil
+}
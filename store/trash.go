@@ -0,0 +1,132 @@
+package store
+
+import (
+  "time"
+)
+
+// Returns credentials in the trash. As with FindCredentials, passwords and
+// fields are not decrypted.
+func (store *Store) TrashedCredentials() ([]*Credential, error) {
+  return store.allCredentials(true, false)
+}
+
+func (store *Store) FindTrashedCredentials(query []string) ([]*Credential, error) {
+  return store.findCredentials(query, true)
+}
+
+// Moves a credential out of the trash.
+func (store *Store) RestoreCredential(credential *Credential) error {
+  if credential.id == 0 {
+    panic("Invalid credential ID.")
+  }
+
+  err := store.update(func(tx Tx) error {
+    row, err := store.credentialRow(tx, credential.id)
+    if err != nil {
+      return err
+    }
+
+    if row.IsNull("deleted") {
+      return NotFoundError { ID: credential.id }
+    }
+
+    _, err = tx.Update("credentials", Row { "id": credential.id, "vault": store.vault }, Row { "deleted": nil })
+    if err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionRestore, credential)
+  })
+
+  if err == nil {
+    credential.Deleted = time.Time{}
+  }
+
+  return err
+}
+
+// Permanently deletes a credential along with its history, fields,
+// attachments, and tags.
+func (store *Store) PurgeCredential(credential *Credential) error {
+  if credential.id == 0 {
+    panic("Invalid credential ID.")
+  }
+
+  return store.update(func(tx Tx) error {
+    return store.purge(tx, credential)
+  })
+}
+
+// Permanently deletes credentials that have been in the trash longer than the
+// retention period. A zero retention period empties the trash. The trash is
+// read in the same transaction, so a credential restored by another process
+// is never purged.
+func (store *Store) EmptyTrash(retention time.Duration) (int, error) {
+  cutoff := now().Add(-retention)
+  count := 0
+
+  err := store.update(func(tx Tx) error {
+    rows, err := tx.Select("credentials", Row { "vault": store.vault })
+    if err != nil {
+      return err
+    }
+
+    trashed := make([]Row, 0, len(rows))
+    for _, row := range rows {
+      if !row.IsNull("deleted") {
+        trashed = append(trashed, row)
+      }
+    }
+
+    return store.decryptCredentials(tx, trashed, false, func(credential *Credential) error {
+      if credential.Deleted.After(cutoff) {
+        return nil
+      }
+
+      if err := store.purge(tx, credential); err != nil {
+        return err
+      }
+
+      count++
+      return nil
+    })
+  })
+
+  if err != nil {
+    return 0, err
+  }
+
+  return count, nil
+}
+
+func (store *Store) purge(tx Tx, credential *Credential) error {
+  count, err := tx.Delete("credentials", Row { "id": credential.id, "vault": store.vault })
+  if err != nil {
+    return err
+  }
+
+  if err = checkAffected(count, credential.id); err != nil {
+    return err
+  }
+
+  if err = deleteCredentialData(tx, credential.id); err != nil {
+    return err
+  }
+
+  if err = store.deleteUnusedTags(tx); err != nil {
+    return err
+  }
+
+  return store.audit(tx, ActionPurge, credential)
+}
+
+// Deletes the history, attachments, fields, and tag links of a credential.
+func deleteCredentialData(tx Tx, credentialId int) error {
+  for _, table := range []string { "history", "attachments", "fields", "credential_tags" } {
+    if _, err := tx.Delete(table, Row { "credential_id": credentialId }); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+  "crypto/sha256"
+  "crypto/rand"
+  "encoding/hex"
+  "strings"
+  "errors"
+  "fmt"
+)
+
+// Formats 16 bytes as a version 4 UUID.
+func formatUUID(b []byte) string {
+  b[6] = (b[6] & 0x0f) | 0x40
+  b[8] = (b[8] & 0x3f) | 0x80
+
+  return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func newUUID() string {
+  b := make([]byte, 16)
+  if _, err := rand.Read(b); err != nil {
+    panic("Failed to generate random UUID.")
+  }
+
+  return formatUUID(b)
+}
+
+// Returns a UUID determined by the given data. Copies of a database upgraded
+// separately assign the same UUIDs to the credentials they share.
+func derivedUUID(data ...[]byte) string {
+  hash := sha256.New()
+  for _, buffer := range data {
+    hash.Write(buffer)
+  }
+
+  return formatUUID(hash.Sum(nil)[:16])
+}
+
+// Returns the canonical lowercase form of a UUID.
+func parseUUID(uuid string) (string, error) {
+  uuid = strings.ToLower(strings.TrimSpace(uuid))
+  invalid := errors.New(fmt.Sprintf("Invalid credential ID: %s.", uuid))
+
+  if len(uuid) != 36 {
+    return "", invalid
+  }
+
+  for _, i := range []int { 8, 13, 18, 23 } {
+    if uuid[i] != '-' {
+      return "", invalid
+    }
+  }
+
+  if _, err := hex.DecodeString(strings.Replace(uuid, "-", "", -1)); err != nil {
+    return "", invalid
+  }
+
+  return uuid, nil
+}
+
+// Returns the active credential with the given UUID, or nil if there is none.
+// As with FindCredentials, the password and fields are not decrypted.
+func (store *Store) CredentialByUUID(uuid string) (*Credential, error) {
+  uuid, err := parseUUID(uuid)
+  if err != nil {
+    return nil, err
+  }
+
+  rows, err := store.db.Select("credentials", Row { "vault": store.vault, "uuid": uuid, "deleted": nil })
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  var credential *Credential
+  err = store.decryptCredentials(store.db, rows, false, func(c *Credential) error {
+    credential = c
+    return nil
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  return credential, nil
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+  "github.com/schmich/ward/crypto"
+  "strings"
+  "errors"
+  "sort"
+  "fmt"
+)
+
+// The vault opened when no vault is named. Databases created before vaults
+// were added hold only this vault.
+const DefaultVault = "default"
+
+const defaultVaultId = 1
+
+// Returns the name of the open vault.
+func (store *Store) VaultName() string {
+  return store.vaultName
+}
+
+// Returns the names of all vaults in the database, in the order they were
+// created.
+func (store *Store) Vaults() ([]string, error) {
+  rows, err := store.db.Select("settings", nil)
+  if err != nil {
+    return nil, dbError(err)
+  }
+
+  sort.Slice(rows, func(i, j int) bool {
+    return rows[i].Int("vault") < rows[j].Int("vault")
+  })
+
+  names := make([]string, len(rows))
+  for i, row := range rows {
+    names[i] = row.String("name")
+  }
+
+  return names, nil
+}
+
+// Adds an empty vault with its own data key, protected by its own master
+// password.
+func (store *Store) CreateVault(name string, password string, kdf crypto.KDF) error {
+  name = strings.TrimSpace(name)
+  if name == "" {
+    return errors.New("Invalid vault name.")
+  }
+
+  keys, err := newKeys(password, nil, kdf, crypto.DefaultSuite)
+  if err != nil {
+    return err
+  }
+
+  return store.update(func(tx Tx) error {
+    rows, err := tx.Select("settings", nil)
+    if err != nil {
+      return err
+    }
+
+    vault := 0
+    for _, row := range rows {
+      if row.String("name") == name {
+        return errors.New(fmt.Sprintf("Vault \"%s\" already exists.", name))
+      }
+
+      if row.Int("vault") > vault {
+        vault = row.Int("vault")
+      }
+    }
+
+    _, err = insertSettings(tx, vault + 1, name, kdf, keys, latestVersion())
+    if err != nil {
+      return err
+    }
+
+    return store.audit(tx, ActionVault, nil)
+  })
+}
+
+// Permanently deletes the open vault and everything in it. The default vault
+// cannot be removed.
+func (store *Store) RemoveVault() error {
+  if store.vaultName == DefaultVault {
+    return errors.New("The default vault cannot be removed.")
+  }
+
+  return store.update(func(tx Tx) error {
+    uuids, err := store.credentialUUIDs(tx)
+    if err != nil {
+      return err
+    }
+
+    for id := range uuids {
+      if err = deleteCredentialData(tx, id); err != nil {
+        return err
+      }
+    }
+
+    for _, table := range []string { "credentials", "tags", "audit", "key_slots", "settings" } {
+      if _, err = tx.Delete(table, Row { "vault": store.vault }); err != nil {
+        return err
+      }
+    }
+
+    return nil
+  })
+}